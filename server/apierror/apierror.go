@@ -0,0 +1,92 @@
+package apierror
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Code identifies the kind of a failed request for clients to branch on.
+// Codes are part of the API: they are never renamed or reused, new ones
+// may be added. The table in the README lists them.
+type Code string
+
+const (
+	InvalidRequest       Code = "INVALID_REQUEST"
+	Unauthorized         Code = "UNAUTHORIZED"
+	Forbidden            Code = "FORBIDDEN"
+	NotFound             Code = "NOT_FOUND"
+	Conflict             Code = "CONFLICT"
+	Processing           Code = "PROCESSING"
+	Gone                 Code = "GONE"
+	FileExpired          Code = "FILE_EXPIRED"
+	DownloadLimitReached Code = "DOWNLOAD_LIMIT_REACHED"
+	FileTooLarge         Code = "FILE_TOO_LARGE"
+	EmptyFile            Code = "EMPTY_FILE"
+	ChecksumMismatch     Code = "CHECKSUM_MISMATCH"
+	MimetypeNotAllowed   Code = "MIMETYPE_NOT_ALLOWED"
+	InvalidName          Code = "INVALID_NAME"
+	RangeNotSatisfiable  Code = "RANGE_NOT_SATISFIABLE"
+	ExpectationFailed    Code = "EXPECTATION_FAILED"
+	Unprocessable        Code = "UNPROCESSABLE"
+	FileQuarantined      Code = "FILE_QUARANTINED"
+	RateLimited          Code = "RATE_LIMITED"
+	FileBlocked          Code = "FILE_BLOCKED"
+	Internal             Code = "INTERNAL"
+	PermissionDenied     Code = "STORAGE_PERMISSION_DENIED"
+	ReadOnly             Code = "READ_ONLY"
+	StorageFull          Code = "STORAGE_FULL"
+	Unavailable          Code = "UNAVAILABLE"
+	ConfirmationInvalid  Code = "CONFIRMATION_INVALID"
+	InsufficientScope    Code = "INSUFFICIENT_SCOPE"
+)
+
+var statusCodes = map[int]Code{
+	http.StatusBadRequest:                   InvalidRequest,
+	http.StatusUnauthorized:                 Unauthorized,
+	http.StatusForbidden:                    Forbidden,
+	http.StatusNotFound:                     NotFound,
+	http.StatusMethodNotAllowed:             InvalidRequest,
+	http.StatusConflict:                     Conflict,
+	http.StatusGone:                         Gone,
+	http.StatusRequestEntityTooLarge:        FileTooLarge,
+	http.StatusUnsupportedMediaType:         MimetypeNotAllowed,
+	http.StatusRequestedRangeNotSatisfiable: RangeNotSatisfiable,
+	http.StatusExpectationFailed:            ExpectationFailed,
+	http.StatusUnprocessableEntity:          Unprocessable,
+	http.StatusLocked:                       FileQuarantined,
+	http.StatusTooManyRequests:              RateLimited,
+	http.StatusUnavailableForLegalReasons:   FileBlocked,
+	http.StatusServiceUnavailable:           Unavailable,
+	http.StatusInsufficientStorage:          StorageFull,
+}
+
+// ForStatus is the code of an error response no handler gave a more
+// specific one.
+func ForStatus(status int) Code {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= http.StatusInternalServerError {
+		return Internal
+	}
+	return InvalidRequest
+}
+
+const contextKey = "apierror.code"
+
+// Set gives the error response the handler is about to write a more
+// specific code than its status implies.
+func Set(c *gin.Context, code Code) {
+	if code != "" {
+		c.Set(contextKey, code)
+	}
+}
+
+// Of returns the code of the error response written for c with status.
+func Of(c *gin.Context, status int) Code {
+	if value, ok := c.Get(contextKey); ok {
+		return value.(Code)
+	}
+	return ForStatus(status)
+}
@@ -0,0 +1,113 @@
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content codings downloads can be compressed with on the fly.
+const (
+	Brotli = "br"
+	Gzip   = "gzip"
+)
+
+// brotliLevel trades some ratio for speed, downloads are compressed while
+// they are sent.
+const brotliLevel = 5
+
+// Supported reports whether NewWriter can encode the content coding.
+func Supported(coding string) bool {
+	return coding == Brotli || coding == Gzip
+}
+
+// NewWriter compresses what is written to w with the content coding; level
+// applies to gzip only. Close flushes the end of the stream but doesn't
+// close w.
+func NewWriter(w io.Writer, coding string, level int) (io.WriteCloser, error) {
+	switch coding {
+	case Brotli:
+		return brotli.NewWriterLevel(w, brotliLevel), nil
+	case Gzip:
+		return gzip.NewWriterLevel(w, level)
+	}
+	return nil, fmt.Errorf("unsupported content coding %q", coding)
+}
+
+// Compressible reports whether files of the media type are worth storing
+// gzipped. types holds media types ("application/json") and families
+// ending in a slash ("text/").
+func Compressible(mimetype string, types []string) bool {
+	mediatype, _, err := mime.ParseMediaType(mimetype)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(mediatype, t) || mediatype == t {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidLevel reports whether level is a gzip level between
+// gzip.BestSpeed and gzip.BestCompression.
+func ValidLevel(level int) bool {
+	return level >= gzip.BestSpeed && level <= gzip.BestCompression
+}
+
+// CompressFile writes a gzipped copy of src to dst at the given level.
+func CompressFile(src, dst string, level int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewWriterLevel(out, level)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+type reader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r reader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+// Open returns the original content of a gzipped file.
+func Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return reader{Reader: gz, file: f}, nil
+}
@@ -0,0 +1,142 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type sample struct {
+	name string
+	data []byte
+}
+
+// samples stand in for what gets stored: chat logs, API dumps and media
+// that is compressed already.
+func samples() []sample {
+	rng := rand.New(rand.NewSource(1))
+	words := strings.Fields("the upload was sent to the group chat and the files were shared with everyone who asked for them")
+	var text, json bytes.Buffer
+	for text.Len() < 1<<20 {
+		fmt.Fprintf(&text, "2026-01-02 03:04:%02d user%d: ", rng.Intn(60), rng.Intn(50))
+		for i := 0; i < 5+rng.Intn(10); i++ {
+			text.WriteString(words[rng.Intn(len(words))] + " ")
+		}
+		text.WriteString("\n")
+	}
+	json.WriteString("[")
+	for i := 0; json.Len() < 1<<20; i++ {
+		fmt.Fprintf(&json, `{"id":%d,"name":"file-%d.txt","size":%d,"mimetype":"text/plain","tags":["a","b"]},`, i, rng.Intn(1000), rng.Int63n(1<<30))
+	}
+	json.WriteString("{}]")
+	random := make([]byte, 1<<20)
+	rng.Read(random)
+	return []sample{{"text", text.Bytes()}, {"json", json.Bytes()}, {"random", random}}
+}
+
+// BenchmarkCompressFile compares the levels for compression at rest. The
+// ratio metric is the compressed size over the original one.
+func BenchmarkCompressFile(b *testing.B) {
+	dir := b.TempDir()
+	for _, sample := range samples() {
+		name, data := sample.name, sample.data
+		src := filepath.Join(dir, name)
+		if err := os.WriteFile(src, data, 0o644); err != nil {
+			b.Fatal(err)
+		}
+		for level := gzip.BestSpeed; level <= gzip.BestCompression; level++ {
+			b.Run(fmt.Sprintf("%s/level=%d", name, level), func(b *testing.B) {
+				dst := src + ".gz"
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					if err := CompressFile(src, dst, level); err != nil {
+						b.Fatal(err)
+					}
+				}
+				info, err := os.Stat(dst)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportMetric(float64(info.Size())/float64(len(data)), "ratio")
+			})
+		}
+	}
+}
+
+// BenchmarkNewWriter compares the levels for downloads encoded while they
+// are sent, brotli included.
+func BenchmarkNewWriter(b *testing.B) {
+	type encoding struct {
+		label  string
+		coding string
+		level  int
+	}
+	encodings := []encoding{{Brotli, Brotli, 0}}
+	for level := gzip.BestSpeed; level <= gzip.BestCompression; level++ {
+		encodings = append(encodings, encoding{fmt.Sprintf("level=%d", level), Gzip, level})
+	}
+	for _, sample := range samples() {
+		data := sample.data
+		for _, encoding := range encodings {
+			b.Run(sample.name+"/"+encoding.label, func(b *testing.B) {
+				var out countingWriter
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					out = 0
+					w, err := NewWriter(&out, encoding.coding, encoding.level)
+					if err != nil {
+						b.Fatal(err)
+					}
+					w.Write(data)
+					w.Close()
+				}
+				b.ReportMetric(float64(out)/float64(len(data)), "ratio")
+			})
+		}
+	}
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func TestCompressFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "notes.txt"), filepath.Join(dir, "notes.txt.gz")
+	content := bytes.Repeat([]byte("compress me "), 1000)
+	if err := os.WriteFile(src, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompressFile(src, dst, gzip.BestSpeed); err != nil {
+		t.Fatal(err)
+	}
+	in, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	got, err := io.ReadAll(in)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Open() read %d bytes, %v; want the original %d", len(got), err, len(content))
+	}
+	if err := CompressFile(src, dst, 10); err == nil {
+		t.Error("CompressFile() accepted level 10")
+	}
+}
+
+func TestValidLevel(t *testing.T) {
+	for level, want := range map[int]bool{-1: false, 0: false, 1: true, 6: true, 9: true, 10: false} {
+		if got := ValidLevel(level); got != want {
+			t.Errorf("ValidLevel(%d) = %v, want %v", level, got, want)
+		}
+	}
+}
@@ -0,0 +1,564 @@
+package config
+
+import (
+	"log"
+	"messangere/compression"
+	"messangere/filehash"
+	"messangere/imageconv"
+	"messangere/namepolicy"
+	"messangere/naming"
+	"messangere/scope"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultCompressTypes = "text/,application/json,application/xml,application/javascript,application/x-ndjson,image/svg+xml"
+
+const (
+	LayoutID   = "id"
+	LayoutHash = "hash"
+)
+
+// StorageRoute stores files whose mimetype starts with Prefix in Dir.
+type StorageRoute struct {
+	Prefix string
+	Dir    string
+}
+
+const (
+	EmptyUploadsReject = "reject"
+	EmptyUploadsAllow  = "allow"
+)
+
+type Config struct {
+	AdminToken            string
+	EventBufferSize       int
+	EventMaxSubscribers   int
+	QuarantineEnabled     bool
+	ScanCommand           []string
+	ScanTimeout           time.Duration
+	IdempotencyTTL        time.Duration
+	ConfirmGracePeriod    time.Duration
+	UploadSessionTTL      time.Duration
+	DBHealthInterval      time.Duration
+	IntegrityScan         bool
+	IntegrityInterval     time.Duration
+	IntegrityBatchSize    int
+	IntegrityRate         int64
+	TempCleanupAge        time.Duration
+	TempCleanupInterval   time.Duration
+	SnapshotDir           string
+	SnapshotInterval      time.Duration
+	SnapshotKeep          int
+	RequireMultipart      bool
+	AutoMigrate           bool
+	HeicConvertTo         string
+	HeicConvertCommand    []string
+	HeicKeepOriginal      bool
+	DuplicatesRateLimit   int
+	EmptyUploads          string
+	MimetypeAliases       map[string]string
+	SignatureCheck        bool
+	SignatureAllow        map[string]bool
+	SignatureDeny         map[string]bool
+	SignaturesFile        string
+	StorageLayout         string
+	StorageRoutes         []StorageRoute
+	StorageHeaders        bool
+	StorageRegion         string
+	NodeID                string
+	NamePattern           *regexp.Regexp
+	NamePrefixes          []string
+	NameNoSpaces          bool
+	NameForbidden         string
+	NameMaxLength         int
+	NameMaxBytes          int
+	MaxUploadBytes        int64
+	MaxTotalBytes         int64
+	HashAlgorithms        []string
+	CompressAtRest        bool
+	CompressTypes         []string
+	CompressLevel         int
+	DownloadCompression   bool
+	DownloadEncodings     []string
+	APITokens             map[string]scope.Token
+	Importers             map[string]bool
+	RedirectHosts         map[string]bool
+	UploadSizeBuckets     []float64
+	UploadDurationBuckets []float64
+	TelemetrySampleRate   float64
+	TracingEndpoint       string
+	TracingSampleRatio    float64
+	TracingService        string
+	RedactHeaders         []string
+	ProcessingWorkers     int
+	ProcessingQueueSize   int
+	HookTimeout           time.Duration
+	HookAttempts          int
+	HookRetryBackoff      time.Duration
+	ThumbnailSize         int
+	ImageMaxPixels        int64
+	ThumbnailOnDemand     bool
+	PlaceholderImage      string
+	PlaceholderDefault    bool
+	ImageAutoOrient       bool
+	ImageVariantFormats   []string
+	ImageVariantQuality   int
+	ImageVariantCommand   []string
+	SensitiveScan         bool
+	SensitivePatterns     string
+	HLSEnabled            bool
+	HLSCommand            []string
+	HLSSegmentLength      time.Duration
+	PreviewMaxLines       int
+	DataURIMaxBytes       int64
+	SimilarMaxDistance    int
+	MetadataMaxBytes      int
+	FileCacheSize         int
+	DownloadRateLimit     int64
+	WriteTimeout          time.Duration
+	NameTemplate          string
+	DeleteExhausted       bool
+	ActiveContentCSP      string
+	ActiveContentInline   bool
+	UserDownloadRates     map[string]int64
+	UserDownloadSlots     int
+	FileDownloadSlots     int
+	ChaosMode             bool
+	ChaosLatency          time.Duration
+	ChaosErrorRate        float64
+	ChaosDropRate         float64
+	StatsTimezone         *time.Location
+	PublicBaseURL         string
+	LinkSigningKey        string
+	LinkTTL               time.Duration
+	QRSize                int
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSMinVersion         string
+	HSTSMaxAge            time.Duration
+	HTTPRedirectAddr      string
+}
+
+// TLSEnabled reports whether both a certificate and a key are configured.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+func Load() *Config {
+	return &Config{
+		AdminToken:          getEnv("ADMIN_TOKEN", ""),
+		EventBufferSize:     getEnvInt("EVENT_BUFFER_SIZE", 256),
+		EventMaxSubscribers: getEnvInt("EVENT_MAX_SUBSCRIBERS", 8),
+		QuarantineEnabled:   getEnvBool("QUARANTINE_ENABLED", false),
+		ScanCommand:         strings.Fields(getEnv("SCAN_COMMAND", "")),
+		ScanTimeout:         getEnvDuration("SCAN_TIMEOUT", 5*time.Minute),
+		IdempotencyTTL:      getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+		ConfirmGracePeriod:  getEnvDuration("CONFIRM_GRACE_PERIOD", 2*time.Minute),
+		UploadSessionTTL:    getEnvDuration("UPLOAD_SESSION_TTL", 24*time.Hour),
+		DBHealthInterval:    getEnvDuration("DB_HEALTH_INTERVAL", 5*time.Second),
+		IntegrityScan:       getEnvBool("INTEGRITY_SCAN", false),
+		IntegrityInterval:   getEnvDuration("INTEGRITY_SCAN_INTERVAL", 24*time.Hour),
+		IntegrityBatchSize:  getEnvInt("INTEGRITY_SCAN_BATCH_SIZE", 100),
+		IntegrityRate:       int64(getEnvInt("INTEGRITY_SCAN_RATE", 10<<20)),
+		TempCleanupAge:      getEnvDuration("TEMP_CLEANUP_AGE", 24*time.Hour),
+		TempCleanupInterval: getEnvDuration("TEMP_CLEANUP_INTERVAL", time.Hour),
+		SnapshotDir:         getEnv("SNAPSHOT_DIR", "./snapshots"),
+		SnapshotInterval:    getEnvDuration("SNAPSHOT_INTERVAL", 0),
+		SnapshotKeep:        getEnvInt("SNAPSHOT_KEEP", 7),
+		RequireMultipart:    getEnvBool("UPLOAD_REQUIRE_MULTIPART", true),
+		AutoMigrate:         getEnvBool("AUTO_MIGRATE", true),
+		HeicConvertTo:       getEnv("HEIC_CONVERT_TO", ""),
+		HeicConvertCommand:  strings.Fields(getEnv("HEIC_CONVERT_COMMAND", "heif-convert")),
+		HeicKeepOriginal:    getEnvBool("HEIC_KEEP_ORIGINAL", false),
+		DuplicatesRateLimit: getEnvInt("DUPLICATES_RATE_LIMIT", 10),
+		EmptyUploads:        getEnvChoice("EMPTY_UPLOADS", EmptyUploadsReject, EmptyUploadsAllow),
+		MimetypeAliases:     parseAliases(getEnv("MIMETYPE_ALIASES", "")),
+		SignatureCheck:      getEnvBool("SIGNATURE_CHECK", false),
+		SignatureAllow:      parseSet(getEnv("SIGNATURE_ALLOW", "")),
+		SignatureDeny:       parseSet(getEnv("SIGNATURE_DENY", "")),
+		SignaturesFile:      getEnv("SIGNATURES_FILE", ""),
+		StorageLayout:       getEnvChoice("STORAGE_LAYOUT", LayoutID, LayoutHash),
+		StorageRoutes:       parseStorageRoutes(getEnv("STORAGE_ROUTES", "")),
+		StorageHeaders:      getEnvBool("STORAGE_HEADERS", false),
+		StorageRegion:       getEnv("STORAGE_REGION", ""),
+		NodeID:              getEnv("NODE_ID", ""),
+		NamePattern:         getEnvNamePattern("NAME_PATTERN"),
+		NamePrefixes:        parseList(getEnv("NAME_PREFIXES", "")),
+		NameNoSpaces:        getEnvBool("NAME_NO_SPACES", false),
+		NameForbidden:       getEnv("NAME_FORBIDDEN_CHARS", ""),
+		NameMaxLength:       getEnvInt("NAME_MAX_LENGTH", 0),
+		NameMaxBytes:        getEnvInt("NAME_MAX_BYTES", 255),
+		MaxUploadBytes:      int64(getEnvInt("UPLOAD_MAX_BYTES", 0)),
+		MaxTotalBytes:       int64(getEnvInt("MAX_TOTAL_BYTES", 0)),
+		HashAlgorithms:      parseHashAlgorithms(getEnv("HASH_ALGORITHMS", filehash.SHA256)),
+		CompressAtRest:      getEnvBool("COMPRESS_AT_REST", false),
+		CompressTypes:       strings.Split(getEnv("COMPRESS_TYPES", defaultCompressTypes), ","),
+		CompressLevel:       getEnvIntRange("COMPRESS_LEVEL", 6, 1, 9),
+		DownloadCompression: getEnvBool("DOWNLOAD_COMPRESSION", false),
+		DownloadEncodings:   parseEncodings(getEnv("DOWNLOAD_ENCODINGS", "br,gzip")),
+		APITokens:           parseTokens(getEnv("API_TOKENS", "")),
+		Importers:           parseSet(getEnv("IMPORTER_USERS", "")),
+		RedirectHosts:       parseSet(strings.ToLower(getEnv("UPLOAD_REDIRECT_HOSTS", ""))),
+		UploadSizeBuckets: getEnvFloats("UPLOAD_SIZE_BUCKETS",
+			[]float64{1 << 10, 64 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30}),
+		UploadDurationBuckets: getEnvFloats("UPLOAD_DURATION_BUCKETS",
+			[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}),
+		TelemetrySampleRate: getEnvFloat("TELEMETRY_SAMPLE_RATE", 0.01),
+		TracingEndpoint:     getEnv("TRACING_ENDPOINT", ""),
+		TracingSampleRatio:  getEnvFloat("TRACING_SAMPLE_RATIO", 1),
+		TracingService:      getEnv("TRACING_SERVICE_NAME", "messangere"),
+		RedactHeaders:       strings.Split(getEnv("LOG_REDACT_HEADERS", ""), ","),
+		ProcessingWorkers:   getEnvInt("PROCESSING_WORKERS", runtime.NumCPU()),
+		ProcessingQueueSize: getEnvInt("PROCESSING_QUEUE_SIZE", 1000),
+		HookTimeout:         getEnvDuration("HOOK_TIMEOUT", 2*time.Minute),
+		HookAttempts:        getEnvInt("HOOK_MAX_ATTEMPTS", 3),
+		HookRetryBackoff:    getEnvDuration("HOOK_RETRY_BACKOFF", 30*time.Second),
+		ThumbnailSize:       getEnvInt("THUMBNAIL_SIZE", 256),
+		ImageMaxPixels:      int64(getEnvInt("IMAGE_MAX_PIXELS", 50_000_000)),
+		ThumbnailOnDemand:   getEnvBool("THUMBNAIL_ON_DEMAND", true),
+		PlaceholderImage:    getEnv("PLACEHOLDER_IMAGE", ""),
+		PlaceholderDefault:  getEnvBool("PLACEHOLDER_DEFAULT", false),
+		ImageAutoOrient:     getEnvBool("IMAGE_AUTO_ORIENT", false),
+		ImageVariantFormats: parseImageVariants(getEnv("IMAGE_VARIANT_FORMATS", "")),
+		ImageVariantQuality: getEnvIntRange("IMAGE_VARIANT_QUALITY", 75, 1, 100),
+		ImageVariantCommand: strings.Fields(getEnv("IMAGE_VARIANT_COMMAND", "magick")),
+		SensitiveScan:       getEnvBool("SENSITIVE_SCAN", false),
+		SensitivePatterns:   getEnv("SENSITIVE_PATTERNS_FILE", ""),
+		HLSEnabled:          getEnvBool("HLS_ENABLED", false),
+		HLSCommand:          strings.Fields(getEnv("HLS_COMMAND", "ffmpeg")),
+		HLSSegmentLength:    getEnvDuration("HLS_SEGMENT_DURATION", 6*time.Second),
+		PreviewMaxLines:     getEnvInt("PREVIEW_MAX_LINES", 500),
+		DataURIMaxBytes:     int64(getEnvInt("DATAURI_MAX_BYTES", 256<<10)),
+		SimilarMaxDistance:  getEnvInt("SIMILAR_MAX_DISTANCE", 10),
+		MetadataMaxBytes:    getEnvInt("METADATA_MAX_BYTES", 16<<10),
+		FileCacheSize:       getEnvInt("FILE_CACHE_SIZE", 1024),
+		DownloadRateLimit:   int64(getEnvInt("DOWNLOAD_RATE_LIMIT", 0)),
+		WriteTimeout:        getEnvDuration("DOWNLOAD_WRITE_TIMEOUT", 30*time.Second),
+		NameTemplate:        getEnvNameTemplate("DOWNLOAD_NAME_TEMPLATE", "{name}"),
+		DeleteExhausted:     getEnvBool("DELETE_EXHAUSTED_FILES", false),
+		ActiveContentCSP:    getEnv("ACTIVE_CONTENT_CSP", "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"),
+		ActiveContentInline: getEnvBool("ACTIVE_CONTENT_INLINE", false),
+		UserDownloadRates:   parseUserLimits(getEnv("USER_DOWNLOAD_RATE_LIMITS", "")),
+		UserDownloadSlots:   getEnvInt("MAX_CONCURRENT_DOWNLOADS_PER_USER", 0),
+		FileDownloadSlots:   getEnvInt("MAX_CONCURRENT_DOWNLOADS_PER_FILE", 0),
+		ChaosMode:           getEnvBool("CHAOS_MODE", false),
+		ChaosLatency:        getEnvDuration("CHAOS_LATENCY", 0),
+		ChaosErrorRate:      getEnvFloat("CHAOS_ERROR_RATE", 0),
+		ChaosDropRate:       getEnvFloat("CHAOS_DROP_RATE", 0),
+		StatsTimezone:       getEnvLocation("STATS_TIMEZONE", time.UTC),
+		PublicBaseURL:       strings.TrimSuffix(getEnv("PUBLIC_BASE_URL", ""), "/"),
+		LinkSigningKey:      getEnv("LINK_SIGNING_KEY", ""),
+		LinkTTL:             getEnvDuration("LINK_TTL", 24*time.Hour),
+		QRSize:              getEnvInt("QR_SIZE", 256),
+		TLSCertFile:         getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:          getEnv("TLS_KEY_FILE", ""),
+		TLSMinVersion:       getEnvChoice("TLS_MIN_VERSION", "1.2", "1.0", "1.1", "1.3"),
+		HSTSMaxAge:          getEnvDuration("HSTS_MAX_AGE", 0),
+		HTTPRedirectAddr:    getEnv("HTTP_REDIRECT_ADDR", ""),
+	}
+}
+
+func getEnv(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return def
+}
+
+func getEnvInt(key string, def int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %d", value, key, def)
+		return def
+	}
+	return n
+}
+
+// getEnvIntRange is getEnvInt for values that must lie between min and max.
+func getEnvIntRange(key string, def, min, max int) int {
+	n := getEnvInt(key, def)
+	if n < min || n > max {
+		log.Printf("Invalid value %d for %s, must be between %d and %d, using default %d", n, key, min, max, def)
+		return def
+	}
+	return n
+}
+
+func getEnvBool(key string, def bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %t", value, key, def)
+		return def
+	}
+	return b
+}
+
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %s", value, key, def)
+		return def
+	}
+	return d
+}
+
+func getEnvLocation(key string, def *time.Location) *time.Location {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	loc, err := time.LoadLocation(value)
+	if err != nil || loc.String() == "Local" {
+		log.Printf("Invalid value %q for %s, using default %s", value, key, def)
+		return def
+	}
+	return loc
+}
+
+// getEnvChoice returns the value of key if it is one of the allowed values
+// and def otherwise.
+func getEnvChoice(key, def string, allowed ...string) string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	for _, choice := range append(allowed, def) {
+		if strings.EqualFold(value, choice) {
+			return choice
+		}
+	}
+	log.Printf("Invalid value %q for %s, using default %s", value, key, def)
+	return def
+}
+
+// getEnvNameTemplate returns the value of key if it is a valid download
+// name template and def otherwise.
+func getEnvNameTemplate(key, def string) string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	if _, err := naming.Parse(value); err != nil {
+		log.Printf("Invalid value %q for %s (%v), using default %s", value, key, err, def)
+		return def
+	}
+	return value
+}
+
+// getEnvNamePattern compiles the filename pattern, nil when unset or
+// invalid.
+func getEnvNamePattern(key string) *regexp.Regexp {
+	value := getEnv(key, "")
+	if value == "" {
+		return nil
+	}
+	pattern, err := namepolicy.Compile(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s (%v), names are not checked against a pattern", value, key, err)
+		return nil
+	}
+	return pattern
+}
+
+// parseList reads a comma separated list, skipping empty entries.
+func parseList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// parseHashAlgorithms reads the checksums computed for uploads, dropping
+// the ones that aren't supported.
+func parseHashAlgorithms(value string) []string {
+	var algorithms []string
+	for _, name := range parseList(strings.ToLower(value)) {
+		if !filehash.Supported(name) {
+			log.Printf("Ignoring unsupported hash algorithm %q", name)
+			continue
+		}
+		algorithms = append(algorithms, name)
+	}
+	return algorithms
+}
+
+// parseEncodings reads the content codings downloads may use, most
+// preferred first, dropping the ones that aren't supported.
+func parseEncodings(value string) []string {
+	var encodings []string
+	for _, coding := range parseList(strings.ToLower(value)) {
+		if !compression.Supported(coding) {
+			log.Printf("Ignoring unsupported download encoding %q", coding)
+			continue
+		}
+		encodings = append(encodings, coding)
+	}
+	return encodings
+}
+
+// parseImageVariants reads the formats images get variants in, most
+// preferred first, dropping the ones that aren't supported.
+func parseImageVariants(value string) []string {
+	var formats []string
+	for _, name := range parseList(strings.ToLower(value)) {
+		if _, ok := imageconv.LookupVariant(name); !ok {
+			log.Printf("Ignoring unsupported image variant format %q", name)
+			continue
+		}
+		formats = append(formats, name)
+	}
+	return formats
+}
+
+// parseSet reads a comma separated list into a set.
+func parseSet(value string) map[string]bool {
+	set := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			set[entry] = true
+		}
+	}
+	return set
+}
+
+// parseAliases reads a comma separated list of alias=canonical mimetypes.
+func parseAliases(value string) map[string]string {
+	aliases := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		alias, canonical, found := strings.Cut(entry, "=")
+		alias, canonical = strings.TrimSpace(alias), strings.TrimSpace(canonical)
+		if !found || !strings.Contains(alias, "/") || !strings.Contains(canonical, "/") {
+			log.Printf("Ignoring malformed mimetype alias %q", entry)
+			continue
+		}
+		aliases[alias] = canonical
+	}
+	return aliases
+}
+
+// parseTokens reads a comma separated list of token:user pairs, each
+// optionally followed by :scopes, e.g. tok:alice:read+write. Tokens without
+// scopes get scope.Default.
+func parseTokens(value string) map[string]scope.Token {
+	tokens := make(map[string]scope.Token)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		token, user, found := strings.Cut(entry, ":")
+		if !found || token == "" || user == "" {
+			log.Printf("Ignoring malformed API_TOKENS entry")
+			continue
+		}
+		scopes := scope.Default
+		// User names may contain colons, a last part that isn't a list of
+		// scopes is part of the name.
+		if i := strings.LastIndex(user, ":"); i > 0 {
+			if parsed, ok := scope.Parse(user[i+1:]); ok {
+				user, scopes = user[:i], parsed
+			}
+		}
+		tokens[token] = scope.Token{User: user, Scopes: scopes}
+	}
+	return tokens
+}
+
+func getEnvFloat(key string, def float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %g", value, key, def)
+		return def
+	}
+	return f
+}
+
+// getEnvFloats reads a comma separated list of numbers.
+func getEnvFloats(key string, def []float64) []float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	var values []float64
+	for _, field := range strings.Split(value, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			log.Printf("Invalid value %q for %s, using the defaults", value, key)
+			return def
+		}
+		values = append(values, f)
+	}
+	return values
+}
+
+// parseStorageRoutes reads "prefix=dir" entries separated by commas. The
+// routes are ordered longest prefix first, so the first match is the most
+// specific one.
+func parseStorageRoutes(value string) []StorageRoute {
+	var routes []StorageRoute
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, dir, found := strings.Cut(entry, "=")
+		prefix, dir = strings.TrimSpace(prefix), strings.TrimSpace(dir)
+		if !found || prefix == "" || dir == "" {
+			log.Printf("Ignoring malformed storage route %q", entry)
+			continue
+		}
+		routes = append(routes, StorageRoute{Prefix: strings.ToLower(prefix), Dir: dir})
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].Prefix) > len(routes[j].Prefix)
+	})
+	return routes
+}
+
+// parseUserLimits reads a comma separated list of user:number pairs.
+func parseUserLimits(value string) map[string]int64 {
+	limits := make(map[string]int64)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		user, number, found := strings.Cut(entry, ":")
+		n, err := strconv.ParseInt(number, 10, 64)
+		if !found || user == "" || err != nil || n < 0 {
+			log.Printf("Ignoring malformed limit entry %q", entry)
+			continue
+		}
+		limits[user] = n
+	}
+	return limits
+}
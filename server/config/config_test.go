@@ -0,0 +1,40 @@
+package config
+
+import (
+	"messangere/scope"
+	"reflect"
+	"testing"
+)
+
+func TestParseTokens(t *testing.T) {
+	got := parseTokens(" tok1:alice , tok2:bob:read, tok3:carol:read+WRITE,tok4:urn:dave, tok5:erin:admin,broken,:frank,tok6:")
+	want := map[string]scope.Token{
+		"tok1": {User: "alice", Scopes: scope.Default},
+		"tok2": {User: "bob", Scopes: scope.Set{scope.Read}},
+		"tok3": {User: "carol", Scopes: scope.Set{scope.Read, scope.Write}},
+		// A last part that isn't a list of scopes belongs to the name.
+		"tok4": {User: "urn:dave", Scopes: scope.Default},
+		"tok5": {User: "erin", Scopes: scope.Set{scope.Admin}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTokens() = %v, want %v", got, want)
+	}
+	if tokens := parseTokens(""); len(tokens) != 0 {
+		t.Errorf("parseTokens(\"\") = %v, want none", tokens)
+	}
+}
+
+func TestGetEnvChoice(t *testing.T) {
+	for value, want := range map[string]string{
+		"":       EmptyUploadsReject,
+		"allow":  EmptyUploadsAllow,
+		"ALLOW":  EmptyUploadsAllow,
+		"reject": EmptyUploadsReject,
+		"keep":   EmptyUploadsReject,
+	} {
+		t.Setenv("EMPTY_UPLOADS", value)
+		if got := getEnvChoice("EMPTY_UPLOADS", EmptyUploadsReject, EmptyUploadsAllow); got != want {
+			t.Errorf("EMPTY_UPLOADS=%q: got %s, want %s", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package confirmation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	operation string
+	expiresAt time.Time
+}
+
+// Store hands out confirmation tokens for destructive operations. A token
+// is bound to the operation it was issued for, is valid for the grace
+// period and can be redeemed once.
+type Store struct {
+	mu      sync.Mutex
+	entries map[string]entry
+	grace   time.Duration
+}
+
+func NewStore(grace time.Duration) *Store {
+	s := &Store{
+		entries: make(map[string]entry),
+		grace:   grace,
+	}
+	go s.sweep()
+	return s
+}
+
+// Issue returns a new token for the operation and when it expires.
+func (s *Store) Issue(operation string) (string, time.Time, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(buf)
+	expiresAt := time.Now().Add(s.grace)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[token] = entry{operation: operation, expiresAt: expiresAt}
+	return token, expiresAt, nil
+}
+
+// Redeem reports whether token was issued for the operation and hasn't
+// expired. The token is used up either way.
+func (s *Store) Redeem(token, operation string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[token]
+	delete(s.entries, token)
+	return ok && e.operation == operation && time.Now().Before(e.expiresAt)
+}
+
+func (s *Store) sweep() {
+	interval := s.grace / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		now := time.Now()
+		s.mu.Lock()
+		for token, e := range s.entries {
+			if now.After(e.expiresAt) {
+				delete(s.entries, token)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
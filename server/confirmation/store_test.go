@@ -0,0 +1,46 @@
+package confirmation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore(time.Minute)
+	token, expiresAt, err := s.Issue("dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 32 || time.Until(expiresAt) <= 0 {
+		t.Fatalf("Issue() = %q, %v", token, expiresAt)
+	}
+	if other, _, _ := s.Issue("dedupe"); other == token {
+		t.Fatal("Issue() handed out the same token twice")
+	}
+	if s.Redeem(token, "session-delete:1") {
+		t.Error("token redeemed for another operation")
+	}
+	// A failed redeem uses the token up as well.
+	if s.Redeem(token, "dedupe") {
+		t.Error("token redeemed twice")
+	}
+	token, _, _ = s.Issue("dedupe")
+	if !s.Redeem(token, "dedupe") {
+		t.Error("fresh token not redeemed")
+	}
+	if s.Redeem("unknown", "dedupe") {
+		t.Error("unknown token redeemed")
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	s := NewStore(time.Millisecond)
+	token, _, err := s.Issue("dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if s.Redeem(token, "dedupe") {
+		t.Error("expired token redeemed")
+	}
+}
@@ -0,0 +1,27 @@
+package database
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const uniqueViolation = "23505"
+
+var uniqueKeyDetail = regexp.MustCompile(`Key \(([^)]+)\)=`)
+
+// UniqueViolation reports whether err is a Postgres unique-constraint
+// violation (SQLSTATE 23505) and, if so, which column(s) conflicted. The
+// column list is taken from the error detail and falls back to the
+// constraint name.
+func UniqueViolation(err error) (field string, ok bool) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != uniqueViolation {
+		return "", false
+	}
+	if m := uniqueKeyDetail.FindStringSubmatch(pgErr.Detail); m != nil {
+		return m[1], true
+	}
+	return pgErr.ConstraintName, true
+}
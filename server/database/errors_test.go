@@ -0,0 +1,62 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestUniqueViolation(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		field string
+		ok    bool
+	}{
+		{
+			name:  "column from the detail",
+			err:   &pgconn.PgError{Code: "23505", Detail: "Key (external_id)=(abc) already exists.", ConstraintName: "idx_files_external_id"},
+			field: "external_id",
+			ok:    true,
+		},
+		{
+			name:  "several columns",
+			err:   &pgconn.PgError{Code: "23505", Detail: "Key (file_id, user_id)=(1, bob) already exists."},
+			field: "file_id, user_id",
+			ok:    true,
+		},
+		{
+			name:  "constraint name without a detail",
+			err:   &pgconn.PgError{Code: "23505", ConstraintName: "idx_files_external_id"},
+			field: "idx_files_external_id",
+			ok:    true,
+		},
+		{
+			name:  "wrapped",
+			err:   fmt.Errorf("insert: %w", &pgconn.PgError{Code: "23505", Detail: "Key (id)=(1) already exists."}),
+			field: "id",
+			ok:    true,
+		},
+		{
+			name: "other constraint",
+			err:  &pgconn.PgError{Code: "23503", Detail: "Key (file_id)=(1) is not present in table \"files\"."},
+		},
+		{
+			name: "not a postgres error",
+			err:  errors.New("connection refused"),
+		},
+		{
+			name: "no error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field, ok := UniqueViolation(tt.err)
+			if field != tt.field || ok != tt.ok {
+				t.Errorf("UniqueViolation() = %q, %v, want %q, %v", field, ok, tt.field, tt.ok)
+			}
+		})
+	}
+}
@@ -1,21 +1,235 @@
 package database
 
 import (
+	"time"
+
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+const (
+	PermissionRead = "read"
+	PermissionNone = "none"
+)
+
+const (
+	HookPending = "pending"
+	HookRunning = "running"
+	HookDone    = "done"
+	HookFailed  = "failed"
+	// Runs in HookRetrying failed and wait for their next attempt.
+	HookRetrying = "retrying"
+)
+
+// Kinds of FileVariant.
+const (
+	VariantThumbnail = "thumbnail"
+	VariantOriginal  = "original"
+	// VariantHLS is the playlist of a video packaged for streaming, its
+	// segments are stored in the same directory.
+	VariantHLS = "hls"
+	// VariantOriented is a JPEG turned upright by its EXIF orientation,
+	// served instead of the upload when IMAGE_AUTO_ORIENT is on.
+	VariantOriented = "oriented"
+	// VariantWebP and VariantAVIF re-encode JPEG and PNG images for
+	// clients accepting these formats, see IMAGE_VARIANT_FORMATS.
+	VariantWebP = "webp"
+	VariantAVIF = "avif"
+)
+
+const (
+	StatusQuarantined = "quarantined"
+	StatusReady       = "ready"
+	StatusInfected    = "infected"
+)
+
 type Files struct {
-	ID          uint64 `gorm:"primary key;autoIncrement" json:"id"`
-	Name        string `json:"name"`
-	Mimetype    string `json:"mimetype"`
-	StoragePath string `json:"storage_path"`
-	Size        uint64 `json:"size"`
+	ID          uint64     `gorm:"primary key;autoIncrement" json:"id"`
+	Name        string     `json:"name"`
+	Mimetype    string     `json:"mimetype"`
+	StoragePath string     `json:"storage_path"`
+	Size        uint64     `json:"size"`
+	Owner       string     `gorm:"not null;default:'';index" json:"owner"`
+	Sha256      string     `gorm:"not null;default:'';index" json:"sha256"`
+	Status      string     `gorm:"not null;default:ready;index" json:"status"`
+	Folder      string     `gorm:"not null;default:'';index" json:"folder"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CreatedAt   time.Time  `gorm:"index" json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Metadata    JSONMap    `json:"metadata,omitempty"`
+	// DownloadRateLimit caps download speed of this file in bytes per
+	// second; 0 uses the server default.
+	DownloadRateLimit int64 `gorm:"not null;default:0" json:"download_rate_limit,omitempty"`
+	// PerceptualHash is the difference hash of image uploads, stored as
+	// the signed bit pattern of the 64-bit hash.
+	PerceptualHash *int64 `gorm:"index" json:"perceptual_hash,omitempty"`
+	// Compressed files are stored gzipped; Size is still the original size.
+	Compressed bool `gorm:"not null;default:false" json:"compressed,omitempty"`
+	// Sensitive is set by the content scan when the file looks like it
+	// holds secrets; SensitivePatterns names the patterns that matched,
+	// comma separated.
+	Sensitive         bool   `gorm:"not null;default:false;index" json:"sensitive,omitempty"`
+	SensitivePatterns string `gorm:"not null;default:''" json:"sensitive_patterns,omitempty"`
+	// MaxDownloads limits how often the file can be downloaded, 0 means
+	// unlimited. DownloadsRemaining counts down with every download.
+	MaxDownloads       int64 `gorm:"not null;default:0" json:"max_downloads,omitempty"`
+	DownloadsRemaining int64 `gorm:"not null;default:0" json:"downloads_remaining,omitempty"`
+	// SessionID groups files uploaded together, see UploadSession.
+	SessionID string `gorm:"not null;default:'';index" json:"session_id,omitempty"`
+	// ExternalID is an identifier chosen by the uploading client. It is
+	// NULL unless set, so files without one don't collide.
+	ExternalID *string `gorm:"uniqueIndex" json:"external_id,omitempty"`
+	// DownloadCount counts successful downloads, ranges and archive
+	// entries included.
+	DownloadCount int64 `gorm:"not null;default:0" json:"download_count"`
+	// Hashes holds the hex encoded checksums of HASH_ALGORITHMS other than
+	// sha256, by algorithm.
+	Hashes JSONMap `json:"hashes,omitempty"`
+	// OriginalName is the name the client sent when it was longer than
+	// NAME_MAX_BYTES and Name holds the truncated one.
+	OriginalName string `gorm:"not null;default:''" json:"original_name,omitempty"`
+}
+
+// UploadSession groups the files a user uploads for one message. Uploads
+// can be added to a session until it expires.
+type UploadSession struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	Owner     string    `gorm:"not null;default:'';index" json:"owner"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+}
+
+// FileVariant is a file derived from a stored file, such as its thumbnail
+// or the original kept when the upload was converted.
+type FileVariant struct {
+	FileID      uint64    `gorm:"primaryKey" json:"file_id"`
+	Kind        string    `gorm:"primaryKey" json:"kind"`
+	Params      JSONMap   `json:"params,omitempty"`
+	StoragePath string    `gorm:"not null" json:"storage_path"`
+	Size        int64     `gorm:"not null;default:0" json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// FileAccess is the last time a user downloaded a file.
+type FileAccess struct {
+	UserID         string    `gorm:"primaryKey" json:"user_id"`
+	FileID         uint64    `gorm:"primaryKey;index" json:"file_id"`
+	LastAccessedAt time.Time `gorm:"not null;index" json:"last_accessed_at"`
+}
+
+// HookRun is the state of one post-upload hook for one file.
+type HookRun struct {
+	FileID    uint64    `gorm:"primaryKey" json:"file_id"`
+	Hook      string    `gorm:"primaryKey" json:"hook"`
+	State     string    `gorm:"not null" json:"state"`
+	Error     string    `json:"error,omitempty"`
+	Attempts  int       `gorm:"not null;default:0" json:"attempts"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// FailedJob is a background job that failed on every attempt. It is kept
+// until it is retried through the admin API or its file is deleted.
+type FailedJob struct {
+	ID             uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	FileID         uint64    `gorm:"not null;index" json:"file_id"`
+	Hook           string    `gorm:"not null" json:"hook"`
+	Error          string    `json:"error"`
+	Attempts       int       `gorm:"not null" json:"attempts"`
+	FirstAttemptAt time.Time `json:"first_attempt_at"`
+	FailedAt       time.Time `gorm:"not null" json:"failed_at"`
+}
+
+// FileShare grants a user other than the owner access to a file.
+type FileShare struct {
+	FileID     uint64 `gorm:"primaryKey" json:"file_id"`
+	UserID     string `gorm:"primaryKey;index" json:"user_id"`
+	Permission string `gorm:"not null" json:"permission"`
+}
+
+// Message links files attached to a chat message with the users allowed to
+// see them: the sender and the recipients.
+type Message struct {
+	ID        uint64    `gorm:"primary key;autoIncrement" json:"id"`
+	Sender    string    `gorm:"not null;index" json:"sender"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type MessageRecipient struct {
+	MessageID uint64 `gorm:"primaryKey" json:"message_id"`
+	UserID    string `gorm:"primaryKey;index" json:"user_id"`
+}
+
+type MessageAttachment struct {
+	MessageID uint64 `gorm:"primaryKey" json:"message_id"`
+	FileID    uint64 `gorm:"primaryKey;index" json:"file_id"`
+}
+
+// IntegrityMismatch is a file whose content no longer matches its stored
+// hash, or that is gone from the storage, as found by the integrity scan.
+type IntegrityMismatch struct {
+	FileID     uint64    `gorm:"primaryKey" json:"file_id"`
+	Expected   string    `gorm:"not null" json:"expected"`
+	Actual     string    `gorm:"not null;default:''" json:"actual,omitempty"`
+	Error      string    `gorm:"not null;default:''" json:"error,omitempty"`
+	DetectedAt time.Time `gorm:"not null" json:"detected_at"`
+}
+
+// IntegrityScanState is the single row holding the progress of the
+// integrity scan, so it resumes after a restart.
+type IntegrityScanState struct {
+	ID        uint `gorm:"primaryKey"`
+	LastID    uint64
+	UpdatedAt time.Time
+}
+
+// ProcessingState is the single row remembering whether background
+// processing was paused, so a pause survives a restart.
+type ProcessingState struct {
+	ID        uint `gorm:"primaryKey"`
+	Paused    bool `gorm:"not null;default:false"`
+	UpdatedAt time.Time
+}
+
+type FileTag struct {
+	FileID uint64 `gorm:"primaryKey" json:"file_id"`
+	Tag    string `gorm:"primaryKey;index" json:"tag"`
 }
 
 func MigrateDB(db *gorm.DB) error {
-	err := db.AutoMigrate(&Files{})
-	return err
+	err := db.AutoMigrate(&Files{}, &FileTag{}, &FileShare{}, &HookRun{},
+		&Message{}, &MessageRecipient{}, &MessageAttachment{}, &FileVariant{}, &FileAccess{},
+		&UploadSession{}, &IntegrityMismatch{}, &IntegrityScanState{}, &ProcessingState{},
+		&FailedJob{})
+	if err != nil {
+		return err
+	}
+	return migrateVariantColumns(db)
+}
+
+// migrateVariantColumns moves thumbnails and kept originals from the
+// columns of files they used to have into file_variants.
+func migrateVariantColumns(db *gorm.DB) error {
+	legacy := []struct{ column, kind string }{
+		{"thumbnail_path", VariantThumbnail},
+		{"original_path", VariantOriginal},
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, l := range legacy {
+			if !tx.Migrator().HasColumn(&Files{}, l.column) {
+				continue
+			}
+			err := tx.Exec(`INSERT INTO file_variants (file_id, kind, storage_path, size, created_at)
+				SELECT id, ?, `+l.column+`, 0, now() FROM files WHERE `+l.column+` <> ''
+				ON CONFLICT DO NOTHING`, l.kind).Error
+			if err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropColumn(&Files{}, l.column); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 func Connection() (*gorm.DB, error) {
 	dsn := "host=localhost user=postgres password=123 dbname=messenger_files port=12345 sslmode=disable"
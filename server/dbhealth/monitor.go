@@ -0,0 +1,70 @@
+package dbhealth
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// Monitor pings the database at a fixed interval and tracks whether it is
+// reachable. While it isn't, the server runs degraded: reads that can be
+// answered from memory keep working and writes are refused.
+type Monitor struct {
+	db       *sql.DB
+	interval time.Duration
+
+	mu    sync.RWMutex
+	down  bool
+	since time.Time
+}
+
+func NewMonitor(db *sql.DB, interval time.Duration) *Monitor {
+	return &Monitor{db: db, interval: interval, since: time.Now()}
+}
+
+// Run checks the database until ctx is done.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *Monitor) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, m.interval)
+	defer cancel()
+	err := m.db.PingContext(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case err != nil && !m.down:
+		m.down, m.since = true, time.Now()
+		log.Printf("Database is unavailable, running degraded: downloads are served from the file cache, writes are refused: %v", err)
+	case err == nil && m.down:
+		log.Printf("Database is back after %v, leaving degraded mode", time.Since(m.since).Round(time.Second))
+		m.down, m.since = false, time.Now()
+	}
+}
+
+// Healthy reports whether the last check reached the database.
+func (m *Monitor) Healthy() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return !m.down
+}
+
+// State returns the current state and when it was entered.
+func (m *Monitor) State() (healthy bool, since time.Time) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return !m.down, m.since
+}
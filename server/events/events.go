@@ -0,0 +1,104 @@
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	TypeUpload   = "upload"
+	TypeDownload = "download"
+	TypeDelete   = "delete"
+)
+
+var ErrTooManySubscribers = errors.New("too many subscribers")
+
+type Event struct {
+	Type      string    `json:"type"`
+	FileID    uint64    `json:"file_id"`
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Hub keeps the last events in a fixed size ring buffer and fans new
+// events out to live subscribers. Slow subscribers lose events instead
+// of blocking the publisher.
+type Hub struct {
+	mu             sync.Mutex
+	buffer         []Event
+	next           int
+	full           bool
+	subscribers    map[chan Event]struct{}
+	maxSubscribers int
+}
+
+func NewHub(size, maxSubscribers int) *Hub {
+	if size < 1 {
+		size = 1
+	}
+	return &Hub{
+		buffer:         make([]Event, size),
+		subscribers:    make(map[chan Event]struct{}),
+		maxSubscribers: maxSubscribers,
+	}
+}
+
+func (h *Hub) Publish(eventType string, fileID uint64, status string) {
+	event := Event{
+		Type:      eventType,
+		FileID:    fileID,
+		Status:    status,
+		Timestamp: time.Now().UTC(),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buffer[h.next] = event
+	h.next = (h.next + 1) % len(h.buffer)
+	if h.next == 0 {
+		h.full = true
+	}
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Recent returns the buffered events from oldest to newest.
+func (h *Hub) Recent() []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.recent()
+}
+
+// recent is Recent for callers holding mu.
+func (h *Hub) recent() []Event {
+	if !h.full {
+		return append([]Event(nil), h.buffer[:h.next]...)
+	}
+	recent := make([]Event, 0, len(h.buffer))
+	recent = append(recent, h.buffer[h.next:]...)
+	return append(recent, h.buffer[:h.next]...)
+}
+
+// Subscribe returns a snapshot of the buffered events together with a
+// channel receiving every event published afterwards. Both are taken under
+// one lock, so no event is missed or delivered twice in between.
+func (h *Hub) Subscribe() ([]Event, chan Event, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subscribers) >= h.maxSubscribers {
+		return nil, nil, ErrTooManySubscribers
+	}
+	ch := make(chan Event, len(h.buffer))
+	h.subscribers[ch] = struct{}{}
+	return h.recent(), ch, nil
+}
+
+func (h *Hub) Unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, ch)
+}
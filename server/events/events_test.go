@@ -0,0 +1,52 @@
+package events
+
+import "testing"
+
+func TestSubscribeWhilePublishing(t *testing.T) {
+	const published = 1000
+	for round := 0; round < 20; round++ {
+		h := NewHub(published, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for id := uint64(1); id <= published; id++ {
+				h.Publish(TypeUpload, id, "ready")
+			}
+		}()
+		recent, ch, err := h.Subscribe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		seen := make([]uint64, 0, published)
+		for _, event := range recent {
+			seen = append(seen, event.FileID)
+		}
+		for len(ch) > 0 {
+			seen = append(seen, (<-ch).FileID)
+		}
+		if len(seen) != published {
+			t.Fatalf("got %d events, want %d", len(seen), published)
+		}
+		for i, id := range seen {
+			if id != uint64(i+1) {
+				t.Fatalf("event %d is file %d: events were missed or repeated", i, id)
+			}
+		}
+	}
+}
+
+func TestSubscribeLimit(t *testing.T) {
+	h := NewHub(4, 1)
+	_, ch, err := h.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := h.Subscribe(); err != ErrTooManySubscribers {
+		t.Fatalf("second Subscribe() = %v, want ErrTooManySubscribers", err)
+	}
+	h.Unsubscribe(ch)
+	if _, _, err := h.Subscribe(); err != nil {
+		t.Fatalf("Subscribe() after Unsubscribe = %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package filecache
+
+import (
+	"container/list"
+	. "messangere/database"
+	"messangere/metrics"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// Cache keeps the most recently looked up file records in memory. Entries
+// are dropped whenever the files table is updated or deleted from through
+// GORM, see Register. A nil *Cache is a disabled cache: lookups always
+// miss and nothing is stored.
+type Cache struct {
+	mu       sync.Mutex
+	size     int
+	order    *list.List
+	entries  map[uint64]*list.Element
+	requests *metrics.CounterVec
+}
+
+// New returns a cache holding up to size records, or nil when size is zero
+// or less.
+func New(size int) *Cache {
+	if size <= 0 {
+		return nil
+	}
+	return &Cache{
+		size:     size,
+		order:    list.New(),
+		entries:  make(map[uint64]*list.Element),
+		requests: metrics.NewCounterVec("file_cache_requests_total", "File metadata cache lookups by result.", "result"),
+	}
+}
+
+func (c *Cache) Get(id uint64) (Files, bool) {
+	if c == nil {
+		return Files{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[id]
+	if !ok {
+		c.requests.Inc("miss")
+		return Files{}, false
+	}
+	c.requests.Inc("hit")
+	c.order.MoveToFront(element)
+	return clone(element.Value.(Files)), true
+}
+
+func (c *Cache) Put(file Files) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[file.ID]; ok {
+		element.Value = clone(file)
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[file.ID] = c.order.PushFront(clone(file))
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(Files).ID)
+	}
+}
+
+func (c *Cache) Invalidate(id uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[id]; ok {
+		c.order.Remove(element)
+		delete(c.entries, id)
+	}
+}
+
+func (c *Cache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	clear(c.entries)
+}
+
+// Register hooks the cache into db so that every update or delete of the
+// files table invalidates the affected record. Statements on a single
+// loaded record drop just that entry; anything else, like updates by a
+// WHERE clause, empties the cache.
+func (c *Cache) Register(db *gorm.DB) error {
+	if c == nil {
+		return nil
+	}
+	invalidate := func(tx *gorm.DB) {
+		if tx.Statement.Table != "files" {
+			return
+		}
+		if file, ok := tx.Statement.Model.(*Files); ok && file.ID != 0 {
+			c.Invalidate(file.ID)
+			return
+		}
+		c.Purge()
+	}
+	if err := db.Callback().Update().After("gorm:update").Register("filecache:invalidate", invalidate); err != nil {
+		return err
+	}
+	return db.Callback().Delete().After("gorm:delete").Register("filecache:invalidate", invalidate)
+}
+
+// clone copies the record so callers can modify it, including the nested
+// metadata, without touching the cached entry.
+func clone(file Files) Files {
+	if file.ExpiresAt != nil {
+		expires := *file.ExpiresAt
+		file.ExpiresAt = &expires
+	}
+	if file.PerceptualHash != nil {
+		hash := *file.PerceptualHash
+		file.PerceptualHash = &hash
+	}
+	if file.Metadata != nil {
+		file.Metadata = cloneValue(map[string]any(file.Metadata)).(map[string]any)
+	}
+	return file
+}
+
+func cloneValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		copied := make(map[string]any, len(v))
+		for key, item := range v {
+			copied[key] = cloneValue(item)
+		}
+		return copied
+	case []any:
+		copied := make([]any, len(v))
+		for i, item := range v {
+			copied[i] = cloneValue(item)
+		}
+		return copied
+	default:
+		return v
+	}
+}
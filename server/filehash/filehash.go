@@ -0,0 +1,103 @@
+package filehash
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Names of the algorithms a Set computes.
+const (
+	MD5    = "md5"
+	SHA1   = "sha1"
+	SHA256 = "sha256"
+	SHA512 = "sha512"
+	CRC32  = "crc32"
+)
+
+var constructors = map[string]func() hash.Hash{
+	MD5:    md5.New,
+	SHA1:   sha1.New,
+	SHA256: sha256.New,
+	SHA512: sha512.New,
+	CRC32:  func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// Supported reports whether a Set can compute the algorithm.
+func Supported(name string) bool {
+	_, ok := constructors[name]
+	return ok
+}
+
+// Set computes several hashes of what is written to it, so content is
+// read once however many are wanted.
+type Set struct {
+	names  []string
+	hashes []hash.Hash
+}
+
+// NewSet returns a Set of the named algorithms; unsupported names are
+// skipped.
+func NewSet(names []string) *Set {
+	s := &Set{}
+	for _, name := range names {
+		if constructor, ok := constructors[name]; ok {
+			s.names = append(s.names, name)
+			s.hashes = append(s.hashes, constructor())
+		}
+	}
+	return s
+}
+
+// Write never fails, like hash.Hash.
+func (s *Set) Write(p []byte) (int, error) {
+	for _, h := range s.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// Sums returns the hex encoded hashes by algorithm, nil for an empty Set.
+func (s *Set) Sums() map[string]string {
+	if len(s.hashes) == 0 {
+		return nil
+	}
+	sums := make(map[string]string, len(s.hashes))
+	for i, h := range s.hashes {
+		sums[s.names[i]] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
+
+// SumFile hashes the file at path with the named algorithms.
+func SumFile(path string, names []string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := NewSet(names)
+	if _, err := io.Copy(s, f); err != nil {
+		return nil, err
+	}
+	return s.Sums(), nil
+}
+
+func SHA256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,126 @@
+package filespb
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"messangere/database"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ContentType is the media type of the encoded messages.
+const ContentType = "application/x-protobuf"
+
+// MarshalFileResponse encodes a FileResponse.
+func MarshalFileResponse(file database.Files) []byte {
+	return appendMessage(nil, 1, marshalFile(file))
+}
+
+// MarshalFileList encodes a FileList.
+func MarshalFileList(files []database.Files, total int64, limit, offset int, hasMore bool) []byte {
+	var b []byte
+	for _, file := range files {
+		b = appendMessage(b, 1, marshalFile(file))
+	}
+	b = appendInt(b, 2, total)
+	b = appendInt(b, 3, int64(limit))
+	b = appendInt(b, 4, int64(offset))
+	return appendBool(b, 5, hasMore)
+}
+
+func marshalFile(file database.Files) []byte {
+	var b []byte
+	b = appendUint(b, 1, file.ID)
+	b = appendString(b, 2, file.Name)
+	b = appendString(b, 3, file.Mimetype)
+	b = appendString(b, 4, file.StoragePath)
+	b = appendUint(b, 5, file.Size)
+	b = appendString(b, 6, file.Owner)
+	b = appendString(b, 7, file.Sha256)
+	b = appendString(b, 8, file.Status)
+	b = appendString(b, 9, file.Folder)
+	if file.ExpiresAt != nil {
+		b = appendTime(b, 10, *file.ExpiresAt)
+	}
+	b = appendTime(b, 11, file.CreatedAt)
+	b = appendTime(b, 12, file.UpdatedAt)
+	if len(file.Metadata) > 0 {
+		// Metadata always comes from JSON, so it marshals back.
+		metadata, _ := json.Marshal(file.Metadata)
+		b = appendString(b, 13, string(metadata))
+	}
+	b = appendInt(b, 14, file.DownloadRateLimit)
+	if file.PerceptualHash != nil {
+		// Optional fields are written even when zero.
+		b = protowire.AppendTag(b, 15, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*file.PerceptualHash))
+	}
+	b = appendBool(b, 16, file.Compressed)
+	b = appendBool(b, 17, file.Sensitive)
+	b = appendString(b, 18, file.SensitivePatterns)
+	b = appendInt(b, 19, file.MaxDownloads)
+	b = appendInt(b, 20, file.DownloadsRemaining)
+	b = appendString(b, 21, file.SessionID)
+	if file.ExternalID != nil {
+		b = appendString(b, 22, *file.ExternalID)
+	}
+	b = appendInt(b, 23, file.DownloadCount)
+	// Map entries are messages of key and value. They are sorted so the
+	// encoding is stable.
+	names := make([]string, 0, len(file.Hashes))
+	for name := range file.Hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sum, _ := file.Hashes[name].(string)
+		b = appendMessage(b, 24, appendString(appendString(nil, 1, name), 2, sum))
+	}
+	b = appendString(b, 25, file.OriginalName)
+	return b
+}
+
+// The append helpers skip zero values like proto3 does for fields without
+// presence.
+
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	return appendUint(b, num, uint64(v))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	return appendUint(b, num, protowire.EncodeBool(v))
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+// appendTime writes a google.protobuf.Timestamp.
+func appendTime(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var ts []byte
+	ts = appendInt(ts, 1, t.Unix())
+	ts = appendInt(ts, 2, int64(t.Nanosecond()))
+	return appendMessage(b, num, ts)
+}
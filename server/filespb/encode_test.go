@@ -0,0 +1,241 @@
+package filespb
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"messangere/database"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type protoField struct {
+	name     string
+	kind     string
+	repeated bool
+}
+
+var (
+	messageLine = regexp.MustCompile(`^message (\w+) \{$`)
+	fieldLine   = regexp.MustCompile(`^(repeated |optional )?(map<string, string>|[\w.]+) (\w+) = (\d+);$`)
+)
+
+// readProto returns the fields of the messages in files.proto by number.
+func readProto(t *testing.T) map[string]map[protowire.Number]protoField {
+	t.Helper()
+	data, err := os.ReadFile("files.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := map[string]map[protowire.Number]protoField{}
+	var current map[protowire.Number]protoField
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if m := messageLine.FindStringSubmatch(line); m != nil {
+			current = map[protowire.Number]protoField{}
+			messages[m[1]] = current
+		} else if m := fieldLine.FindStringSubmatch(line); m != nil && current != nil {
+			num, _ := strconv.Atoi(m[4])
+			current[protowire.Number(num)] = protoField{m[3], m[2], m[1] == "repeated "}
+		}
+	}
+	return messages
+}
+
+// decode parses an encoded message the way a generated decoder would,
+// following the types files.proto declares, into values by field name.
+func decode(t *testing.T, messages map[string]map[protowire.Number]protoField, message string, b []byte) map[string]any {
+	t.Helper()
+	fields := messages[message]
+	decoded := map[string]any{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("%s: %v", message, protowire.ParseError(n))
+		}
+		b = b[n:]
+		field, ok := fields[num]
+		if !ok {
+			t.Fatalf("%s: field %d isn't in files.proto", message, num)
+		}
+		want := protowire.BytesType
+		switch field.kind {
+		case "uint64", "int64", "bool":
+			want = protowire.VarintType
+		}
+		if typ != want {
+			t.Fatalf("%s.%s: wire type %d, files.proto declares %s", message, field.name, typ, field.kind)
+		}
+		var value any
+		if typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				t.Fatalf("%s.%s: %v", message, field.name, protowire.ParseError(n))
+			}
+			b = b[n:]
+			switch field.kind {
+			case "uint64":
+				value = v
+			case "int64":
+				value = int64(v)
+			case "bool":
+				value = protowire.DecodeBool(v)
+			}
+		} else {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				t.Fatalf("%s.%s: %v", message, field.name, protowire.ParseError(n))
+			}
+			b = b[n:]
+			switch field.kind {
+			case "string":
+				value = string(v)
+			case "google.protobuf.Timestamp":
+				ts := decode(t, timestamp, "Timestamp", v)
+				seconds, _ := ts["seconds"].(int64)
+				nanos, _ := ts["nanos"].(int64)
+				value = time.Unix(seconds, nanos).UTC()
+			case "map<string, string>":
+				entry := decode(t, mapEntry, "Entry", v)
+				entries, _ := decoded[field.name].(map[string]string)
+				if entries == nil {
+					entries = map[string]string{}
+				}
+				entries[entry["key"].(string)] = entry["value"].(string)
+				value = entries
+			default:
+				value = decode(t, messages, field.kind, v)
+			}
+		}
+		if field.repeated {
+			list, _ := decoded[field.name].([]any)
+			value = append(list, value)
+		}
+		decoded[field.name] = value
+	}
+	return decoded
+}
+
+var (
+	timestamp = map[string]map[protowire.Number]protoField{"Timestamp": {
+		1: {"seconds", "int64", false},
+		2: {"nanos", "int64", false},
+	}}
+	mapEntry = map[string]map[protowire.Number]protoField{"Entry": {
+		1: {"key", "string", false},
+		2: {"value", "string", false},
+	}}
+)
+
+// fullFile has every field set.
+func fullFile() (database.Files, map[string]any) {
+	expires := time.Date(2026, 3, 4, 5, 6, 7, 8, time.UTC)
+	created := time.Date(2026, 1, 2, 3, 4, 5, 600, time.UTC)
+	updated := time.Date(2026, 1, 2, 3, 4, 6, 0, time.UTC)
+	hash, external := int64(-42), "client-7"
+	file := database.Files{
+		ID:                 7,
+		Name:               "notes.txt",
+		Mimetype:           "text/plain",
+		StoragePath:        "/srv/files/7",
+		Size:               1234,
+		Owner:              "alice",
+		Sha256:             "abc123",
+		Status:             "ready",
+		Folder:             "docs",
+		ExpiresAt:          &expires,
+		CreatedAt:          created,
+		UpdatedAt:          updated,
+		Metadata:           database.JSONMap{"album": "trip"},
+		DownloadRateLimit:  1 << 20,
+		PerceptualHash:     &hash,
+		Compressed:         true,
+		Sensitive:          true,
+		SensitivePatterns:  "ssn",
+		MaxDownloads:       3,
+		DownloadsRemaining: 2,
+		SessionID:          "session-1",
+		ExternalID:         &external,
+		DownloadCount:      9,
+		Hashes:             database.JSONMap{"md5": "0123", "sha1": "4567"},
+		OriginalName:       "Notes.TXT",
+	}
+	want := map[string]any{
+		"id":                  uint64(7),
+		"name":                "notes.txt",
+		"mimetype":            "text/plain",
+		"storage_path":        "/srv/files/7",
+		"size":                uint64(1234),
+		"owner":               "alice",
+		"sha256":              "abc123",
+		"status":              "ready",
+		"folder":              "docs",
+		"expires_at":          expires,
+		"created_at":          created,
+		"updated_at":          updated,
+		"metadata_json":       `{"album":"trip"}`,
+		"download_rate_limit": int64(1 << 20),
+		"perceptual_hash":     int64(-42),
+		"compressed":          true,
+		"sensitive":           true,
+		"sensitive_patterns":  "ssn",
+		"max_downloads":       int64(3),
+		"downloads_remaining": int64(2),
+		"session_id":          "session-1",
+		"external_id":         "client-7",
+		"download_count":      int64(9),
+		"hashes":              map[string]string{"md5": "0123", "sha1": "4567"},
+		"original_name":       "Notes.TXT",
+	}
+	return file, want
+}
+
+func TestMarshalFileResponse(t *testing.T) {
+	messages := readProto(t)
+	file, want := fullFile()
+	if len(want) != len(messages["File"]) {
+		t.Fatalf("the test sets %d fields, files.proto declares %d", len(want), len(messages["File"]))
+	}
+	response := decode(t, messages, "FileResponse", MarshalFileResponse(file))
+	got, _ := response["data"].(map[string]any)
+	for name, value := range want {
+		if !reflect.DeepEqual(got[name], value) {
+			t.Errorf("%s = %#v, want %#v", name, got[name], value)
+		}
+	}
+}
+
+func TestMarshalFileZeroValues(t *testing.T) {
+	messages := readProto(t)
+	hash := int64(0)
+	got := decode(t, messages, "File", marshalFile(database.Files{ID: 1, PerceptualHash: &hash}))
+	// Only the optional field is written when zero.
+	want := map[string]any{"id": uint64(1), "perceptual_hash": int64(0)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %#v, want %#v", got, want)
+	}
+}
+
+func TestMarshalFileList(t *testing.T) {
+	messages := readProto(t)
+	file, want := fullFile()
+	got := decode(t, messages, "FileList", MarshalFileList([]database.Files{file, {ID: 8}}, 12, 2, 4, true))
+	if got["total"] != int64(12) || got["limit"] != int64(2) || got["offset"] != int64(4) || got["has_more"] != true {
+		t.Errorf("paging fields = %v", got)
+	}
+	data, _ := got["data"].([]any)
+	if len(data) != 2 {
+		t.Fatalf("%d files, want 2", len(data))
+	}
+	if first := data[0].(map[string]any); !reflect.DeepEqual(first["hashes"], want["hashes"]) || first["name"] != want["name"] {
+		t.Errorf("first file = %v", first)
+	}
+	if second := data[1].(map[string]any); !reflect.DeepEqual(second, map[string]any{"id": uint64(8)}) {
+		t.Errorf("second file = %v", second)
+	}
+}
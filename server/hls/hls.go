@@ -0,0 +1,73 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Playlist is the file name of the manifest inside a packaged directory.
+const Playlist = "playlist.m3u8"
+
+const (
+	PlaylistType = "application/vnd.apple.mpegurl"
+	SegmentType  = "video/mp2t"
+)
+
+var segmentName = regexp.MustCompile(`^segment[0-9]{5}\.ts$`)
+
+// Supported reports whether uploads of the mimetype are packaged.
+func Supported(mimetype string) bool {
+	return strings.HasPrefix(strings.ToLower(mimetype), "video/")
+}
+
+// ValidSegment reports whether name is a segment file written by Package,
+// so it can be joined to the directory without escaping it.
+func ValidSegment(name string) bool {
+	return segmentName.MatchString(name)
+}
+
+// Package segments src into dir with the external packager (ffmpeg by
+// default). The streams are copied, not transcoded, and the playlist
+// refers to the segments by their file names. It returns the number of
+// segments written.
+func Package(ctx context.Context, command []string, src, dir string, segment time.Duration) (int, error) {
+	if len(command) == 0 {
+		return 0, fmt.Errorf("no packager configured")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	seconds := strconv.FormatFloat(segment.Seconds(), 'f', -1, 64)
+	args := append(append([]string(nil), command[1:]...),
+		"-nostdin", "-y", "-i", src,
+		"-map", "0:v:0", "-map", "0:a?", "-c", "copy",
+		"-f", "hls", "-hls_time", seconds, "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "segment%05d.ts"),
+		filepath.Join(dir, Playlist))
+	output, err := exec.CommandContext(ctx, command[0], args...).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", err, lastLine(output))
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "segment*.ts"))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, Playlist)); err != nil || len(segments) == 0 {
+		return 0, fmt.Errorf("packager produced no output")
+	}
+	return len(segments), nil
+}
+
+// lastLine keeps the end of the packager output, where ffmpeg reports
+// the reason it failed.
+func lastLine(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return lines[len(lines)-1]
+}
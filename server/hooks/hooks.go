@@ -0,0 +1,250 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	. "messangere/database"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PostUploadHook is a processing step run in the background after a file
+// was stored successfully.
+type PostUploadHook interface {
+	Name() string
+	Process(ctx context.Context, file *Files) error
+}
+
+type job struct {
+	hook PostUploadHook
+	file Files
+	// attempt counts from 1; first is when the first attempt was queued.
+	attempt int
+	first   time.Time
+}
+
+var (
+	ErrUnknownHook = errors.New("no such hook is registered")
+	ErrQueueFull   = errors.New("processing queue is full")
+)
+
+// Pool runs registered hooks for uploaded files. At most workers jobs run
+// at once; the same slots are shared with on-demand processing started
+// through Run, so background and request-time work together are bounded.
+// The state of every hook run is recorded in the hook_runs table.
+//
+// A failed run is retried up to attempts times in total, waiting backoff
+// before the second attempt and twice as long before each further one.
+// Jobs failing every attempt are recorded as FailedJob rows.
+//
+// While paused, submitted jobs stay queued and no new ones are started;
+// running jobs and on-demand work through Run are not affected.
+type Pool struct {
+	db      *gorm.DB
+	hooks   []PostUploadHook
+	jobs    chan job
+	slots   chan struct{}
+	timeout time.Duration
+
+	attempts int
+	backoff  time.Duration
+
+	mu      sync.Mutex
+	resumed *sync.Cond
+	paused  bool
+	// held is set while the dispatcher holds a job it took off the queue
+	// and waits for the pool to be resumed.
+	held bool
+}
+
+// Stats describes the pool for monitoring.
+type Stats struct {
+	Paused  bool `json:"paused"`
+	Queued  int  `json:"queued"`
+	Active  int  `json:"active"`
+	Workers int  `json:"workers"`
+}
+
+func NewPool(db *gorm.DB, workers, queueSize int, timeout time.Duration, attempts int, backoff time.Duration) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &Pool{
+		db:       db,
+		jobs:     make(chan job, queueSize),
+		slots:    make(chan struct{}, workers),
+		timeout:  timeout,
+		attempts: max(attempts, 1),
+		backoff:  backoff,
+	}
+	p.resumed = sync.NewCond(&p.mu)
+	go p.dispatch()
+	return p
+}
+
+// Register adds a hook. Hooks must be registered before the server starts
+// accepting uploads.
+func (p *Pool) Register(hook PostUploadHook) {
+	p.hooks = append(p.hooks, hook)
+}
+
+// Submit queues every registered hook for the file. It never blocks the
+// caller: when the queue is full the run is recorded as failed.
+func (p *Pool) Submit(file Files) {
+	for _, hook := range p.hooks {
+		p.enqueue(job{hook: hook, file: file, attempt: 1, first: time.Now()})
+	}
+}
+
+// Retry queues the named hook for the file again, with a fresh series of
+// attempts.
+func (p *Pool) Retry(file Files, name string) error {
+	for _, hook := range p.hooks {
+		if hook.Name() == name {
+			if !p.enqueue(job{hook: hook, file: file, attempt: 1, first: time.Now()}) {
+				return ErrQueueFull
+			}
+			return nil
+		}
+	}
+	return ErrUnknownHook
+}
+
+func (p *Pool) enqueue(j job) bool {
+	p.setState(j.file.ID, j.hook.Name(), HookPending, "", j.attempt-1)
+	select {
+	case p.jobs <- j:
+		return true
+	default:
+		log.Printf("Processing queue is full, skipping %s for file %d", j.hook.Name(), j.file.ID)
+		p.fail(j, ErrQueueFull)
+		return false
+	}
+}
+
+// Run executes fn in one of the pool's slots, waiting for a free slot
+// until ctx is done.
+func (p *Pool) Run(ctx context.Context, fn func() error) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+	return fn()
+}
+
+// SetPaused pauses or resumes dispatching of queued jobs.
+func (p *Pool) SetPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+	if !paused {
+		p.resumed.Broadcast()
+	}
+}
+
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	queued := len(p.jobs)
+	if p.held {
+		queued++
+	}
+	return Stats{Paused: p.paused, Queued: queued, Active: len(p.slots), Workers: cap(p.slots)}
+}
+
+func (p *Pool) waitResumed() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.paused {
+		p.held = true
+		p.resumed.Wait()
+	}
+	p.held = false
+}
+
+func (p *Pool) dispatch() {
+	for j := range p.jobs {
+		p.waitResumed()
+		p.slots <- struct{}{}
+		go func(j job) {
+			defer func() { <-p.slots }()
+			p.run(j)
+		}(j)
+	}
+}
+
+func (p *Pool) run(j job) {
+	name := j.hook.Name()
+	p.setState(j.file.ID, name, HookRunning, "", j.attempt)
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = fmt.Errorf("hook panicked: %v", v)
+			}
+		}()
+		return j.hook.Process(ctx, &j.file)
+	}()
+	if err == nil {
+		p.setState(j.file.ID, name, HookDone, "", j.attempt)
+		return
+	}
+	if j.attempt >= p.attempts {
+		log.Printf("Hook %s failed for file %d after %d attempts: %v", name, j.file.ID, j.attempt, err)
+		p.fail(j, err)
+		return
+	}
+	delay := p.backoff << (j.attempt - 1)
+	log.Printf("Hook %s failed for file %d (attempt %d of %d), retrying in %v: %v", name, j.file.ID, j.attempt, p.attempts, delay, err)
+	p.setState(j.file.ID, name, HookRetrying, err.Error(), j.attempt)
+	j.attempt++
+	time.AfterFunc(delay, func() { p.enqueue(j) })
+}
+
+// fail records the job as failed for good.
+func (p *Pool) fail(j job, err error) {
+	attempts := j.attempt
+	if errors.Is(err, ErrQueueFull) {
+		// The job never ran this time.
+		attempts--
+	}
+	p.setState(j.file.ID, j.hook.Name(), HookFailed, err.Error(), attempts)
+	failed := FailedJob{
+		FileID:         j.file.ID,
+		Hook:           j.hook.Name(),
+		Error:          err.Error(),
+		Attempts:       attempts,
+		FirstAttemptAt: j.first,
+		FailedAt:       time.Now(),
+	}
+	if err := p.db.Create(&failed).Error; err != nil {
+		log.Printf("Failed to record failed job %s for file %d: %v", j.hook.Name(), j.file.ID, err)
+	}
+}
+
+func (p *Pool) setState(fileID uint64, hook, state, message string, attempts int) {
+	run := HookRun{
+		FileID:    fileID,
+		Hook:      hook,
+		State:     state,
+		Error:     message,
+		Attempts:  attempts,
+		UpdatedAt: time.Now(),
+	}
+	err := p.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}, {Name: "hook"}},
+		DoUpdates: clause.AssignmentColumns([]string{"state", "error", "attempts", "updated_at"}),
+	}).Create(&run).Error
+	if err != nil {
+		log.Printf("Failed to record %s state of hook %s for file %d: %v", state, hook, fileID, err)
+	}
+}
@@ -0,0 +1,38 @@
+package httpheader
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NegotiateType returns the mimetype of offered, in the server's order of
+// preference, the Accept header lists with the highest quality, or "" if
+// it lists none of them. Types only match by name: */* and image/* say
+// nothing about which of the offered formats a client can decode.
+func NegotiateType(header string, offered []string) string {
+	accepted := make(map[string]float64)
+	for _, entry := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(entry, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.EqualFold(key, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	best, bestq := "", 0.0
+	for _, mimetype := range offered {
+		if q := accepted[strings.ToLower(mimetype)]; q > bestq {
+			best, bestq = mimetype, q
+		}
+	}
+	return best
+}
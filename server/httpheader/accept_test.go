@@ -0,0 +1,27 @@
+package httpheader
+
+import "testing"
+
+func TestNegotiateType(t *testing.T) {
+	offered := []string{"image/avif", "image/webp", "image/jpeg"}
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"image/avif,image/webp,*/*", "image/avif"},
+		{"image/webp,image/*;q=0.8", "image/webp"},
+		{"image/avif;q=0.5, image/webp", "image/webp"},
+		{"IMAGE/WEBP", "image/webp"},
+		{"image/jpeg;q=0.9, image/webp;q=0.9", "image/webp"},
+		{"image/avif;q=0, image/jpeg", "image/jpeg"},
+		// Wildcards don't say which formats the client decodes.
+		{"image/*,*/*;q=0.8", ""},
+		{"text/html", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NegotiateType(tt.header, offered); got != tt.want {
+			t.Errorf("NegotiateType(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package httpheader
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ContentDisposition builds a Content-Disposition value that survives
+// non-ASCII file names: an ASCII-only filename= fallback for old clients
+// plus the RFC 5987 filename*= form carrying the UTF-8 name.
+func ContentDisposition(disposition, filename string) string {
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`,
+		disposition, asciiFallback(filename), encodeRFC5987(filename))
+}
+
+func asciiFallback(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '"' || r == '\\' || r < 0x20 || r == 0x7f:
+			b.WriteByte('_')
+		case r >= utf8.RuneSelf:
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// isAttrChar reports whether c may appear unescaped in an RFC 5987 value.
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+func encodeRFC5987(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAttrChar(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,39 @@
+package httpheader
+
+import (
+	"mime"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", `attachment; filename="report.pdf"; filename*=UTF-8''report.pdf`},
+		{"отчёт 2026.txt", `attachment; filename="_____ 2026.txt"; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82%202026.txt`},
+		{"日本.png", `attachment; filename="__.png"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.png`},
+		// Quotes, backslashes and control characters can't break out of
+		// the quoted fallback.
+		{"a\"b\\c\r\n.txt", `attachment; filename="a_b_c__.txt"; filename*=UTF-8''a%22b%5Cc%0D%0A.txt`},
+		{"50% off;x=1.txt", `attachment; filename="50% off;x=1.txt"; filename*=UTF-8''50%25%20off%3Bx%3D1.txt`},
+	}
+	for _, tt := range tests {
+		got := ContentDisposition("attachment", tt.name)
+		if got != tt.want {
+			t.Errorf("ContentDisposition(%q) =\n%s, want\n%s", tt.name, got, tt.want)
+		}
+		// A client that understands filename* gets the name back exactly.
+		disposition, params, err := mime.ParseMediaType(got)
+		if err != nil {
+			t.Errorf("%q doesn't parse: %v", got, err)
+			continue
+		}
+		if disposition != "attachment" || params["filename"] != tt.name {
+			t.Errorf("%q parses to %s %q, want %q", got, disposition, params["filename"], tt.name)
+		}
+	}
+	if got := ContentDisposition("inline", "a.txt"); got != `inline; filename="a.txt"; filename*=UTF-8''a.txt` {
+		t.Errorf("inline: %s", got)
+	}
+}
@@ -0,0 +1,64 @@
+package httpheader
+
+import (
+	"strconv"
+	"strings"
+)
+
+// AcceptsEncoding reports whether an Accept-Encoding header allows the
+// content coding, either by name or through "*", with a non-zero quality.
+func AcceptsEncoding(header, coding string) bool {
+	for _, entry := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(entry, ";")
+		name = strings.TrimSpace(name)
+		if !strings.EqualFold(name, coding) && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.EqualFold(key, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+// NegotiateEncoding returns the content coding of offered, in the
+// server's order of preference, the client accepts with the highest
+// quality, or "" if it accepts none of them.
+func NegotiateEncoding(header string, offered []string) string {
+	accepted := make(map[string]float64)
+	for _, entry := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(entry, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.EqualFold(key, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	best, bestq := "", 0.0
+	for _, coding := range offered {
+		q, ok := accepted[coding]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestq {
+			best, bestq = coding, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,71 @@
+package httpheader
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NoneMatch reports whether an If-None-Match header matches etag using the
+// weak comparison of RFC 9110, so W/"x" and "x" are considered equal.
+func NoneMatch(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether an If-Match header matches etag using the strong
+// comparison of RFC 9110; weak tags never match.
+func Match(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// NotModified reports whether a GET of content with etag and modtime is
+// answered with 304, the way http.ServeContent decides it: If-None-Match
+// when present, If-Modified-Since otherwise.
+func NotModified(h http.Header, etag string, modtime time.Time) bool {
+	if header := h.Get("If-None-Match"); header != "" {
+		return etag != "" && NoneMatch(header, etag)
+	}
+	since, err := http.ParseTime(h.Get("If-Modified-Since"))
+	if err != nil || modtime.IsZero() {
+		return false
+	}
+	return !modtime.Truncate(time.Second).After(since)
+}
+
+// IfRange reports whether the ranges of a request with the If-Range
+// header apply to content with etag and modtime; when they don't the whole
+// content is sent. An empty header always applies.
+func IfRange(header, etag string, modtime time.Time) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return true
+	}
+	if strings.HasPrefix(header, `"`) {
+		return etag != "" && !strings.HasPrefix(etag, "W/") && header == etag
+	}
+	date, err := http.ParseTime(header)
+	return err == nil && !modtime.IsZero() && modtime.Truncate(time.Second).Equal(date)
+}
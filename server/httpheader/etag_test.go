@@ -0,0 +1,45 @@
+package httpheader
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		etag   string
+		want   bool
+	}{
+		{`"abc"`, `"abc"`, true},
+		{` "x", "abc" `, `"abc"`, true},
+		{"*", `"abc"`, true},
+		{`"x"`, `"abc"`, false},
+		// If-Match compares strongly.
+		{`W/"abc"`, `"abc"`, false},
+		{`"abc"`, `W/"abc"`, false},
+		{`abc`, `"abc"`, false},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.header, tt.etag); got != tt.want {
+			t.Errorf("Match(%q, %s) = %v, want %v", tt.header, tt.etag, got, tt.want)
+		}
+	}
+}
+
+func TestNoneMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		etag   string
+		want   bool
+	}{
+		{"", `"abc"`, false},
+		{`"abc"`, `"abc"`, true},
+		{`W/"abc"`, `"abc"`, true},
+		{`"x", W/"abc"`, `W/"abc"`, true},
+		{"*", `"abc"`, true},
+		{`"x"`, `"abc"`, false},
+	}
+	for _, tt := range tests {
+		if got := NoneMatch(tt.header, tt.etag); got != tt.want {
+			t.Errorf("NoneMatch(%q, %s) = %v, want %v", tt.header, tt.etag, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package httpheader
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type byteRange struct {
+	start, end int64
+}
+
+// CoalesceRanges rewrites a Range header for content of size bytes: the
+// ranges are resolved against the size, sorted, and overlapping or
+// adjacent ones merged, so a multipart/byteranges response never carries
+// a byte twice. Ranges starting past the end are dropped. It returns the
+// rewritten header and the number of ranges left; ok is false when the
+// header doesn't parse or none of its ranges is satisfiable.
+func CoalesceRanges(header string, size int64) (rewritten string, count int, ok bool) {
+	unit, specs, found := strings.Cut(header, "=")
+	if !found || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return "", 0, false
+	}
+	var ranges []byteRange
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, found := strings.Cut(spec, "-")
+		if !found {
+			return "", 0, false
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		var r byteRange
+		if first == "" {
+			// A suffix range, the last bytes of the content.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return "", 0, false
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			r = byteRange{max(size-n, 0), size - 1}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return "", 0, false
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return "", 0, false
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start, min(end, size-1)}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return "", 0, false
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.start <= last.end+1 {
+			last.end = max(last.end, r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	parts := make([]string, len(merged))
+	for i, r := range merged {
+		parts[i] = fmt.Sprintf("%d-%d", r.start, r.end)
+	}
+	return "bytes=" + strings.Join(parts, ","), len(merged), true
+}
+
+// StartsAtZero reports whether the satisfiable ranges of a Range header
+// for content of size bytes include its first byte.
+func StartsAtZero(header string, size int64) bool {
+	rewritten, _, ok := CoalesceRanges(header, size)
+	return ok && strings.HasPrefix(rewritten, "bytes=0-")
+}
@@ -0,0 +1,79 @@
+package httpheader
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCoalesceRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		size   int64
+		want   string
+		count  int
+		ok     bool
+	}{
+		{"single", "bytes=0-99", 1000, "bytes=0-99", 1, true},
+		{"open ended", "bytes=900-", 1000, "bytes=900-999", 1, true},
+		{"suffix", "bytes=-100", 1000, "bytes=900-999", 1, true},
+		{"suffix longer than the content", "bytes=-5000", 1000, "bytes=0-999", 1, true},
+		{"multiple sorted", "bytes=500-599, 0-99", 1000, "bytes=0-99,500-599", 2, true},
+		{"overlapping", "bytes=0-99,50-149", 1000, "bytes=0-149", 1, true},
+		{"adjacent", "bytes=0-99,100-199", 1000, "bytes=0-199", 1, true},
+		{"contained", "bytes=0-499,100-199", 1000, "bytes=0-499", 1, true},
+		{"suffix overlapping a range", "bytes=800-949,-100", 1000, "bytes=800-999", 1, true},
+		{"end past the content", "bytes=900-5000", 1000, "bytes=900-999", 1, true},
+		{"start past the content dropped", "bytes=0-9,2000-2999", 1000, "bytes=0-9", 1, true},
+		{"unit is case insensitive", "Bytes=0-9", 1000, "bytes=0-9", 1, true},
+		{"all out of bounds", "bytes=1000-1999", 1000, "", 0, false},
+		{"empty content", "bytes=-10", 0, "", 0, false},
+		{"zero suffix", "bytes=-0", 1000, "", 0, false},
+		{"end before start", "bytes=100-50", 1000, "", 0, false},
+		{"negative start", "bytes=--5", 1000, "", 0, false},
+		{"not a number", "bytes=a-b", 1000, "", 0, false},
+		{"missing dash", "bytes=100", 1000, "", 0, false},
+		{"other unit", "items=0-9", 1000, "", 0, false},
+		{"no unit", "0-9", 1000, "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, count, ok := CoalesceRanges(tt.header, tt.size)
+			if got != tt.want || count != tt.count || ok != tt.ok {
+				t.Errorf("CoalesceRanges(%q, %d) = %q, %d, %v, want %q, %d, %v",
+					tt.header, tt.size, got, count, ok, tt.want, tt.count, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCoalesceRangesMany(t *testing.T) {
+	specs := make([]string, 100)
+	for i := range specs {
+		specs[i] = fmt.Sprintf("%d-%d", i*10, i*10+4)
+	}
+	_, count, ok := CoalesceRanges("bytes="+strings.Join(specs, ","), 1000)
+	if !ok || count != 100 {
+		t.Errorf("CoalesceRanges() = %d ranges, %v, want 100", count, ok)
+	}
+}
+
+func TestStartsAtZero(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"bytes=0-99", true},
+		{"bytes=50-99,0-9", true},
+		{"bytes=-1000", true},
+		{"bytes=1-99", false},
+		{"bytes=-10", false},
+		{"bytes=2000-", false},
+	}
+	for _, tt := range tests {
+		if got := StartsAtZero(tt.header, 1000); got != tt.want {
+			t.Errorf("StartsAtZero(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
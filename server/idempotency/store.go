@@ -0,0 +1,81 @@
+package idempotency
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Response is what a repeated request gets back. Header holds only the
+// headers the replay needs, such as the Location of a redirect.
+type Response struct {
+	Status      int
+	ContentType string
+	Header      http.Header
+	Body        []byte
+}
+
+type entry struct {
+	response  *Response
+	expiresAt time.Time
+}
+
+// Store remembers the response produced for each idempotency key until the
+// key expires. A key without a response is still being processed.
+type Store struct {
+	mu      sync.Mutex
+	entries map[string]entry
+	ttl     time.Duration
+}
+
+func NewStore(ttl time.Duration) *Store {
+	s := &Store{
+		entries: make(map[string]entry),
+		ttl:     ttl,
+	}
+	go s.sweep()
+	return s
+}
+
+// Begin reserves the key for a new request. If the key is already known it
+// returns the stored response, or inFlight when the first request with this
+// key hasn't finished yet.
+func (s *Store) Begin(key string) (response *Response, inFlight bool, reserved bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && time.Now().Before(e.expiresAt) {
+		return e.response, e.response == nil, false
+	}
+	s.entries[key] = entry{expiresAt: time.Now().Add(s.ttl)}
+	return nil, false, true
+}
+
+func (s *Store) Complete(key string, response *Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = entry{response: response, expiresAt: time.Now().Add(s.ttl)}
+}
+
+// Release forgets a reserved key so the request can be retried.
+func (s *Store) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+func (s *Store) sweep() {
+	interval := s.ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		now := time.Now()
+		s.mu.Lock()
+		for key, e := range s.entries {
+			if now.After(e.expiresAt) {
+				delete(s.entries, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
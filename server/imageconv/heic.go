@@ -0,0 +1,92 @@
+package imageconv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Format struct {
+	Extension string
+	Mimetype  string
+}
+
+var formats = map[string]Format{
+	"jpeg": {".jpg", "image/jpeg"},
+	"png":  {".png", "image/png"},
+}
+
+func LookupFormat(name string) (Format, bool) {
+	format, ok := formats[strings.ToLower(name)]
+	return format, ok
+}
+
+var heicBrands = [][]byte{
+	[]byte("heic"), []byte("heix"), []byte("hevc"), []byte("hevx"),
+	[]byte("heim"), []byte("heis"), []byte("mif1"), []byte("msf1"),
+}
+
+// IsHEIC reports whether the upload looks like a HEIC/HEIF image, either by
+// its declared type and extension or by the ftyp brand in the file header.
+func IsHEIC(path, name, mimetype string) bool {
+	switch strings.ToLower(mimetype) {
+	case "image/heic", "image/heif", "image/heic-sequence", "image/heif-sequence":
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".heic", ".heif":
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	if !bytes.Equal(header[4:8], []byte("ftyp")) {
+		return false
+	}
+	for _, brand := range heicBrands {
+		if bytes.Equal(header[8:12], brand) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConvertHEIC converts src with the external converter (heif-convert by
+// default, which picks the output format from the file extension) and
+// returns the path of the converted file next to src. Images of more than
+// maxPixels pixels fail with ErrTooLarge without running the converter.
+func ConvertHEIC(command []string, src string, format Format, timeout time.Duration, maxPixels int64) (string, error) {
+	if len(command) == 0 {
+		return "", fmt.Errorf("no converter configured")
+	}
+	if err := checkPixels(src, maxPixels, true); err != nil {
+		return "", err
+	}
+	dst := strings.TrimSuffix(src, filepath.Ext(src)) + ".converted" + format.Extension
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	args := append(append([]string(nil), command[1:]...), src, dst)
+	output, err := exec.CommandContext(ctx, command[0], args...).CombinedOutput()
+	if err != nil {
+		os.Remove(dst)
+		return "", fmt.Errorf("%w: %s", err, output)
+	}
+	if info, err := os.Stat(dst); err != nil || info.Size() == 0 {
+		os.Remove(dst)
+		return "", fmt.Errorf("converter produced no output")
+	}
+	return dst, nil
+}
@@ -0,0 +1,83 @@
+package imageconv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+)
+
+// ErrTooLarge is returned for images with more pixels than allowed.
+var ErrTooLarge = errors.New("image is too large")
+
+// heicHeaderSize is how much of a HEIC file is searched for its image
+// sizes. The meta box holding them comes before the pixel data.
+const heicHeaderSize = 1 << 20
+
+// checkPixels refuses src when its header declares more than maxPixels
+// pixels, before an external tool gets to allocate them. A maxPixels of
+// zero or less disables the check.
+func checkPixels(src string, maxPixels int64, heic bool) error {
+	if maxPixels <= 0 {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var width, height int64
+	if heic {
+		width, height, err = heicSize(in)
+	} else {
+		var config image.Config
+		config, _, err = image.DecodeConfig(in)
+		width, height = int64(config.Width), int64(config.Height)
+	}
+	if err != nil {
+		return fmt.Errorf("decode image header: %w", err)
+	}
+	if width*height > maxPixels {
+		return fmt.Errorf("%w: %dx%d is more than %d pixels", ErrTooLarge, width, height, maxPixels)
+	}
+	return nil
+}
+
+// heicSize returns the largest image spatial extent (ispe) property in the
+// header of a HEIF file. A grid image has one for the whole picture and one
+// per tile, the largest is the picture.
+func heicSize(in io.Reader) (width, height int64, err error) {
+	header, err := io.ReadAll(io.LimitReader(in, heicHeaderSize))
+	if err != nil {
+		return 0, 0, err
+	}
+	found := false
+	for i := 0; ; {
+		n := bytes.Index(header[i:], []byte("ispe"))
+		if n < 0 {
+			break
+		}
+		at := i + n
+		i = at + 4
+		// A box is its 32 bit size and type, the ispe box then holds a
+		// version and flags, the width and the height.
+		if at < 4 || at+16 > len(header) || binary.BigEndian.Uint32(header[at-4:]) != 20 {
+			continue
+		}
+		w := int64(binary.BigEndian.Uint32(header[at+8:]))
+		h := int64(binary.BigEndian.Uint32(header[at+12:]))
+		if w*h > width*height {
+			width, height = w, h
+		}
+		found = true
+	}
+	if !found {
+		return 0, 0, errors.New("no image size in the header")
+	}
+	return width, height, nil
+}
@@ -0,0 +1,118 @@
+package imageconv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// missingTool fails with a different error than ErrTooLarge if it is ever
+// started.
+var missingTool = []string{"/nonexistent/image-tool"}
+
+// pngHeader returns the signature and IHDR chunk of a PNG declaring the
+// size, without any pixel data.
+func pngHeader(width, height uint32) []byte {
+	data := make([]byte, 13)
+	binary.BigEndian.PutUint32(data[0:], width)
+	binary.BigEndian.PutUint32(data[4:], height)
+	data[8], data[9] = 8, 2 // 8 bit RGB
+	chunk := append([]byte("IHDR"), data...)
+	var out bytes.Buffer
+	out.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&out, binary.BigEndian, uint32(len(data)))
+	out.Write(chunk)
+	binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return out.Bytes()
+}
+
+// heicHeader returns the start of a HEIC file with one ispe property per
+// size.
+func heicHeader(sizes ...[2]uint32) []byte {
+	var out bytes.Buffer
+	out.Write([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"))
+	out.Write([]byte("\x00\x00\x01\x00meta\x00\x00\x00\x00"))
+	for _, size := range sizes {
+		binary.Write(&out, binary.BigEndian, uint32(20))
+		out.WriteString("ispe\x00\x00\x00\x00")
+		binary.Write(&out, binary.BigEndian, size)
+	}
+	return out.Bytes()
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncodeRefusesOversizedHeader(t *testing.T) {
+	src := writeFile(t, "big.png", pngHeader(100_000, 100_000))
+	dst := filepath.Join(t.TempDir(), "big.webp")
+	err := Encode(context.Background(), missingTool, src, dst, 80, 50_000_000)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Encode() = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestConvertHEICRefusesOversizedHeader(t *testing.T) {
+	// The tiles are small, the grid image they make up isn't.
+	src := writeFile(t, "big.heic", heicHeader([2]uint32{512, 512}, [2]uint32{60_000, 60_000}))
+	_, err := ConvertHEIC(missingTool, src, formats["jpeg"], time.Second, 50_000_000)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("ConvertHEIC() = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestCheckPixels(t *testing.T) {
+	var small bytes.Buffer
+	if err := png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		data      []byte
+		heic      bool
+		maxPixels int64
+		want      error
+	}{
+		{"small png", small.Bytes(), false, 100, nil},
+		{"png over the limit", small.Bytes(), false, 99, ErrTooLarge},
+		{"no limit", pngHeader(100_000, 100_000), false, 0, nil},
+		{"small heic", heicHeader([2]uint32{4000, 3000}), true, 50_000_000, nil},
+		{"heic over the limit", heicHeader([2]uint32{10_000, 10_000}), true, 50_000_000, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := writeFile(t, "image", tt.data)
+			if err := checkPixels(src, tt.maxPixels, tt.heic); !errors.Is(err, tt.want) {
+				t.Errorf("checkPixels() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		heic bool
+	}{
+		{"not an image", []byte("hello"), false},
+		{"heic without a size", heicHeader(), true},
+	} {
+		src := writeFile(t, "image", tt.data)
+		if err := checkPixels(src, 100, tt.heic); err == nil || errors.Is(err, ErrTooLarge) {
+			t.Errorf("%s: checkPixels() = %v, want a header error", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package imageconv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var variantFormats = map[string]Format{
+	"webp": {".webp", "image/webp"},
+	"avif": {".avif", "image/avif"},
+}
+
+// LookupVariant returns the format images can be re-encoded to for
+// clients that accept it.
+func LookupVariant(name string) (Format, bool) {
+	format, ok := variantFormats[strings.ToLower(name)]
+	return format, ok
+}
+
+// VariantSource reports whether images of the mimetype get variants.
+// Others, GIF for one, could lose their animation.
+func VariantSource(mimetype string) bool {
+	switch strings.ToLower(mimetype) {
+	case "image/jpeg", "image/png":
+		return true
+	}
+	return false
+}
+
+// Encode re-encodes src to dst with the external encoder (magick by
+// default, which picks the output format from the file extension) at the
+// quality, 1 to 100. The image is turned upright by its EXIF orientation
+// first, the way browsers show the original. Images of more than maxPixels
+// pixels fail with ErrTooLarge without running the encoder.
+func Encode(ctx context.Context, command []string, src, dst string, quality int, maxPixels int64) error {
+	if len(command) == 0 {
+		return fmt.Errorf("no encoder configured")
+	}
+	if err := checkPixels(src, maxPixels, false); err != nil {
+		return err
+	}
+	args := append(append([]string(nil), command[1:]...),
+		src, "-auto-orient", "-quality", strconv.Itoa(quality), dst)
+	output, err := exec.CommandContext(ctx, command[0], args...).CombinedOutput()
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	if info, err := os.Stat(dst); err != nil || info.Size() == 0 {
+		os.Remove(dst)
+		return fmt.Errorf("encoder produced no output")
+	}
+	return nil
+}
@@ -1,133 +1,6812 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"messangere/apierror"
+	"messangere/compression"
+	"messangere/config"
+	"messangere/confirmation"
 	. "messangere/database"
+	"messangere/dbhealth"
+	"messangere/events"
+	"messangere/filecache"
+	"messangere/filehash"
+	"messangere/filespb"
+	"messangere/hls"
+	"messangere/hooks"
+	"messangere/httpheader"
+	"messangere/idempotency"
+	"messangere/imageconv"
+	"messangere/metrics"
+	"messangere/middleware"
+	"messangere/mimealias"
+	"messangere/namepolicy"
+	"messangere/naming"
+	"messangere/scanner"
+	"messangere/scope"
+	"messangere/sensitive"
+	"messangere/signature"
+	"messangere/signedlink"
+	"messangere/throttle"
+	"messangere/thumbnail"
+	"messangere/tracing"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/skip2/go-qrcode"
+	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Repository struct {
-	DB *gorm.DB
+	DB        *gorm.DB
+	Config    *config.Config
+	Events    *events.Hub
+	Backfill  *backfillJob
+	Hooks     *hooks.Pool
+	Stats     *statsCache
+	Files     *filecache.Cache
+	Mimetypes *mimetypeCache
+	Health    *dbhealth.Monitor
+
+	Diagnostics *diagnosticsCache
+	Usage       *storageUsage
+	Writable    *writableCheck
+
+	// Confirmations holds the tokens destructive admin operations wait
+	// for, nil when CONFIRM_GRACE_PERIOD is 0.
+	Confirmations *confirmation.Store
+	Snapshots     *snapshotter
+	// Placeholder is served for missing images, nil without
+	// PLACEHOLDER_IMAGE.
+	Placeholder *placeholderImage
+
+	UserDownloads *throttle.Slots
+	FileDownloads *throttle.Slots
+
+	// Signatures is the magic byte table uploads are checked against when
+	// SIGNATURE_CHECK is on.
+	Signatures []signature.Signature
+
+	// NamePolicy is the filename convention uploads must follow.
+	NamePolicy namepolicy.Policy
 }
 
 const storageDir = "./storage"
 
+// storageDirs lists every directory files are stored in: storageDir, the
+// catch-all, followed by the STORAGE_ROUTES targets. It is set once at
+// startup.
+var storageDirs = []string{storageDir}
+
+// mimetypes normalizes the mimetypes of uploads and filters, extended by
+// MIMETYPE_ALIASES at startup.
+var mimetypes = mimealias.New(nil)
+
+// storageBackend is the span attribute of storage operations, files are
+// only ever stored on local disks.
+var storageBackend = attribute.String("storage.backend", "local")
+
+// extraHashes are the HASH_ALGORITHMS computed next to sha256, which every
+// upload gets, set once at startup.
+var extraHashes []string
+
+// storageRoot is the directory uploads of the mimetype are stored in.
+func (r *Repository) storageRoot(mimetype string) string {
+	mimetype = strings.ToLower(mimetype)
+	for _, route := range r.Config.StorageRoutes {
+		if strings.HasPrefix(mimetype, route.Prefix) {
+			return route.Dir
+		}
+	}
+	return storageDir
+}
+
+const maxBulkUpdateIDs = 10000
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+const (
+	backfillBatchSize  = 100
+	maxReportedMissing = 1000
+)
+
+// uploadHandler stores the files of a multipart upload. Everything that can
+// be decided from the headers (auth, the read-only mode, the declared body
+// size, the content type and the upload session) is checked before the
+// first read of the body. net/http only answers "100 Continue" on that
+// first read, so clients sending Expect: 100-continue get the rejection
+// without uploading the body; other Expect values get a 417 from net/http.
 func (r *Repository) uploadHandler(c *gin.Context) {
-	form, err := c.MultipartForm()
+	if r.Config.RequireMultipart {
+		mediatype, _, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if err != nil || mediatype != "multipart/form-data" {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{
+				"message": "use multipart/form-data with field 'file'",
+			})
+			return
+		}
+	}
+	// The body is an upper bound of the incoming bytes, each file is
+	// checked again when it is saved.
+	if c.Request.ContentLength > 0 && !r.Usage.fits(c.Request.ContentLength) {
+		storageFull(c)
+		return
+	}
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "file not found",
 		})
 		return
 	}
-	files := form.File["file"]
-	if len(files) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"message": "no files received",
+	// In atomic mode the batch is all-or-nothing: the first failure rolls
+	// back every file already stored by this request. The default is
+	// best-effort, where each file succeeds or fails on its own and the
+	// failures are reported next to the stored files.
+	atomic := c.Query("atomic") == "true" || c.GetHeader("X-Upload-Atomic") == "true"
+	level := r.compressionLevel(c)
+	// Files sent for the same message share an upload session. The first
+	// upload opens one and returns its ID, later uploads pass it back in
+	// X-Upload-Session.
+	sessionid := c.GetHeader("X-Upload-Session")
+	if sessionid != "" && !r.openSession(sessionid, middleware.CurrentUser(c)) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "upload session not found or expired",
 		})
 		return
 	}
-	var successuploads []Files
-	for _, file := range files {
-		tmpfilename := uuid.New().String() + filepath.Ext(file.Filename)
-		temppath := filepath.Join(storageDir, tmpfilename)
 
-		if err := c.SaveUploadedFile(file, temppath); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "can't save temporary file",
+	// Parts are streamed straight into temporary files while the body is
+	// read, so each file is written to disk once. Records are created after
+	// the whole body has been received.
+	var pending []pendingUpload
+	defer func() {
+		for _, upload := range pending {
+			os.Remove(upload.TempPath)
+		}
+	}()
+	var failures []gin.H
+	clienterrorsonly := true
+	fields := map[string]string{}
+	// partnames lists the file name of every file part in order, stored
+	// or not, for matching the per-file descriptors.
+	var partnames []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if tooLarge(c, err) {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "malformed multipart body",
 			})
 			return
 		}
-
-		filerecord := Files{
-			Name:     file.Filename,
-			Mimetype: file.Header.Get("Content-Type"),
-			Size:     uint64(file.Size),
+		if part.FileName() == "" {
+			value, err := readFormValue(part, r.Config.MetadataMaxBytes)
+			part.Close()
+			if tooLarge(c, err) {
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": fmt.Sprintf("form field %s: %v", part.FormName(), err),
+				})
+				return
+			}
+			fields[part.FormName()] = value
+			continue
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		upload, readerr, uploaderr := receivePart(c.Request.Context(), part, r.storageRoot(part.Header.Get("Content-Type")))
+		part.Close()
+		upload.Part = len(partnames)
+		partnames = append(partnames, part.FileName())
+		if tooLarge(c, readerr) {
+			return
+		}
+		if readerr != nil {
+			log.Printf("Upload of %s interrupted: %v", part.FileName(), readerr)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "upload interrupted",
+				"file":    part.FileName(),
+			})
+			return
+		}
+		if uploaderr == nil {
+			if uploaderr = r.checkUpload(upload); uploaderr != nil {
+				os.Remove(upload.TempPath)
+			}
+		}
+		if uploaderr != nil {
+			if uploaderr.status >= http.StatusInternalServerError {
+				clienterrorsonly = false
+			}
+			r.Events.Publish(events.TypeUpload, 0, "failed")
+			if atomic {
+				apierror.Set(c, uploaderr.code)
+				c.JSON(uploaderr.status, gin.H{
+					"message": uploaderr.message,
+					"file":    part.FileName(),
+				})
+				return
+			}
+			failures = append(failures, gin.H{
+				"file":    part.FileName(),
+				"message": uploaderr.message,
+				"code":    uploaderr.code,
+			})
+			continue
+		}
+		upload.Owner = middleware.CurrentUser(c)
+		pending = append(pending, upload)
+	}
+	if len(pending) == 0 && len(failures) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "no files received",
+		})
+		return
+	}
+	// Form fields may come before or after the file parts, so they are
+	// applied once the whole body has been read.
+	var metadata JSONMap
+	var descriptors []uploadDescriptor
+	if value, ok := fields["metadata"]; ok {
+		if strings.HasPrefix(strings.TrimSpace(value), "[") {
+			var err error
+			if descriptors, err = matchDescriptors(value, partnames); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": "metadata: " + err.Error(),
+				})
+				return
+			}
+		} else if err := json.Unmarshal([]byte(value), &metadata); err != nil || metadata == nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "metadata must be a JSON object, or an array describing each file",
+			})
+			return
 		}
-		err = r.DB.Create(&filerecord).Error
+	}
+	var redirect *url.URL
+	if value, ok := fields["redirect"]; ok && browserForm(c) {
+		target, err := r.redirectTarget(value)
 		if err != nil {
-			os.Remove(temppath)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "redirect: " + err.Error(),
+			})
+			return
+		}
+		redirect = target
+	}
+	var maxdownloads int64
+	if value, ok := fields["max_downloads"]; ok {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "max_downloads must be a non-negative integer",
+			})
+			return
+		}
+		maxdownloads = n
+	}
+	externalid := fields["external_id"]
+	if externalid != "" {
+		if !validExternalID.MatchString(externalid) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "external_id must be 1 to 128 letters, digits or . _ : -",
+			})
+			return
+		}
+		if len(pending)+len(failures) > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "external_id can only be set when uploading a single file",
+			})
+			return
+		}
+		var count int64
+		if err := r.DB.Model(&Files{}).Where("external_id = ?", externalid).Count(&count).Error; err != nil {
+			log.Printf("Failed to look up external id %s: %v", externalid, err)
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "couldn't create record in DB",
+				"message": "couldn't check the external id",
+			})
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"message": "a file with the same external_id already exists",
+			})
+			return
+		}
+	}
+	var createdat *time.Time
+	if value, ok := fields["created_at"]; ok {
+		user := middleware.CurrentUser(c)
+		if !middleware.IsAdmin(c) && (user == "" || !r.Config.Importers[user]) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"message": "only importers can set created_at",
+			})
+			return
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil || parsed.Before(time.Unix(0, 0)) || parsed.After(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "created_at must be an RFC 3339 timestamp between 1970 and now",
 			})
-			log.Printf("Failed to create DB record for %s: %v", file.Filename, err)
+			return
+		}
+		createdat = &parsed
+	}
+	for i := range pending {
+		pending[i].Metadata = metadata
+		pending[i].CreatedAt = createdat
+		pending[i].CompressLevel = level
+		pending[i].MaxDownloads = maxdownloads
+		pending[i].ExternalID = externalid
+		pending[i].Folder = fields["folder"]
+		if descriptors != nil {
+			descriptors[pending[i].Part].apply(&pending[i])
+		}
+		// The request header is meant for single file uploads, with
+		// several files each part or descriptor carries its own.
+		if pending[i].ExpectedSha256 == "" && len(partnames) == 1 {
+			pending[i].ExpectedSha256 = c.GetHeader("X-Expected-Sha256")
+		}
+	}
+	// The policy applies to the final names, descriptors may rename files.
+	// Checksums given by a descriptor or the request header are only known
+	// now too.
+	accepted := pending[:0]
+	for _, upload := range pending {
+		r.truncateName(&upload)
+		uploaderr := checkChecksum(upload)
+		if uploaderr == nil {
+			uploaderr = r.checkName(upload.Name)
+		}
+		if uploaderr == nil {
+			accepted = append(accepted, upload)
 			continue
 		}
-		finalfilename := strconv.FormatUint(filerecord.ID, 10) + filepath.Ext(file.Filename)
-		finalpath := filepath.Join(storageDir, finalfilename)
-
-		if err := os.Rename(temppath, finalpath); err != nil {
-			os.Remove(temppath)
-			r.DB.Delete(&filerecord)
+		os.Remove(upload.TempPath)
+		r.Events.Publish(events.TypeUpload, 0, "failed")
+		if atomic {
+			for _, other := range pending {
+				os.Remove(other.TempPath)
+			}
+			apierror.Set(c, uploaderr.code)
+			c.JSON(uploaderr.status, gin.H{
+				"message": uploaderr.message,
+				"file":    upload.Name,
+			})
+			return
+		}
+		failures = append(failures, gin.H{
+			"file":    upload.Name,
+			"message": uploaderr.message,
+			"code":    uploaderr.code,
+		})
+	}
+	pending = accepted
+	if sessionid == "" && len(pending) > 0 {
+		session := UploadSession{
+			ID:        uuid.New().String(),
+			Owner:     middleware.CurrentUser(c),
+			ExpiresAt: time.Now().Add(r.Config.UploadSessionTTL),
+		}
+		if err := r.DB.Create(&session).Error; err != nil {
+			log.Printf("Failed to create upload session: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "can't rename the file",
+				"message": "couldn't create the upload session",
 			})
-			log.Printf("Failed to rename file %s: %v", file.Filename, err)
-			continue
+			return
 		}
+		sessionid = session.ID
+	}
+	for i := range pending {
+		pending[i].SessionID = sessionid
+	}
 
-		filerecord.StoragePath = finalpath
-		r.DB.Save(&filerecord)
+	// A sync client re-sending unchanged files gets the stored record back
+	// instead of a copy: same owner, folder, name and content.
+	ifnonematch := c.Query("if-none-match-name") == "true"
+	var successuploads []Files
+	var skipped []uint64
+	for _, upload := range pending {
+		if ifnonematch {
+			existing, found, err := r.sameFile(upload)
+			if err != nil {
+				log.Printf("Failed to look up %s in folder %q: %v", upload.Name, upload.Folder, err)
+			}
+			if found {
+				os.Remove(upload.TempPath)
+				r.Events.Publish(events.TypeUpload, existing.ID, "skipped")
+				successuploads = append(successuploads, existing)
+				skipped = append(skipped, existing.ID)
+				continue
+			}
+		}
+		filerecord, uploaderr := r.saveUpload(c.Request.Context(), upload)
+		if uploaderr != nil {
+			r.Events.Publish(events.TypeUpload, 0, "failed")
+			if atomic {
+				r.rollbackUploads(slices.DeleteFunc(successuploads, func(f Files) bool {
+					return slices.Contains(skipped, f.ID)
+				}))
+				apierror.Set(c, uploaderr.code)
+				c.JSON(uploaderr.status, gin.H{
+					"message": uploaderr.message,
+					"file":    upload.Name,
+				})
+				return
+			}
+			clienterrorsonly = false
+			failures = append(failures, gin.H{
+				"file":    upload.Name,
+				"message": uploaderr.message,
+				"code":    uploaderr.code,
+			})
+			continue
+		}
+		r.Events.Publish(events.TypeUpload, filerecord.ID, "success")
 		successuploads = append(successuploads, filerecord)
 	}
 	if len(successuploads) == 0 {
-		c.JSON(http.StatusInternalServerError, gin.H{
+		status := http.StatusInternalServerError
+		if clienterrorsonly {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{
 			"message": "no one files could be uploaded",
+			"errors":  failures,
+		})
+		return
+	}
+	for _, filerecord := range successuploads {
+		if slices.Contains(skipped, filerecord.ID) {
+			continue
+		}
+		if filerecord.Status == StatusQuarantined && len(r.Config.ScanCommand) > 0 {
+			go r.scanFile(filerecord)
+		}
+		r.Hooks.Submit(filerecord)
+	}
+
+	if redirect != nil {
+		query := redirect.Query()
+		for _, filerecord := range successuploads {
+			query.Add("file_id", strconv.FormatUint(filerecord.ID, 10))
+		}
+		redirect.RawQuery = query.Encode()
+		c.Redirect(http.StatusSeeOther, redirect.String())
+		return
+	}
+	response := gin.H{
+		"message":    "files uploaded successfully",
+		"data":       successuploads,
+		"session_id": sessionid,
+	}
+	if len(failures) > 0 {
+		response["errors"] = failures
+	}
+	if ifnonematch {
+		// In this mode the status tells a sync client whether anything was
+		// stored: 201 for at least one new file, 200 when all were skipped.
+		response["skipped"] = skipped
+		if len(skipped) < len(successuploads) {
+			c.JSON(http.StatusCreated, response)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// rawUploadHandler stores the request body as a single file, for clients
+// such as curl --data-binary that don't build multipart forms. The name
+// comes from X-Filename (percent-encoded if needed) or ?name=, the mimetype
+// from Content-Type; the checks and the response are those of
+// uploadHandler for one file.
+func (r *Repository) rawUploadHandler(c *gin.Context) {
+	name := c.Query("name")
+	if header := c.GetHeader("X-Filename"); header != "" {
+		name = header
+		if decoded, err := url.PathUnescape(header); err == nil {
+			name = decoded
+		}
+	}
+	name = filepath.Base(name)
+	if name == "." || name == string(filepath.Separator) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "the file name is required, in X-Filename or ?name=",
 		})
 		return
 	}
+	mimetype := c.ContentType()
+	if mimetype == "" || mimetype == "application/x-www-form-urlencoded" {
+		// curl sends the form type with --data-binary unless told
+		// otherwise, the extension says more.
+		if mimetype = mime.TypeByExtension(filepath.Ext(name)); mimetype == "" {
+			mimetype = "application/octet-stream"
+		}
+	}
+	mimetype = mimetypes.Normalize(mimetype)
+	if c.Request.ContentLength > 0 && !r.Usage.fits(c.Request.ContentLength) {
+		storageFull(c)
+		return
+	}
+	upload, readerr, uploaderr := receiveBody(c.Request.Context(), c.Request.Body, pendingUpload{
+		Name:     name,
+		Mimetype: mimetype,
+		TempPath: filepath.Join(r.storageRoot(mimetype), uuid.New().String()+filepath.Ext(name)),
 
+		ExpectedSha256: c.GetHeader("X-Expected-Sha256"),
+	})
+	if tooLarge(c, readerr) {
+		return
+	}
+	if readerr != nil {
+		log.Printf("Upload of %s interrupted: %v", name, readerr)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "upload interrupted",
+			"file":    name,
+		})
+		return
+	}
+	if uploaderr == nil {
+		if uploaderr = r.checkUpload(upload); uploaderr == nil {
+			r.truncateName(&upload)
+			uploaderr = r.checkName(upload.Name)
+		}
+		if uploaderr != nil {
+			os.Remove(upload.TempPath)
+		}
+	}
+	var filerecord Files
+	if uploaderr == nil {
+		upload.Owner = middleware.CurrentUser(c)
+		upload.Folder = c.Query("folder")
+		upload.CompressLevel = r.compressionLevel(c)
+		filerecord, uploaderr = r.saveUpload(c.Request.Context(), upload)
+	}
+	if uploaderr != nil {
+		r.Events.Publish(events.TypeUpload, 0, "failed")
+		apierror.Set(c, uploaderr.code)
+		c.JSON(uploaderr.status, gin.H{
+			"message": uploaderr.message,
+			"file":    name,
+		})
+		return
+	}
+	r.Events.Publish(events.TypeUpload, filerecord.ID, "success")
+	if filerecord.Status == StatusQuarantined && len(r.Config.ScanCommand) > 0 {
+		go r.scanFile(filerecord)
+	}
+	r.Hooks.Submit(filerecord)
 	c.JSON(http.StatusOK, gin.H{
-		"message": "files uploaded successfully",
-		"data":    successuploads,
+		"message": "file uploaded successfully",
+		"data":    filerecord,
 	})
 }
-func (r *Repository) downloadHandler(c *gin.Context) {
-	param := c.Param("id")
 
-	filerecord := Files{}
+// browserForm reports whether the request looks like a plain HTML form
+// submission: a navigation, or a client preferring HTML over JSON.
+func browserForm(c *gin.Context) bool {
+	if c.GetHeader("Sec-Fetch-Mode") == "navigate" {
+		return true
+	}
+	return c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML
+}
 
-	err := r.DB.Where("id=?", param).First(&filerecord).Error
+// redirectTarget checks the redirect form field of an upload. Paths on
+// this server are always accepted, absolute URLs only for the hosts in
+// UPLOAD_REDIRECT_HOSTS.
+func (r *Repository) redirectTarget(value string) (*url.URL, error) {
+	target, err := url.Parse(value)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"message": "can't found",
-		})
+		return nil, errors.New("invalid URL")
+	}
+	if !target.IsAbs() {
+		// "//host/path" and "/\host" would leave the server too.
+		if target.Host != "" || !strings.HasPrefix(value, "/") || strings.HasPrefix(value, "//") || strings.HasPrefix(value, "/\\") {
+			return nil, errors.New("only absolute paths or URLs are allowed")
+		}
+		return target, nil
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, errors.New("only http and https URLs are allowed")
+	}
+	if !r.Config.RedirectHosts[strings.ToLower(target.Hostname())] {
+		return nil, fmt.Errorf("host %s is not allowed", target.Hostname())
+	}
+	return target, nil
+}
+
+// permissionMessage replaces the generic error when the storage can't be
+// accessed, so the operator knows what to fix. The path is only logged.
+const permissionMessage = "the server isn't allowed to access its storage, check the permissions of the storage directory"
+
+// storageWriteError is the upload error for a failed write to the storage.
+func storageWriteError(err error, message string) *uploadError {
+	if errors.Is(err, fs.ErrPermission) {
+		return &uploadError{http.StatusInternalServerError, permissionMessage, apierror.PermissionDenied}
+	}
+	return &uploadError{http.StatusInternalServerError, message, apierror.Internal}
+}
+
+// readFailed answers a download whose stored file couldn't be read.
+func readFailed(c *gin.Context, err error) {
+	if errors.Is(err, fs.ErrPermission) {
+		apierror.Set(c, apierror.PermissionDenied)
+		downloadError(c, http.StatusInternalServerError, permissionMessage)
 		return
 	}
-	c.FileAttachment(filerecord.StoragePath, filerecord.Name)
+	downloadError(c, http.StatusInternalServerError, "can't read the file")
+}
 
+// storageFull answers an upload that would take the stored files past
+// MAX_TOTAL_BYTES.
+func storageFull(c *gin.Context) {
+	c.JSON(http.StatusInsufficientStorage, gin.H{
+		"message": "the storage limit has been reached",
+	})
 }
 
-func main() {
-	if err := os.MkdirAll(storageDir, 0755); err != nil {
-		log.Fatal("coudn't create the directory")
+// tooLarge answers 413 when err comes from the body size limit being
+// crossed mid-stream.
+func tooLarge(c *gin.Context, err error) bool {
+	var maxerr *http.MaxBytesError
+	if !errors.As(err, &maxerr) {
+		return false
 	}
-	router := gin.Default()
-	db, err := Connection()
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"message": fmt.Sprintf("request body exceeds %d bytes", maxerr.Limit),
+	})
+	return true
+}
+
+type uploadError struct {
+	status  int
+	message string
+	code    apierror.Code
+}
+
+// pendingUpload is a file part that has been received into a temporary
+// file but has no DB record yet.
+type pendingUpload struct {
+	Name     string
+	Mimetype string
+	TempPath string
+	Size     int64
+	Sha256   string
+	// Hashes are the checksums of extraHashes.
+	Hashes   map[string]string
+	Owner    string
+	Metadata JSONMap
+	// CreatedAt overrides the creation time for imports of older files.
+	CreatedAt *time.Time
+	// ExpectedSha256 is the hash the client computed before uploading.
+	ExpectedSha256 string
+	// CompressLevel is the gzip level used when the file is compressed
+	// at rest.
+	CompressLevel int
+	SessionID     string
+	MaxDownloads  int64
+	ExternalID    string
+	// Part is the position of the file among the file parts.
+	Part      int
+	Tags      []string
+	Folder    string
+	ExpiresAt *time.Time
+	// OriginalName is the name the client sent when Name was truncated.
+	OriginalName string
+}
+
+// uploadDescriptor describes one file of an upload in the metadata array.
+// Entries naming a file are matched to the part with that file name, the
+// others by position among the file parts.
+type uploadDescriptor struct {
+	File      string     `json:"file"`
+	Name      string     `json:"name"`
+	Tags      []string   `json:"tags"`
+	Folder    string     `json:"folder"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Metadata  JSONMap    `json:"metadata"`
+	Sha256    string     `json:"sha256"`
+}
+
+// matchDescriptors parses the metadata array and orders it like the file
+// parts. Every part needs exactly one entry: either all entries name their
+// file or none do.
+func matchDescriptors(value string, partnames []string) ([]uploadDescriptor, error) {
+	var descriptors []uploadDescriptor
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&descriptors); err != nil {
+		return nil, err
+	}
+	if len(descriptors) != len(partnames) {
+		return nil, fmt.Errorf("%d entries for %d files", len(descriptors), len(partnames))
+	}
+	named := 0
+	for i, d := range descriptors {
+		if d.File != "" {
+			named++
+		}
+		for _, tag := range d.Tags {
+			if strings.TrimSpace(tag) == "" {
+				return nil, fmt.Errorf("entry %d: tags must not be empty", i)
+			}
+		}
+		if d.ExpiresAt != nil && !d.ExpiresAt.After(time.Now()) {
+			return nil, fmt.Errorf("entry %d: expires_at must be in the future", i)
+		}
+	}
+	if named == 0 {
+		return descriptors, nil
+	}
+	if named != len(descriptors) {
+		return nil, fmt.Errorf("either every entry or none must name its file")
+	}
+	byname := make(map[string]uploadDescriptor, len(descriptors))
+	for _, d := range descriptors {
+		if _, dup := byname[d.File]; dup {
+			return nil, fmt.Errorf("file %s is described twice", d.File)
+		}
+		byname[d.File] = d
+	}
+	ordered := make([]uploadDescriptor, len(partnames))
+	for i, name := range partnames {
+		d, ok := byname[name]
+		if !ok {
+			return nil, fmt.Errorf("no entry for file %s", name)
+		}
+		ordered[i] = d
+	}
+	return ordered, nil
+}
 
+func (d uploadDescriptor) apply(upload *pendingUpload) {
+	if name := filepath.Base(strings.TrimSpace(d.Name)); d.Name != "" && name != "." && name != "/" {
+		upload.Name = name
+	}
+	for _, tag := range d.Tags {
+		upload.Tags = append(upload.Tags, strings.TrimSpace(tag))
+	}
+	if d.Folder != "" {
+		upload.Folder = d.Folder
+	}
+	upload.ExpiresAt = d.ExpiresAt
+	if d.Metadata != nil {
+		upload.Metadata = d.Metadata
+	}
+	if d.Sha256 != "" {
+		upload.ExpectedSha256 = strings.TrimSpace(d.Sha256)
+	}
+}
+
+// trackingReader remembers the last read error so failures of the client
+// connection can be told apart from failures writing to disk.
+type trackingReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	n, err := t.reader.Read(p)
+	if err != nil && err != io.EOF {
+		t.err = err
+	}
+	return n, err
+}
+
+var errFieldTooLarge = errors.New("value is too large")
+
+// readFormValue reads a non-file form field of at most limit bytes.
+func readFormValue(part *multipart.Part, limit int) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, int64(limit)+1))
 	if err != nil {
-		log.Fatal("could not load the database")
+		return "", err
+	}
+	if len(value) > limit {
+		return "", errFieldTooLarge
+	}
+	return string(value), nil
+}
+
+// receivePart writes a single file part to a temporary file in dir, hashing
+// it on the way. readerr is set when the request body itself failed; uploaderr
+// when the part couldn't be stored.
+func receivePart(ctx context.Context, part *multipart.Part, dir string) (pendingUpload, error, *uploadError) {
+	return receiveBody(ctx, part, pendingUpload{
+		Name:           part.FileName(),
+		Mimetype:       mimetypes.Normalize(part.Header.Get("Content-Type")),
+		TempPath:       filepath.Join(dir, uuid.New().String()+filepath.Ext(part.FileName())),
+		ExpectedSha256: part.Header.Get("X-Expected-Sha256"),
+	})
+}
+
+// receiveBody streams the content of a file into upload.TempPath, hashing
+// it on the way. The errors are those of receivePart.
+func receiveBody(ctx context.Context, body io.Reader, upload pendingUpload) (received pendingUpload, readerr error, uploaderr *uploadError) {
+	_, span := tracing.Start(ctx, "storage.receive", storageBackend)
+	defer func() {
+		span.SetAttributes(attribute.Int64("file.size", received.Size))
+		err := readerr
+		if err == nil && uploaderr != nil {
+			err = errors.New(uploaderr.message)
+		}
+		tracing.End(span, err)
+	}()
+	out, err := os.Create(upload.TempPath)
+	if err != nil {
+		log.Printf("Failed to create temporary file for %s: %v", upload.Name, err)
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return upload, err, nil
+		}
+		return upload, nil, storageWriteError(err, "can't save temporary file")
 	}
-	err = MigrateDB(db)
+	defer out.Close()
+
+	source := &trackingReader{reader: body}
+	h := sha256.New()
+	hashes := filehash.NewSet(extraHashes)
+	written, err := io.Copy(io.MultiWriter(out, h, hashes), source)
 	if err != nil {
-		log.Fatal("could not migrate db")
+		os.Remove(upload.TempPath)
+		if source.err != nil {
+			return upload, source.err, nil
+		}
+		log.Printf("Failed to write temporary file for %s: %v", upload.Name, err)
+		if _, discarderr := io.Copy(io.Discard, body); discarderr != nil {
+			return upload, discarderr, nil
+		}
+		return upload, nil, storageWriteError(err, "can't save temporary file")
 	}
-	r := Repository{
-		DB: db,
+	if err := out.Close(); err != nil {
+		os.Remove(upload.TempPath)
+		log.Printf("Failed to write temporary file for %s: %v", upload.Name, err)
+		return upload, nil, storageWriteError(err, "can't save temporary file")
 	}
-	api := router.Group("/files")
-	{
-		api.GET("/download/:id", r.downloadHandler)
-		api.POST("/upload", r.uploadHandler)
-		// api.Get("/")
+	upload.Size = written
+	upload.Sha256 = hex.EncodeToString(h.Sum(nil))
+	upload.Hashes = hashes.Sums()
+	return upload, nil, nil
+}
+
+// checkUpload applies the per-file upload policies to a received file
+// before anything is stored for it.
+func (r *Repository) checkUpload(upload pendingUpload) *uploadError {
+	if uploaderr := checkChecksum(upload); uploaderr != nil {
+		return uploaderr
 	}
+	if upload.Size == 0 && r.Config.EmptyUploads != config.EmptyUploadsAllow {
+		return &uploadError{http.StatusBadRequest, fmt.Sprintf("file %s is empty", upload.Name), apierror.EmptyFile}
+	}
+	if r.Config.SignatureCheck {
+		return r.checkSignature(upload)
+	}
+	return nil
+}
+
+// checkChecksum rejects an upload whose content doesn't hash to the
+// sha256 the client expected.
+func checkChecksum(upload pendingUpload) *uploadError {
+	if upload.ExpectedSha256 != "" && !strings.EqualFold(upload.ExpectedSha256, upload.Sha256) {
+		return &uploadError{http.StatusBadRequest, fmt.Sprintf("sha256 mismatch for %s: expected %s, received %s",
+			upload.Name, upload.ExpectedSha256, upload.Sha256), apierror.ChecksumMismatch}
+	}
+	return nil
+}
+
+// checkRefSignature is checkSignature for a reference to the stored source.
+func (r *Repository) checkRefSignature(source Files, ref pendingUpload) *uploadError {
+	content, _, err := openContent(source)
+	if err != nil {
+		log.Printf("Failed to open %s: %v", source.StoragePath, err)
+		return &uploadError{http.StatusInternalServerError, "couldn't check the file type", apierror.Internal}
+	}
+	defer content.Close()
+	detected, err := signature.DetectReader(content, r.Signatures)
+	if err != nil {
+		log.Printf("Failed to read the header of %s: %v", source.StoragePath, err)
+		return &uploadError{http.StatusInternalServerError, "couldn't check the file type", apierror.Internal}
+	}
+	return r.checkDetected(ref, detected)
+}
+
+// truncateName shortens a name longer than NAME_MAX_BYTES, see
+// naming.Truncate, keeping the one the client sent.
+func (r *Repository) truncateName(upload *pendingUpload) {
+	name, truncated := naming.Truncate(upload.Name, r.Config.NameMaxBytes)
+	if !truncated {
+		return
+	}
+	log.Printf("Truncated a name of %d bytes to %s", len(upload.Name), name)
+	upload.OriginalName, upload.Name = upload.Name, name
+}
 
-	router.Run(":9090")
+// checkName applies the naming policy, listing every rule the name
+// breaks.
+func (r *Repository) checkName(name string) *uploadError {
+	violations := r.NamePolicy.Check(name)
+	if len(violations) == 0 {
+		return nil
+	}
+	broken := make([]string, len(violations))
+	for i, v := range violations {
+		broken[i] = v.Rule + ": " + v.Message
+	}
+	return &uploadError{http.StatusBadRequest, fmt.Sprintf("name %s breaks the naming policy (%s)",
+		name, strings.Join(broken, "; ")), apierror.InvalidName}
+}
+
+// checkSignature detects the type of an upload from its first bytes. The
+// type must pass the allow and deny lists and agree with the declared
+// mimetype, so an executable can't be passed off as an image.
+func (r *Repository) checkSignature(upload pendingUpload) *uploadError {
+	detected, err := signature.DetectFile(upload.TempPath, r.Signatures)
+	if err != nil {
+		log.Printf("Failed to read the header of %s: %v", upload.Name, err)
+		return &uploadError{http.StatusInternalServerError, "couldn't check the file type", apierror.Internal}
+	}
+	return r.checkDetected(upload, detected)
+}
+
+// checkDetected applies the signature policies to an upload detected as
+// detected.
+func (r *Repository) checkDetected(upload pendingUpload, detected string) *uploadError {
+	allow, deny := r.Config.SignatureAllow, r.Config.SignatureDeny
+	if deny[detected] || len(allow) > 0 && !allow[detected] {
+		return &uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("file %s is detected as %s, which isn't allowed",
+			upload.Name, detected), apierror.MimetypeNotAllowed}
+	}
+	if !signature.Matches(detected, upload.Mimetype, r.Signatures) {
+		return &uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("file %s is declared as %s but detected as %s",
+			upload.Name, upload.Mimetype, detected), apierror.MimetypeNotAllowed}
+	}
+	return nil
+}
+
+// sameFile finds a stored file the upload would duplicate: the same name
+// and content in the same folder of the same owner.
+func (r *Repository) sameFile(upload pendingUpload) (Files, bool, error) {
+	var existing []Files
+	err := r.DB.Where("owner = ? AND folder = ? AND name = ? AND sha256 = ? AND storage_path <> ''",
+		upload.Owner, upload.Folder, upload.Name, upload.Sha256).
+		Order("id DESC").Limit(1).Find(&existing).Error
+	if err != nil || len(existing) == 0 {
+		return Files{}, false, err
+	}
+	return existing[0], true, nil
+}
+
+// hashMap stores checksums in the JSON column, nil when there are none.
+func hashMap(sums map[string]string) JSONMap {
+	if len(sums) == 0 {
+		return nil
+	}
+	m := make(JSONMap, len(sums))
+	for name, sum := range sums {
+		m[name] = sum
+	}
+	return m
+}
+
+// tracedDB is r.DB carrying the trace in ctx, so the queries show up in
+// it. Cancellation isn't passed on: a client hanging up mustn't abort the
+// writes of a request half way.
+func (r *Repository) tracedDB(ctx context.Context) *gorm.DB {
+	return r.DB.WithContext(context.WithoutCancel(ctx))
+}
+
+// saveUpload turns a received file into a stored one: it creates the DB
+// record and renames the temporary file to its final name. On failure
+// nothing is left behind.
+func (r *Repository) saveUpload(ctx context.Context, upload pendingUpload) (Files, *uploadError) {
+	ctx, span := tracing.Start(ctx, "storage.save", storageBackend, attribute.Int64("file.size", upload.Size))
+	defer span.End()
+	db := r.tracedDB(ctx)
+	temppath := upload.TempPath
+	filerecord := Files{
+		Name:      upload.Name,
+		Mimetype:  upload.Mimetype,
+		Size:      uint64(upload.Size),
+		Sha256:    upload.Sha256,
+		Hashes:    hashMap(upload.Hashes),
+		Owner:     upload.Owner,
+		Metadata:  upload.Metadata,
+		Status:    StatusReady,
+		SessionID: upload.SessionID,
+		Folder:    upload.Folder,
+		ExpiresAt: upload.ExpiresAt,
+
+		OriginalName: upload.OriginalName,
+
+		MaxDownloads:       upload.MaxDownloads,
+		DownloadsRemaining: upload.MaxDownloads,
+	}
+	if r.Config.QuarantineEnabled {
+		filerecord.Status = StatusQuarantined
+	}
+	if upload.CreatedAt != nil {
+		filerecord.CreatedAt = *upload.CreatedAt
+	}
+	if upload.ExternalID != "" {
+		filerecord.ExternalID = &upload.ExternalID
+	}
+	originaltemp := r.convertHEIC(&filerecord, &temppath)
+	r.compressUpload(&filerecord, &temppath, upload.CompressLevel)
+
+	// The size is reserved before the record exists so concurrent uploads
+	// can't pass the limit together. Once the blob is in place the record
+	// owns it, removeStoredFiles gives it back.
+	if !r.Usage.reserve(int64(filerecord.Size)) {
+		os.Remove(temppath)
+		if originaltemp != "" {
+			os.Remove(originaltemp)
+		}
+		return Files{}, &uploadError{http.StatusInsufficientStorage, "the storage limit has been reached", apierror.StorageFull}
+	}
+	if err := db.Create(&filerecord).Error; err != nil {
+		r.Usage.add(-int64(filerecord.Size))
+		os.Remove(temppath)
+		if originaltemp != "" {
+			os.Remove(originaltemp)
+		}
+		return Files{}, createConflict(upload, err)
+	}
+	// The file stays in the directory it was received in, a rename can't
+	// cross file systems.
+	root := filepath.Dir(upload.TempPath)
+	finalpath := r.blobPath(root, filerecord)
+
+	// The record points at the blob before the lock is released, a delete
+	// of another record sharing it then sees this reference.
+	var placed bool
+	err := withBlobLock(db, finalpath, func(tx *gorm.DB) error {
+		if err := r.placeBlob(temppath, finalpath); err != nil {
+			return err
+		}
+		placed = true
+		return tx.Model(&Files{ID: filerecord.ID}).Update("storage_path", finalpath).Error
+	})
+	if err != nil {
+		r.Usage.add(-int64(filerecord.Size))
+		if placed {
+			r.releaseBlob(finalpath, filerecord.ID)
+		} else {
+			os.Remove(temppath)
+		}
+		if originaltemp != "" {
+			os.Remove(originaltemp)
+		}
+		db.Delete(&filerecord)
+		log.Printf("Failed to rename file %s: %v", upload.Name, err)
+		return Files{}, storageWriteError(err, "can't rename the file")
+	}
+	filerecord.StoragePath = finalpath
+
+	if originaltemp != "" {
+		originalpath := filepath.Join(root, strconv.FormatUint(filerecord.ID, 10)+".orig"+filepath.Ext(upload.Name))
+		if err := os.Rename(originaltemp, originalpath); err != nil {
+			os.Remove(originaltemp)
+			log.Printf("Failed to keep original of %s: %v", upload.Name, err)
+		} else if err := saveVariant(db, filerecord.ID, VariantOriginal, originalpath, JSONMap{"name": upload.Name, "mimetype": upload.Mimetype}); err != nil {
+			os.Remove(originalpath)
+			log.Printf("Failed to keep original of %s: %v", upload.Name, err)
+		}
+	}
+
+	if err := db.Save(&filerecord).Error; err != nil {
+		r.removeStoredFiles(filerecord)
+		db.Delete(&filerecord)
+		log.Printf("Failed to save storage path for %s: %v", upload.Name, err)
+		return Files{}, &uploadError{http.StatusInternalServerError, "couldn't update record in DB", apierror.Internal}
+	}
+	if len(upload.Tags) > 0 {
+		tags := make([]FileTag, 0, len(upload.Tags))
+		for _, tag := range upload.Tags {
+			tags = append(tags, FileTag{FileID: filerecord.ID, Tag: tag})
+		}
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&tags).Error; err != nil {
+			r.removeStoredFiles(filerecord)
+			db.Delete(&filerecord)
+			log.Printf("Failed to tag %s: %v", upload.Name, err)
+			return Files{}, &uploadError{http.StatusInternalServerError, "couldn't save the tags", apierror.Internal}
+		}
+	}
+	return filerecord, nil
+}
+
+// convertHEIC replaces a HEIC upload with the configured target format when
+// conversion is enabled. The record and temppath are updated in place. When
+// the original is kept, its temporary path is returned so the caller can
+// link it to the record. A failed conversion keeps the original upload.
+func (r *Repository) convertHEIC(filerecord *Files, temppath *string) string {
+	if r.Config.HeicConvertTo == "" || !imageconv.IsHEIC(*temppath, filerecord.Name, filerecord.Mimetype) {
+		return ""
+	}
+	format, ok := imageconv.LookupFormat(r.Config.HeicConvertTo)
+	if !ok {
+		log.Printf("Unsupported HEIC_CONVERT_TO %q, storing %s unchanged", r.Config.HeicConvertTo, filerecord.Name)
+		return ""
+	}
+	converted, err := imageconv.ConvertHEIC(r.Config.HeicConvertCommand, *temppath, format, time.Minute, r.Config.ImageMaxPixels)
+	if err != nil {
+		log.Printf("Warning: couldn't convert %s, storing the original: %v", filerecord.Name, err)
+		return ""
+	}
+	info, err := os.Stat(converted)
+	if err != nil {
+		os.Remove(converted)
+		log.Printf("Warning: couldn't stat converted %s, storing the original: %v", filerecord.Name, err)
+		return ""
+	}
+
+	sums, err := filehash.SumFile(converted, append([]string{filehash.SHA256}, extraHashes...))
+	if err != nil {
+		os.Remove(converted)
+		log.Printf("Warning: couldn't hash converted %s, storing the original: %v", filerecord.Name, err)
+		return ""
+	}
+	sum := sums[filehash.SHA256]
+	delete(sums, filehash.SHA256)
+
+	original := *temppath
+	*temppath = converted
+	filerecord.Name = strings.TrimSuffix(filerecord.Name, filepath.Ext(filerecord.Name)) + format.Extension
+	filerecord.Mimetype = format.Mimetype
+	filerecord.Size = uint64(info.Size())
+	filerecord.Sha256 = sum
+	filerecord.Hashes = hashMap(sums)
+	if r.Config.HeicKeepOriginal {
+		return original
+	}
+	os.Remove(original)
+	return ""
+}
+
+// blobPath is where the bytes of a file are stored. The default layout
+// names them by record ID; the hash layout by content hash, sharded by its
+// first two bytes, so identical uploads in the same root share one file.
+func (r *Repository) blobPath(root string, filerecord Files) string {
+	if r.Config.StorageLayout == config.LayoutHash && filerecord.Sha256 != "" {
+		return hashBlobPath(root, filerecord.Sha256, filerecord.Compressed)
+	}
+	name := strconv.FormatUint(filerecord.ID, 10) + filepath.Ext(filerecord.Name)
+	if filerecord.Compressed {
+		name += ".gz"
+	}
+	return filepath.Join(root, name)
+}
+
+func hashBlobPath(root, sum string, compressed bool) string {
+	name := sum
+	if compressed {
+		name += ".gz"
+	}
+	return filepath.Join(root, sum[:2], sum[2:4], name)
+}
+
+// placeBlob moves a received file to its final path. In the hash layout a
+// file already at the path has the same content, so the new copy is
+// dropped instead.
+func (r *Repository) placeBlob(temppath, finalpath string) error {
+	if r.Config.StorageLayout == config.LayoutHash {
+		if err := os.MkdirAll(filepath.Dir(finalpath), 0755); err != nil {
+			return err
+		}
+		if _, err := os.Stat(finalpath); err == nil {
+			return os.Remove(temppath)
+		}
+	}
+	return os.Rename(temppath, finalpath)
+}
+
+// migrateLayout moves files stored under their ID into the hash layout.
+// Records sharing a blob are moved together; a run can be repeated and
+// only touches what hasn't been moved yet.
+func migrateLayout(db *gorm.DB) error {
+	var blobs []struct {
+		StoragePath string
+		Sha256      string
+		Compressed  bool
+	}
+	err := db.Model(&Files{}).Distinct("storage_path", "sha256", "compressed").
+		Where("storage_path <> ''").Scan(&blobs).Error
+	if err != nil {
+		return err
+	}
+	moved, skipped := 0, 0
+	for _, blob := range blobs {
+		if blob.Sha256 == "" {
+			skipped++
+			continue
+		}
+		root, ok := storageRootOf(blob.StoragePath)
+		if !ok {
+			log.Printf("Skipping %s: it is outside the storage directories", blob.StoragePath)
+			skipped++
+			continue
+		}
+		target := hashBlobPath(root, blob.Sha256, blob.Compressed)
+		if blob.StoragePath == target {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		_, err := os.Stat(target)
+		exists := err == nil
+		if !exists {
+			if err := os.Rename(blob.StoragePath, target); err != nil {
+				log.Printf("Failed to move %s: %v", blob.StoragePath, err)
+				skipped++
+				continue
+			}
+		}
+		err = db.Model(&Files{}).Where("storage_path = ?", blob.StoragePath).
+			Update("storage_path", target).Error
+		if err != nil {
+			if !exists {
+				os.Rename(target, blob.StoragePath)
+			}
+			return err
+		}
+		if exists {
+			os.Remove(blob.StoragePath)
+		}
+		moved++
+	}
+	log.Printf("Storage layout migration: %d files moved, %d skipped", moved, skipped)
+	return nil
+}
+
+// compressionLevel returns the gzip level for the request: the
+// X-Compression-Level header when it holds a valid level, COMPRESS_LEVEL
+// otherwise. The header is meant for trying out levels on real traffic,
+// invalid values fall back quietly instead of logging for every request.
+func (r *Repository) compressionLevel(c *gin.Context) int {
+	level, err := strconv.Atoi(c.GetHeader("X-Compression-Level"))
+	if err != nil || !compression.ValidLevel(level) {
+		return r.Config.CompressLevel
+	}
+	return level
+}
+
+// compressUpload gzips the received file when COMPRESS_AT_REST is on and its
+// type is compressible. The uncompressed file is stored when compression
+// fails.
+func (r *Repository) compressUpload(filerecord *Files, temppath *string, level int) {
+	if !r.Config.CompressAtRest || !compression.Compressible(filerecord.Mimetype, r.Config.CompressTypes) {
+		return
+	}
+	compressed := *temppath + ".gz"
+	if err := compression.CompressFile(*temppath, compressed, level); err != nil {
+		os.Remove(compressed)
+		log.Printf("Failed to compress %s, storing it uncompressed: %v", filerecord.Name, err)
+		return
+	}
+	os.Remove(*temppath)
+	*temppath = compressed
+	filerecord.Compressed = true
+}
+
+// openContent opens the original content of a stored file, inflating it
+// when it is stored compressed, and returns its size.
+func openContent(filerecord Files) (io.ReadCloser, int64, error) {
+	if !insideStorage(filerecord.StoragePath) {
+		return nil, 0, errOutsideStorage
+	}
+	if filerecord.Compressed {
+		content, err := compression.Open(filerecord.StoragePath)
+		return content, int64(filerecord.Size), err
+	}
+	f, err := os.Open(filerecord.StoragePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// contentPath returns the path of a file holding the original content of a
+// stored file, for tools that take a path: the stored file itself, or an
+// inflated copy next to it when it is stored compressed. done removes the
+// copy.
+func contentPath(filerecord Files) (path string, done func(), err error) {
+	if !filerecord.Compressed {
+		return filerecord.StoragePath, func() {}, nil
+	}
+	content, _, err := openContent(filerecord)
+	if err != nil {
+		return "", nil, err
+	}
+	defer content.Close()
+	out, err := os.CreateTemp(filepath.Dir(filerecord.StoragePath), ".inflated-*")
+	if err != nil {
+		return "", nil, err
+	}
+	done = func() { os.Remove(out.Name()) }
+	if _, err := io.Copy(out, content); err != nil {
+		out.Close()
+		done()
+		return "", nil, err
+	}
+	if err := out.Close(); err != nil {
+		done()
+		return "", nil, err
+	}
+	return out.Name(), done, nil
+}
+
+// removeStoredFiles deletes the files on disk that belong to a record that
+// is being removed. The stored blob may be shared with other records after
+// deduplication, so it is only released once nothing references it.
+func (r *Repository) removeStoredFiles(filerecord Files) {
+	r.Usage.add(-int64(filerecord.Size))
+	r.releaseBlob(filerecord.StoragePath, filerecord.ID)
+	var variants []FileVariant
+	if err := r.DB.Where("file_id = ?", filerecord.ID).Find(&variants).Error; err != nil {
+		log.Printf("Failed to load variants of file %d: %v", filerecord.ID, err)
+		return
+	}
+	for _, variant := range variants {
+		if !insideStorage(variant.StoragePath) {
+			log.Printf("Refusing to remove %s: it is outside the storage directory", variant.StoragePath)
+			continue
+		}
+		if variant.Kind == VariantHLS {
+			if dir := filepath.Dir(variant.StoragePath); insideStorage(dir) {
+				if err := os.RemoveAll(dir); err != nil {
+					log.Printf("Failed to remove directory %s: %v", dir, err)
+				}
+			}
+			continue
+		}
+		if err := os.Remove(variant.StoragePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove file %s: %v", variant.StoragePath, err)
+		}
+	}
+	r.DB.Where("file_id = ?", filerecord.ID).Delete(&FileVariant{})
+}
+
+// saveVariant records a derived file, replacing an earlier variant of the
+// same kind.
+func saveVariant(db *gorm.DB, fileID uint64, kind, path string, params JSONMap) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	variant := FileVariant{
+		FileID:      fileID,
+		Kind:        kind,
+		Params:      params,
+		StoragePath: path,
+		Size:        info.Size(),
+		CreatedAt:   time.Now(),
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}, {Name: "kind"}},
+		DoUpdates: clause.AssignmentColumns([]string{"params", "storage_path", "size", "created_at"}),
+	}).Create(&variant).Error
+}
+
+// storedVariant returns the variant of the given kind if its file is still
+// on disk.
+func (r *Repository) storedVariant(fileID uint64, kind string) (FileVariant, bool) {
+	variant := FileVariant{}
+	if err := r.DB.Where("file_id = ? AND kind = ?", fileID, kind).First(&variant).Error; err != nil {
+		return variant, false
+	}
+	if !insideStorage(variant.StoragePath) {
+		log.Printf("Refusing to serve variant %s of file %d: %s is outside the storage directory", kind, fileID, variant.StoragePath)
+		return variant, false
+	}
+	if _, err := os.Stat(variant.StoragePath); err != nil {
+		return variant, false
+	}
+	return variant, true
+}
+
+var errOutsideStorage = errors.New("path is outside the storage directory")
+
+// insideStorage reports whether path resolves to a file inside one of the
+// storage directories. Paths come from the DB and are checked before
+// anything is served or removed, so a bad row can't expose or delete other
+// files on the host.
+func insideStorage(path string) bool {
+	_, ok := storageRootOf(path)
+	return ok
+}
+
+// storageRootOf returns the storage directory holding path.
+func storageRootOf(path string) (string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	for _, dir := range storageDirs {
+		root, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// releaseBlob removes the file at path unless a record other than exceptID
+// still points at it. The number of records sharing a storage path is the
+// blob's reference count. It reports whether the file was removed.
+func (r *Repository) releaseBlob(path string, exceptID uint64) bool {
+	if path == "" {
+		return false
+	}
+	if !insideStorage(path) {
+		log.Printf("Refusing to remove %s: it is outside the storage directory", path)
+		return false
+	}
+	var removed bool
+	err := withBlobLock(r.DB, path, func(tx *gorm.DB) error {
+		var refs int64
+		if err := tx.Model(&Files{}).Where("storage_path = ? AND id <> ?", path, exceptID).Count(&refs).Error; err != nil {
+			return err
+		}
+		if refs > 0 {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Failed to remove file %s: %v", path, err)
+			}
+			return nil
+		}
+		removed = true
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to count references to %s, keeping it: %v", path, err)
+	}
+	return removed
+}
+
+// withBlobLock runs fn in a transaction holding a Postgres advisory lock on
+// the storage path. Placing a blob that is shared in the hash layout and
+// releasing its last reference both take it, so a delete can't remove a
+// blob an upload has just linked to but not yet recorded.
+func withBlobLock(db *gorm.DB, path string, fn func(tx *gorm.DB) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", path).Error; err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// createConflict turns a failed record insert into an upload error. Unique
+// violations, e.g. of external_id, are reported as a 409 naming the
+// conflicting field.
+func createConflict(upload pendingUpload, err error) *uploadError {
+	field, unique := UniqueViolation(err)
+	if !unique {
+		log.Printf("Failed to create DB record for %s: %v", upload.Name, err)
+		return &uploadError{http.StatusInternalServerError, "couldn't create record in DB", apierror.Internal}
+	}
+	return &uploadError{http.StatusConflict, fmt.Sprintf("a file with the same %s already exists", field), apierror.Conflict}
+}
+
+// rollbackUploads removes records and files created earlier in a failed
+// atomic batch.
+func (r *Repository) rollbackUploads(filerecords []Files) {
+	for _, filerecord := range filerecords {
+		if err := r.DB.Delete(&filerecord).Error; err != nil {
+			log.Printf("Failed to roll back record %d: %v", filerecord.ID, err)
+		}
+		r.removeStoredFiles(filerecord)
+		r.Events.Publish(events.TypeDelete, filerecord.ID, "rolled_back")
+	}
+}
+
+func (r *Repository) downloadHandler(c *gin.Context) {
+	filerecord, ok := r.servableImage(c)
+	if !ok {
+		return
+	}
+	filename, ok := r.downloadName(c, filerecord)
+	if !ok {
+		return
+	}
+	release, ok := r.acquireDownload(c, filerecord)
+	if !ok {
+		return
+	}
+	defer release()
+	// The download is only taken once the content is about to be sent, see
+	// countsAsDownload.
+	var exhausted bool
+	claim := func() bool {
+		var ok bool
+		exhausted, ok = r.claimDownload(c, filerecord)
+		return ok
+	}
+	defer func() {
+		if exhausted && r.Config.DeleteExhausted {
+			if err := r.deleteFile(filerecord); err != nil {
+				log.Printf("Failed to delete exhausted file %d: %v", filerecord.ID, err)
+			}
+		}
+	}()
+	if r.Config.WriteTimeout > 0 {
+		stall := throttle.NewStallWriter(c.Writer, r.Config.WriteTimeout)
+		defer stall.Clear()
+		c.Writer = stall
+	}
+	if rate := r.downloadRate(c, filerecord); rate > 0 {
+		c.Writer = throttle.NewWriter(c.Request.Context(), c.Writer, rate)
+	}
+	ctx, span := tracing.Start(c.Request.Context(), "storage.read", storageBackend,
+		attribute.Int64("file.size", int64(filerecord.Size)))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+	if filerecord.Compressed {
+		r.serveCompressed(c, filerecord, filename, claim)
+		return
+	}
+	if r.encodesDownload(filerecord) {
+		c.Header("Vary", "Accept-Encoding")
+		// Ranges are offsets into the original content, a request for one
+		// gets it unencoded.
+		coding := httpheader.NegotiateEncoding(c.GetHeader("Accept-Encoding"), r.Config.DownloadEncodings)
+		if coding != "" && c.GetHeader("Range") == "" {
+			r.serveEncoded(c, filerecord, filename, coding, claim)
+			return
+		}
+	}
+	// A variant of an image is served under its own ETag.
+	path, mimetype, variant := filerecord.StoragePath, "", ""
+	if image, format, ok := r.imageVariant(c, filerecord); ok {
+		path, mimetype, variant = image.StoragePath, format.Mimetype, image.Kind
+		filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + format.Extension
+	} else if oriented, ok := r.orientedImage(c.Request.Context(), filerecord); ok {
+		path, variant = oriented, VariantOriented
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open file %s: %v", path, err)
+		if errors.Is(err, fs.ErrNotExist) && isImage(filerecord) && r.placeholder(c, false) {
+			return
+		}
+		readFailed(c, err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		log.Printf("Failed to open file %s: %v", path, err)
+		readFailed(c, err)
+		return
+	}
+	// The pixels of a variant aren't those of the upload, neither are the
+	// bytes.
+	var etag string
+	if filerecord.Sha256 != "" {
+		etag = `"` + filerecord.Sha256 + `"`
+		if variant != "" {
+			etag = `"` + filerecord.Sha256 + `-` + variant + `"`
+		}
+	}
+	if header := c.GetHeader("Range"); header != "" {
+		coalesceRanges(c, f, header)
+	}
+	if countsAsDownload(c.Request, etag, filerecord.CreatedAt, info.Size()) && !claim() {
+		return
+	}
+	r.setDownloadHeaders(c, filerecord, filename)
+	if mimetype != "" {
+		c.Header("Content-Type", mimetype)
+	}
+	if etag != "" {
+		c.Header("ETag", etag)
+	}
+	if variant == "" {
+		setChecksums(c, filerecord)
+		if c.GetHeader("Range") == "" {
+			setContentMD5(c, filerecord)
+		}
+	}
+	// The copy goes through a 32 KiB buffer and stops as soon as the client
+	// disconnects, so the file is closed right away.
+	http.ServeContent(c.Writer, c.Request, filerecord.Name, filerecord.CreatedAt,
+		throttle.ContextReadSeeker{Ctx: c.Request.Context(), ReadSeeker: f})
+	r.Events.Publish(events.TypeDownload, filerecord.ID, "success")
+	r.recordAccess(c, filerecord.ID)
+}
+
+// countsAsDownload reports whether http.ServeContent is about to send
+// content with etag and modtime that takes one of its downloads: the whole
+// body, or ranges from its first byte, the start of a resumable download.
+// HEAD requests, revalidations answered with 304, the later ranges and
+// unsatisfiable ones don't.
+func countsAsDownload(req *http.Request, etag string, modtime time.Time, size int64) bool {
+	if req.Method == http.MethodHead || httpheader.NotModified(req.Header, etag, modtime) {
+		return false
+	}
+	header := req.Header.Get("Range")
+	if header == "" || !httpheader.IfRange(req.Header.Get("If-Range"), etag, modtime) {
+		return true
+	}
+	return httpheader.StartsAtZero(header, size)
+}
+
+// imageVariant picks the IMAGE_VARIANT_FORMATS variant of an image the
+// Accept header of the client prefers to the original. Variants are only
+// offered once the hook has made them; the response varies by Accept
+// either way.
+func (r *Repository) imageVariant(c *gin.Context, filerecord Files) (FileVariant, imageconv.Format, bool) {
+	if len(r.Config.ImageVariantFormats) == 0 || !imageconv.VariantSource(filerecord.Mimetype) {
+		return FileVariant{}, imageconv.Format{}, false
+	}
+	c.Writer.Header().Add("Vary", "Accept")
+	var variants []FileVariant
+	if err := r.DB.Where("file_id = ? AND kind IN ?", filerecord.ID, r.Config.ImageVariantFormats).
+		Find(&variants).Error; err != nil || len(variants) == 0 {
+		return FileVariant{}, imageconv.Format{}, false
+	}
+	var offered []string
+	byType := map[string]FileVariant{}
+	for _, name := range r.Config.ImageVariantFormats {
+		format, _ := imageconv.LookupVariant(name)
+		for _, variant := range variants {
+			if variant.Kind == name {
+				offered = append(offered, format.Mimetype)
+				byType[format.Mimetype] = variant
+			}
+		}
+	}
+	offered = append(offered, strings.ToLower(filerecord.Mimetype))
+	chosen := httpheader.NegotiateType(c.GetHeader("Accept"), offered)
+	variant, ok := byType[chosen]
+	if !ok || !insideStorage(variant.StoragePath) {
+		return FileVariant{}, imageconv.Format{}, false
+	}
+	if _, err := os.Stat(variant.StoragePath); err != nil {
+		return FileVariant{}, imageconv.Format{}, false
+	}
+	format, _ := imageconv.LookupVariant(variant.Kind)
+	return variant, format, true
+}
+
+// maxRanges is how many distinct ranges a request may ask for before it
+// gets the whole file instead.
+const maxRanges = 64
+
+// coalesceRanges merges the overlapping and adjacent ranges of a Range
+// header before http.ServeContent answers it, which would otherwise fall
+// back to the whole file for overlaps. Headers that don't parse or can't
+// be satisfied are left to it, it answers them with 416 unless If-Range
+// asks for the whole file anyway.
+func coalesceRanges(c *gin.Context, f *os.File, header string) {
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	rewritten, count, ok := httpheader.CoalesceRanges(header, info.Size())
+	switch {
+	case !ok:
+	case count > maxRanges:
+		c.Request.Header.Del("Range")
+	default:
+		c.Request.Header.Set("Range", rewritten)
+	}
+}
+
+// orientedImage returns the path of a copy of the JPEG turned upright by
+// its EXIF orientation, when IMAGE_AUTO_ORIENT is on and the image isn't
+// upright already. The copy is made on the first download, in the
+// processing slots, and kept as a variant.
+func (r *Repository) orientedImage(ctx context.Context, filerecord Files) (string, bool) {
+	if !r.Config.ImageAutoOrient || !thumbnail.Orientable(filerecord.Mimetype) {
+		return "", false
+	}
+	if variant, ok := r.storedVariant(filerecord.ID, VariantOriented); ok {
+		return variant.StoragePath, true
+	}
+	// Reading the orientation is cheap, upright images don't take a slot.
+	if orientation, err := thumbnail.FileOrientation(filerecord.StoragePath); err != nil || orientation == 1 {
+		return "", false
+	}
+	root, ok := storageRootOf(filerecord.StoragePath)
+	if !ok {
+		return "", false
+	}
+	path := filepath.Join(root, strconv.FormatUint(filerecord.ID, 10)+".oriented.jpg")
+	var rotated bool
+	err := r.Hooks.Run(ctx, func() error {
+		var err error
+		if rotated, err = thumbnail.Orient(filerecord.StoragePath, path, r.Config.ImageMaxPixels); err != nil || !rotated {
+			return err
+		}
+		return saveVariant(r.DB, filerecord.ID, VariantOriented, path, nil)
+	})
+	if err != nil {
+		// The upload is still served as it is.
+		log.Printf("Failed to orient image %d: %v", filerecord.ID, err)
+		return "", false
+	}
+	return path, rotated
+}
+
+// serveCompressed sends a file stored gzipped: as is with Content-Encoding
+// to clients accepting gzip, which costs nothing even when another coding
+// is preferred, re-encoded or inflated on the fly to the others. Ranges
+// aren't supported for these, the whole content is always sent; claim takes
+// the download right before.
+func (r *Repository) serveCompressed(c *gin.Context, filerecord Files, filename string, claim func() bool) {
+	accept := c.GetHeader("Accept-Encoding")
+	if !httpheader.AcceptsEncoding(accept, compression.Gzip) {
+		var coding string
+		if r.encodesDownload(filerecord) {
+			coding = httpheader.NegotiateEncoding(accept, r.Config.DownloadEncodings)
+		}
+		r.serveEncoded(c, filerecord, filename, coding, claim)
+		return
+	}
+	f, err := os.Open(filerecord.StoragePath)
+	var length int64
+	if err == nil {
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			length = info.Size()
+		} else {
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to open file %s: %v", filerecord.StoragePath, err)
+		readFailed(c, err)
+		return
+	}
+	defer f.Close()
+	c.Header("Vary", "Accept-Encoding")
+	etag := encodedETag(filerecord, compression.Gzip)
+	if notModified(c, etag, filerecord.CreatedAt) {
+		return
+	}
+	if c.Request.Method != http.MethodHead && !claim() {
+		return
+	}
+	r.setDownloadHeaders(c, filerecord, filename)
+	setChecksums(c, filerecord)
+	c.Header("Accept-Ranges", "none")
+	c.Header("Content-Encoding", compression.Gzip)
+	setValidators(c, etag, filerecord.CreatedAt)
+	c.DataFromReader(http.StatusOK, length, downloadType(filerecord),
+		throttle.ContextReader{Ctx: c.Request.Context(), Reader: f}, nil)
+	r.Events.Publish(events.TypeDownload, filerecord.ID, "success")
+	r.recordAccess(c, filerecord.ID)
+}
+
+// setChecksums sends the checksums of the file. They are of the whole
+// original file, whatever part or encoding of it the response carries, and
+// are left out for variants, whose bytes are different.
+func setChecksums(c *gin.Context, filerecord Files) {
+	for name, sum := range filerecord.Hashes {
+		if sum, ok := sum.(string); ok {
+			c.Header("X-Checksum-"+name, sum)
+		}
+	}
+}
+
+// setContentMD5 sends the MD5 of the file, when it was computed, as the
+// Content-MD5 of a response whose body is the whole unencoded file.
+func setContentMD5(c *gin.Context, filerecord Files) {
+	sum, _ := filerecord.Hashes[filehash.MD5].(string)
+	if raw, err := hex.DecodeString(sum); err == nil && len(raw) == md5.Size {
+		c.Header("Content-MD5", base64.StdEncoding.EncodeToString(raw))
+	}
+}
+
+// encodesDownload reports whether downloads of the file are compressed on
+// the fly for clients accepting one of DOWNLOAD_ENCODINGS. Types missing
+// from COMPRESS_TYPES, images and archives among them, are usually
+// compressed already and are always sent as they are.
+func (r *Repository) encodesDownload(filerecord Files) bool {
+	return r.Config.DownloadCompression && len(r.Config.DownloadEncodings) > 0 &&
+		compression.Compressible(filerecord.Mimetype, r.Config.CompressTypes)
+}
+
+// serveEncoded sends the whole original content of a file compressed with
+// the content coding, or unencoded when coding is "". The length of the
+// result isn't known up front, so the response is chunked. claim takes the
+// download once the content could be opened.
+func (r *Repository) serveEncoded(c *gin.Context, filerecord Files, filename, coding string, claim func() bool) {
+	content, length, err := openContent(filerecord)
+	if err != nil {
+		log.Printf("Failed to open file %s: %v", filerecord.StoragePath, err)
+		readFailed(c, err)
+		return
+	}
+	defer content.Close()
+	c.Header("Vary", "Accept-Encoding")
+	etag := encodedETag(filerecord, coding)
+	if notModified(c, etag, filerecord.CreatedAt) {
+		return
+	}
+	if c.Request.Method != http.MethodHead && !claim() {
+		return
+	}
+	body := io.Reader(throttle.ContextReader{Ctx: c.Request.Context(), Reader: content})
+	r.setDownloadHeaders(c, filerecord, filename)
+	setChecksums(c, filerecord)
+	c.Header("Accept-Ranges", "none")
+	setValidators(c, etag, filerecord.CreatedAt)
+	if coding == "" {
+		setContentMD5(c, filerecord)
+		c.DataFromReader(http.StatusOK, length, downloadType(filerecord), body, nil)
+		r.Events.Publish(events.TypeDownload, filerecord.ID, "success")
+		r.recordAccess(c, filerecord.ID)
+		return
+	}
+	c.Header("Content-Encoding", coding)
+	c.Header("Content-Type", downloadType(filerecord))
+	c.Status(http.StatusOK)
+	encoder, err := compression.NewWriter(c.Writer, coding, r.compressionLevel(c))
+	if err != nil {
+		log.Printf("Failed to encode file %d: %v", filerecord.ID, err)
+		return
+	}
+	if _, err := io.Copy(encoder, body); err != nil {
+		log.Printf("Download of file %d interrupted: %v", filerecord.ID, err)
+		return
+	}
+	if err := encoder.Close(); err != nil {
+		log.Printf("Download of file %d interrupted: %v", filerecord.ID, err)
+		return
+	}
+	r.Events.Publish(events.TypeDownload, filerecord.ID, "success")
+	r.recordAccess(c, filerecord.ID)
+}
+
+// downloadType is the Content-Type of a download: the stored mimetype, or
+// the one the extension implies for records without one. It is always
+// set, http.ServeContent would otherwise sniff the content and could turn
+// an upload without an extension into HTML.
+func downloadType(filerecord Files) string {
+	if mediatype, params, err := mime.ParseMediaType(filerecord.Mimetype); err == nil {
+		if contenttype := mime.FormatMediaType(mediatype, params); contenttype != "" {
+			return contenttype
+		}
+	}
+	if contenttype := mime.TypeByExtension(filepath.Ext(filerecord.Name)); contenttype != "" {
+		return contenttype
+	}
+	return "application/octet-stream"
+}
+
+// encodedETag is the ETag of the file sent with the content coding: the
+// hash for the original bytes, suffixed by the coding otherwise.
+func encodedETag(filerecord Files, coding string) string {
+	switch {
+	case filerecord.Sha256 == "":
+		return ""
+	case coding == "":
+		return `"` + filerecord.Sha256 + `"`
+	}
+	return `"` + filerecord.Sha256 + "-" + coding + `"`
+}
+
+// notModified answers a revalidation of content not sent through
+// http.ServeContent with 304 the way ServeContent would.
+func notModified(c *gin.Context, etag string, modtime time.Time) bool {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead ||
+		!httpheader.NotModified(c.Request.Header, etag, modtime) {
+		return false
+	}
+	setValidators(c, etag, modtime)
+	c.Status(http.StatusNotModified)
+	c.Writer.WriteHeaderNow()
+	return true
+}
+
+func setValidators(c *gin.Context, etag string, modtime time.Time) {
+	if etag != "" {
+		c.Header("ETag", etag)
+	}
+	if !modtime.IsZero() {
+		c.Header("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// setDownloadHeaders sets the validators and the headers that decide how a
+// browser treats the downloaded file.
+func (r *Repository) setDownloadHeaders(c *gin.Context, filerecord Files, filename string) {
+	// Instances sharing the storage must agree on the validators so a
+	// client can fetch ranges from different nodes: the ETag is the content
+	// hash and Last-Modified the creation time from the DB, never the
+	// mtime of the local copy. A stale If-Range then yields the full file
+	// instead of a range of different content.
+	if filerecord.Sha256 != "" {
+		c.Header("ETag", `"`+filerecord.Sha256+`"`)
+	}
+	disposition := "attachment"
+	if c.Query("inline") == "true" {
+		disposition = "inline"
+	}
+	c.Header("Content-Type", downloadType(filerecord))
+	c.Header("X-Content-Type-Options", "nosniff")
+	if activeContent(filerecord) {
+		c.Header("Content-Security-Policy", r.Config.ActiveContentCSP)
+		if !r.Config.ActiveContentInline {
+			disposition = "attachment"
+		}
+	} else {
+		// Nothing a download contains is meant to run in the page.
+		c.Header("Content-Security-Policy", "sandbox")
+	}
+	c.Header("Content-Disposition", httpheader.ContentDisposition(disposition, filename))
+	if r.Config.StorageHeaders {
+		// Files are only ever stored on local disks; the region and node
+		// tell apart deployments sharing a load balancer.
+		c.Header("X-Storage-Backend", "local")
+		if r.Config.StorageRegion != "" {
+			c.Header("X-Storage-Region", r.Config.StorageRegion)
+		}
+		if r.Config.NodeID != "" {
+			c.Header("X-Storage-Node", r.Config.NodeID)
+		}
+	}
+}
+
+// downloadName applies the name template, DOWNLOAD_NAME_TEMPLATE or the
+// one passed in ?name_template=, to the file. An invalid template in the
+// query is answered with 400.
+func (r *Repository) downloadName(c *gin.Context, filerecord Files) (string, bool) {
+	value := c.DefaultQuery("name_template", r.Config.NameTemplate)
+	template, err := naming.Parse(value)
+	if err != nil {
+		downloadError(c, http.StatusBadRequest, "invalid name_template: "+err.Error())
+		return "", false
+	}
+	return template.Execute(filerecord.ID, filerecord.Name, filerecord.CreatedAt), true
+}
+
+var activeContentTypes = map[string]bool{
+	"text/html":             true,
+	"application/xhtml+xml": true,
+	"image/svg+xml":         true,
+	"text/xml":              true,
+	"application/xml":       true,
+}
+
+// activeContent reports whether a browser opening the file may run scripts
+// embedded in it. The type it is served with is checked, and the type
+// derived from the name, which a browser saving and reopening it goes by.
+func activeContent(filerecord Files) bool {
+	for _, value := range []string{downloadType(filerecord), mime.TypeByExtension(filepath.Ext(filerecord.Name))} {
+		mediatype, _, err := mime.ParseMediaType(value)
+		if err == nil && activeContentTypes[strings.ToLower(mediatype)] {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireDownload takes the per-user and per-file download slots, answering
+// 429 when either is exhausted. The returned release must be called once
+// the download has finished or the client went away, which is when the
+// handler returns.
+func (r *Repository) acquireDownload(c *gin.Context, filerecord Files) (func(), bool) {
+	user := middleware.CurrentUser(c)
+	if user == "" {
+		user = "ip:" + c.ClientIP()
+	}
+	file := strconv.FormatUint(filerecord.ID, 10)
+	if !r.UserDownloads.Acquire(user) {
+		c.Header("Retry-After", "5")
+		downloadError(c, http.StatusTooManyRequests, "too many concurrent downloads")
+		return nil, false
+	}
+	if !r.FileDownloads.Acquire(file) {
+		r.UserDownloads.Release(user)
+		c.Header("Retry-After", "5")
+		downloadError(c, http.StatusTooManyRequests, "too many concurrent downloads of this file")
+		return nil, false
+	}
+	return func() {
+		r.FileDownloads.Release(file)
+		r.UserDownloads.Release(user)
+	}, true
+}
+
+// downloadRate picks the bandwidth limit for a download in bytes per second.
+// Limits set on the file and on the caller override the server default;
+// when both are set the stricter one wins. 0 means unlimited.
+func (r *Repository) downloadRate(c *gin.Context, filerecord Files) int64 {
+	var rate int64
+	overrides := []int64{filerecord.DownloadRateLimit, r.Config.UserDownloadRates[middleware.CurrentUser(c)]}
+	for _, override := range overrides {
+		if override > 0 && (rate == 0 || override < rate) {
+			rate = override
+		}
+	}
+	if rate == 0 {
+		rate = r.Config.DownloadRateLimit
+	}
+	return rate
+}
+
+var validExternalID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// externalDownloadHandler downloads a file by the ID its uploader chose.
+// The ID is resolved here and the request continues as a download of the
+// file, with the usual access checks.
+func (r *Repository) externalDownloadHandler(c *gin.Context) {
+	filerecord := Files{}
+	err := r.DB.Select("id").Where("external_id = ?", c.Param("externalId")).First(&filerecord).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		r.Events.Publish(events.TypeDownload, 0, "not_found")
+		downloadError(c, http.StatusNotFound, "can't found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up external id %s: %v", c.Param("externalId"), err)
+		downloadError(c, http.StatusServiceUnavailable, "file metadata is unavailable")
+		return
+	}
+	c.Params = append(c.Params, gin.Param{Key: "id", Value: strconv.FormatUint(filerecord.ID, 10)})
+	r.downloadHandler(c)
+}
+
+var validSha256 = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// storedByHash finds a ready file with the given content that the caller
+// can read. Only readable files are considered: knowing a hash must not
+// reveal, or grant access to, somebody else's file.
+func (r *Repository) storedByHash(c *gin.Context, sum string) (Files, error) {
+	filter := fileFilter{User: middleware.CurrentUser(c), Admin: middleware.IsAdmin(c)}
+	filerecord := Files{}
+	err := filter.apply(r.DB.Model(&Files{})).
+		Where("sha256 = ? AND status = ? AND storage_path <> ''", sum, StatusReady).
+		Order("id").First(&filerecord).Error
+	return filerecord, err
+}
+
+// hashLookupHandler lets clients that hash locally check whether the
+// content is already stored before uploading it. On a hit the file can be
+// referenced through POST /files/ref instead. It answers HEAD as well, with
+// the ID in X-File-Id.
+func (r *Repository) hashLookupHandler(c *gin.Context) {
+	sum := strings.ToLower(c.Param("sha256"))
+	if !validSha256.MatchString(sum) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid sha256",
+		})
+		return
+	}
+	filerecord, err := r.storedByHash(c, sum)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "no file with this content",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up hash %s: %v", sum, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't look up the hash",
+		})
+		return
+	}
+	c.Header("X-File-Id", strconv.FormatUint(filerecord.ID, 10))
+	c.JSON(http.StatusOK, gin.H{
+		"data": filerecord,
+	})
+}
+
+type fileRefRequest struct {
+	Sha256   string `json:"sha256" binding:"required"`
+	Name     string `json:"name" binding:"required"`
+	Mimetype string `json:"mimetype"`
+}
+
+// fileRefHandler creates a file from content that is already stored,
+// without the bytes being sent again. The new record shares the blob of an
+// existing readable file; the blob is removed once neither is left, see
+// releaseBlob.
+func (r *Repository) fileRefHandler(c *gin.Context) {
+	var req fileRefRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "sha256 and name are required",
+		})
+		return
+	}
+	sum := strings.ToLower(req.Sha256)
+	if !validSha256.MatchString(sum) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid sha256",
+		})
+		return
+	}
+	source, err := r.storedByHash(c, sum)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "no file with this content",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up hash %s: %v", sum, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't look up the hash",
+		})
+		return
+	}
+	mimetype := source.Mimetype
+	if req.Mimetype != "" {
+		mimetype = mimetypes.Normalize(req.Mimetype)
+	}
+	ref := pendingUpload{Name: filepath.Base(req.Name), Mimetype: mimetype}
+	r.truncateName(&ref)
+	uploaderr := r.checkName(ref.Name)
+	// The source was checked against its own type when it was uploaded, a
+	// new one has to agree with the content too.
+	if uploaderr == nil && r.Config.SignatureCheck && mimetype != source.Mimetype {
+		uploaderr = r.checkRefSignature(source, ref)
+	}
+	if uploaderr != nil {
+		apierror.Set(c, uploaderr.code)
+		c.JSON(uploaderr.status, gin.H{
+			"message": uploaderr.message,
+		})
+		return
+	}
+	filerecord := Files{
+		Name:         ref.Name,
+		OriginalName: ref.OriginalName,
+		Mimetype:     mimetype,
+		StoragePath:  source.StoragePath,
+		Size:         source.Size,
+		Owner:        middleware.CurrentUser(c),
+		Sha256:       source.Sha256,
+		Hashes:       source.Hashes,
+		Status:       StatusReady,
+		Compressed:   source.Compressed,
+	}
+	if err := r.DB.Create(&filerecord).Error; err != nil {
+		log.Printf("Failed to create reference to %s: %v", source.StoragePath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't create record in DB",
+		})
+		return
+	}
+	// A reference takes no space on disk, it is counted but never refused.
+	r.Usage.add(int64(filerecord.Size))
+	r.Events.Publish(events.TypeUpload, filerecord.ID, "success")
+	r.Hooks.Submit(filerecord)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "file reference created",
+		"data":    filerecord,
+	})
+}
+
+type validateNameRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// validateNameHandler checks a proposed filename against the naming
+// policy, so clients can tell users what to fix before uploading.
+func (r *Repository) validateNameHandler(c *gin.Context) {
+	var req validateNameRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "name is required",
+		})
+		return
+	}
+	violations := r.NamePolicy.Check(req.Name)
+	if violations == nil {
+		violations = []namepolicy.Violation{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"name":       req.Name,
+		"valid":      len(violations) == 0,
+		"violations": violations,
+	})
+}
+
+// pathID parses the :id path parameter. IDs are unsigned 64-bit integers;
+// anything else is rejected before it reaches a query.
+func pathID(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	return id, err == nil
+}
+
+// healthHandler reports whether the database is reachable. A degraded
+// server still answers 200: it keeps serving cached downloads, only writes
+// are refused.
+func (r *Repository) healthHandler(c *gin.Context) {
+	healthy, since := r.Health.State()
+	storage := gin.H{"used_bytes": r.Usage.total(), "writable": r.Writable.check()}
+	if !storage["writable"].(bool) {
+		storage["warning"] = permissionMessage
+	}
+	if r.Usage.limit > 0 {
+		storage["limit_bytes"] = r.Usage.limit
+	}
+	if healthy {
+		c.JSON(http.StatusOK, gin.H{
+			"status":   "ok",
+			"database": "up",
+			"storage":  storage,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "degraded",
+		"database": "down",
+		"since":    since,
+		"storage":  storage,
+	})
+}
+
+// lookupFile loads a single file record by ID, from the cache when it holds
+// the record.
+func (r *Repository) lookupFile(id uint64) (Files, error) {
+	if filerecord, ok := r.Files.Get(id); ok {
+		return filerecord, nil
+	}
+	filerecord := Files{}
+	if err := r.DB.Where("id = ?", id).First(&filerecord).Error; err != nil {
+		return filerecord, err
+	}
+	r.Files.Put(filerecord)
+	return filerecord, nil
+}
+
+// servableFile loads the file from the :id parameter for serving its
+// content, or anything derived from it. Files the caller can't read, files
+// held back by the scanner, expired files and files past their download
+// limit are answered with the matching error.
+func (r *Repository) servableFile(c *gin.Context) (Files, bool) {
+	return r.servable(c, false, false)
+}
+
+// servableContinuation is servableFile for a request continuing a fetch
+// whose download was already taken, the later chunks of bytes. They are
+// served even when that was the file's last download.
+func (r *Repository) servableContinuation(c *gin.Context) (Files, bool) {
+	return r.servable(c, false, true)
+}
+
+// servableImage is servableFile for the handlers showing the image itself,
+// download and thumbnail, which send the placeholder for an image held back
+// by the scanner.
+func (r *Repository) servableImage(c *gin.Context) (Files, bool) {
+	return r.servable(c, true, false)
+}
+
+func (r *Repository) servable(c *gin.Context, placeholder, continued bool) (Files, bool) {
+	id, ok := pathID(c)
+	if !ok {
+		downloadError(c, http.StatusBadRequest, "invalid id")
+		return Files{}, false
+	}
+	filerecord, err := r.lookupFile(id)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		// Only files in the cache can be served while the database is
+		// down.
+		log.Printf("Failed to load file %d: %v", id, err)
+		downloadError(c, http.StatusServiceUnavailable, "file metadata is unavailable")
+		return filerecord, false
+	}
+	if err == nil && !r.canRead(c, filerecord) &&
+		!signedlink.Verify(r.Config.LinkSigningKey, id, c.Query("expires"), c.Query("signature")) {
+		err = gorm.ErrRecordNotFound
+	}
+	if err != nil {
+		r.Events.Publish(events.TypeDownload, 0, "not_found")
+		downloadError(c, http.StatusNotFound, "can't found")
+		return filerecord, false
+	}
+	switch filerecord.Status {
+	case StatusQuarantined:
+		r.Events.Publish(events.TypeDownload, filerecord.ID, "quarantined")
+		if placeholder && isImage(filerecord) && r.placeholder(c, true) {
+			return filerecord, false
+		}
+		downloadError(c, http.StatusLocked, "file is pending a scan")
+		return filerecord, false
+	case StatusInfected:
+		r.Events.Publish(events.TypeDownload, filerecord.ID, "infected")
+		downloadError(c, http.StatusUnavailableForLegalReasons, "file is blocked")
+		return filerecord, false
+	}
+	if filerecord.ExpiresAt != nil && time.Now().After(*filerecord.ExpiresAt) {
+		r.Events.Publish(events.TypeDownload, filerecord.ID, "expired")
+		apierror.Set(c, apierror.FileExpired)
+		downloadError(c, http.StatusGone, "file has expired")
+		return filerecord, false
+	}
+	if filerecord.MaxDownloads > 0 && filerecord.DownloadsRemaining <= 0 && !continued {
+		r.Events.Publish(events.TypeDownload, filerecord.ID, "exhausted")
+		apierror.Set(c, apierror.DownloadLimitReached)
+		downloadError(c, http.StatusGone, "download limit reached")
+		return filerecord, false
+	}
+	if !insideStorage(filerecord.StoragePath) {
+		log.Printf("Refusing to serve file %d: %s is outside the storage directory", filerecord.ID, filerecord.StoragePath)
+		downloadError(c, http.StatusInternalServerError, "can't read the file")
+		return filerecord, false
+	}
+	return filerecord, true
+}
+
+// claimDownload takes one download from a file with a download limit. The
+// decrement is guarded by downloads_remaining > 0 in the same statement,
+// so concurrent downloads can't go past the limit. exhausted reports that
+// this download was the last one.
+func (r *Repository) claimDownload(c *gin.Context, filerecord Files) (exhausted, ok bool) {
+	if filerecord.MaxDownloads == 0 {
+		return false, true
+	}
+	claimed := Files{ID: filerecord.ID}
+	result := r.tracedDB(c.Request.Context()).Model(&claimed).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "downloads_remaining"}}}).
+		Where("downloads_remaining > 0").
+		UpdateColumn("downloads_remaining", gorm.Expr("downloads_remaining - 1"))
+	if result.Error != nil {
+		log.Printf("Failed to count download of file %d: %v", filerecord.ID, result.Error)
+		downloadError(c, http.StatusInternalServerError, "can't record the download")
+		return false, false
+	}
+	if result.RowsAffected == 0 {
+		r.Events.Publish(events.TypeDownload, filerecord.ID, "exhausted")
+		apierror.Set(c, apierror.DownloadLimitReached)
+		downloadError(c, http.StatusGone, "download limit reached")
+		return false, false
+	}
+	return claimed.DownloadsRemaining == 0, true
+}
+
+type downloadLimitRequest struct {
+	MaxDownloads *int64 `json:"max_downloads" binding:"required"`
+}
+
+// downloadLimitHandler sets how often a file can still be downloaded. The
+// count starts over at the new limit; 0 removes the limit.
+func (r *Repository) downloadLimitHandler(c *gin.Context) {
+	filerecord, ok := r.ownedFile(c)
+	if !ok {
+		return
+	}
+	var req downloadLimitRequest
+	if err := c.ShouldBindJSON(&req); err != nil || *req.MaxDownloads < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "max_downloads must be a non-negative integer",
+		})
+		return
+	}
+	err := r.DB.Model(&filerecord).Updates(map[string]any{
+		"max_downloads":       *req.MaxDownloads,
+		"downloads_remaining": *req.MaxDownloads,
+	}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't update the file",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": filerecord,
+	})
+}
+
+// byteRangeHandler returns exactly the bytes start..end (inclusive) of the
+// file as an attachment. Unlike a Range request it never falls back to the
+// full content and is never served from a cache.
+func (r *Repository) byteRangeHandler(c *gin.Context) {
+	// The chunks after the first continue a fetch already counted.
+	start, startErr := strconv.ParseInt(c.Query("start"), 10, 64)
+	servable := r.servableFile
+	if startErr == nil && start > 0 {
+		servable = r.servableContinuation
+	}
+	filerecord, ok := servable(c)
+	if !ok {
+		return
+	}
+	release, ok := r.acquireDownload(c, filerecord)
+	if !ok {
+		return
+	}
+	defer release()
+	content, size, err := openContent(filerecord)
+	if err != nil {
+		log.Printf("Failed to open file %s: %v", filerecord.StoragePath, err)
+		readFailed(c, err)
+		return
+	}
+	defer content.Close()
+
+	if startErr != nil || start < 0 {
+		downloadError(c, http.StatusBadRequest, "start must be a non-negative integer")
+		return
+	}
+	end := size - 1
+	if value := c.Query("end"); value != "" {
+		end, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || end < 0 {
+			downloadError(c, http.StatusBadRequest, "end must be a non-negative integer")
+			return
+		}
+	}
+	if start > end || end >= size {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", size))
+		downloadError(c, http.StatusRequestedRangeNotSatisfiable, "range is outside the file")
+		return
+	}
+
+	// Like the ranges of a download, only the chunk at the start of the
+	// file takes a download.
+	if start == 0 {
+		if _, ok := r.claimDownload(c, filerecord); !ok {
+			return
+		}
+	}
+
+	length := end - start + 1
+	c.Header("Content-Disposition", httpheader.ContentDisposition("attachment", filerecord.Name))
+	c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	c.Header("Cache-Control", "no-store")
+	if filerecord.Sha256 != "" {
+		c.Header("ETag", `"`+filerecord.Sha256+`"`)
+	}
+	var body io.Reader
+	if f, ok := content.(*os.File); ok {
+		body = io.NewSectionReader(f, start, length)
+	} else {
+		// Compressed content can't seek, the bytes before start are
+		// inflated and dropped.
+		if _, err := io.CopyN(io.Discard, content, start); err != nil {
+			log.Printf("Failed to read file %s: %v", filerecord.StoragePath, err)
+			readFailed(c, err)
+			return
+		}
+		body = io.LimitReader(content, length)
+	}
+	c.DataFromReader(http.StatusPartialContent, length, "application/octet-stream", body, nil)
+	r.Events.Publish(events.TypeDownload, filerecord.ID, "success")
+	r.recordAccess(c, filerecord.ID)
+}
+
+const (
+	defaultPreviewLines = 50
+	maxPreviewBytes     = 1 << 20
+)
+
+var textTypes = map[string]bool{
+	"application/json":     true,
+	"application/x-ndjson": true,
+	"application/xml":      true,
+	"application/yaml":     true,
+	"application/x-yaml":   true,
+	"application/csv":      true,
+}
+
+// textual decides from the stored mimetype and the first bytes of the
+// content whether a file can be previewed as text. Both have to agree, so a
+// binary uploaded as text/plain is still refused.
+func textual(mimetype string, head []byte) bool {
+	mediatype, _, err := mime.ParseMediaType(mimetype)
+	if err != nil || !strings.HasPrefix(mediatype, "text/") && !textTypes[mediatype] {
+		return false
+	}
+	return strings.HasPrefix(http.DetectContentType(head), "text/")
+}
+
+// previewHandler streams the first lines of a text file as plain text.
+// The file is read incrementally and never more than maxPreviewBytes of
+// it, however long its lines are.
+func (r *Repository) previewHandler(c *gin.Context) {
+	filerecord, ok := r.servableFile(c)
+	if !ok {
+		return
+	}
+	lines := defaultPreviewLines
+	if value := c.Query("lines"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > r.Config.PreviewMaxLines {
+			downloadError(c, http.StatusBadRequest, fmt.Sprintf("lines must be between 1 and %d", r.Config.PreviewMaxLines))
+			return
+		}
+		lines = n
+	}
+	content, _, err := openContent(filerecord)
+	if err != nil {
+		log.Printf("Failed to open file %s: %v", filerecord.StoragePath, err)
+		readFailed(c, err)
+		return
+	}
+	defer content.Close()
+	reader := bufio.NewReader(io.LimitReader(content, maxPreviewBytes))
+	head, _ := reader.Peek(512)
+	if !textual(filerecord.Mimetype, head) {
+		downloadError(c, http.StatusUnsupportedMediaType, "preview is only available for text files")
+		return
+	}
+	if _, ok := r.claimDownload(c, filerecord); !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+	for lines > 0 {
+		chunk, err := reader.ReadSlice('\n')
+		if len(chunk) > 0 {
+			if _, werr := c.Writer.Write(chunk); werr != nil {
+				return
+			}
+		}
+		if err == nil {
+			lines--
+		} else if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+}
+
+// dataURIType writes the mimetype the way RFC 2397 has it, parameters
+// joined by ; without the spaces mime.FormatMediaType puts after them.
+// Values that aren't tokens are quoted first.
+func dataURIType(mimetype string) string {
+	mediatype, params, err := mime.ParseMediaType(mimetype)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	formatted := mediatype
+	for _, name := range slices.Sorted(maps.Keys(params)) {
+		formatted += ";" + strings.TrimPrefix(mime.FormatMediaType("x/x", map[string]string{name: params[name]}), "x/x; ")
+	}
+	return formatted
+}
+
+// datauriHandler returns a small file as a data: URI for clients that can
+// only embed content inline, such as email templates. The URI is sent as
+// plain text, or in the data field when JSON is accepted.
+func (r *Repository) datauriHandler(c *gin.Context) {
+	filerecord, ok := r.servableFile(c)
+	if !ok {
+		return
+	}
+	if filerecord.Size > uint64(r.Config.DataURIMaxBytes) {
+		downloadError(c, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("data URIs are only available for files up to %d bytes", r.Config.DataURIMaxBytes))
+		return
+	}
+	content, _, err := openContent(filerecord)
+	if err != nil {
+		log.Printf("Failed to open file %s: %v", filerecord.StoragePath, err)
+		readFailed(c, err)
+		return
+	}
+	defer content.Close()
+	data, err := io.ReadAll(io.LimitReader(content, r.Config.DataURIMaxBytes+1))
+	if err != nil {
+		log.Printf("Failed to read file %s: %v", filerecord.StoragePath, err)
+		readFailed(c, err)
+		return
+	}
+	if int64(len(data)) > r.Config.DataURIMaxBytes {
+		downloadError(c, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("data URIs are only available for files up to %d bytes", r.Config.DataURIMaxBytes))
+		return
+	}
+	uri := "data:" + dataURIType(filerecord.Mimetype) + ";base64," + base64.StdEncoding.EncodeToString(data)
+	if _, ok := r.claimDownload(c, filerecord); !ok {
+		return
+	}
+
+	c.Header("Vary", "Accept")
+	if c.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) == gin.MIMEJSON {
+		c.JSON(http.StatusOK, gin.H{
+			"data": uri,
+		})
+		return
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(uri))
+}
+
+const maxArchiveIDs = 1000
+
+// parseIDList reads a comma separated list of file IDs.
+func parseIDList(value string) ([]uint64, error) {
+	var ids []uint64
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", field)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+type archiveManifest struct {
+	Files   []archiveEntry `json:"files"`
+	Missing []uint64       `json:"missing"`
+}
+
+type archiveEntry struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// tarDownloadHandler streams the requested files as a tar archive, gzipped
+// with ?gzip=true. IDs that don't exist, can't be read by the caller or
+// aren't servable are skipped and listed in a trailing MANIFEST.json entry.
+func (r *Repository) tarDownloadHandler(c *gin.Context) {
+	ids, err := parseIDList(c.Query("ids"))
+	if err != nil || len(ids) == 0 {
+		downloadError(c, http.StatusBadRequest, "ids must be a comma separated list of file ids")
+		return
+	}
+	if len(ids) > maxArchiveIDs {
+		downloadError(c, http.StatusBadRequest, fmt.Sprintf("at most %d files per archive", maxArchiveIDs))
+		return
+	}
+	var filerecords []Files
+	if err := r.DB.Where("id IN ?", ids).Find(&filerecords).Error; err != nil {
+		downloadError(c, http.StatusInternalServerError, "couldn't load files")
+		return
+	}
+	byid := make(map[uint64]Files, len(filerecords))
+	for _, filerecord := range filerecords {
+		expired := filerecord.ExpiresAt != nil && time.Now().After(*filerecord.ExpiresAt)
+		// Files with a download limit are left out, an archive would
+		// hand them out without counting.
+		if filerecord.Status == StatusReady && !expired && filerecord.MaxDownloads == 0 && r.canRead(c, filerecord) {
+			byid[filerecord.ID] = filerecord
+		}
+	}
+
+	name, contenttype := "files.tar", "application/x-tar"
+	var out io.Writer = c.Writer
+	if c.Query("gzip") == "true" {
+		name, contenttype = "files.tar.gz", "application/gzip"
+		gz, _ := gzip.NewWriterLevel(c.Writer, r.compressionLevel(c))
+		defer gz.Close()
+		out = gz
+	}
+	c.Header("Content-Type", contenttype)
+	c.Header("Content-Disposition", httpheader.ContentDisposition("attachment", name))
+	c.Status(http.StatusOK)
+
+	tw := tar.NewWriter(out)
+	defer tw.Close()
+	manifest := archiveManifest{Files: []archiveEntry{}, Missing: []uint64{}}
+	names := map[string]bool{}
+	seen := map[uint64]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		filerecord, ok := byid[id]
+		if !ok {
+			manifest.Missing = append(manifest.Missing, id)
+			continue
+		}
+		entryname := archiveEntryName(names, "", id, filerecord.Name)
+		size, err := writeTarEntry(tw, entryname, filerecord)
+		if errors.Is(err, errOutsideStorage) {
+			log.Printf("Refusing to archive file %d: %s is outside the storage directory", id, filerecord.StoragePath)
+		}
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, errOutsideStorage) {
+			manifest.Missing = append(manifest.Missing, id)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to stream file %d into archive: %v", id, err)
+			return
+		}
+		names[entryname] = true
+		manifest.Files = append(manifest.Files, archiveEntry{ID: id, Name: entryname, Size: size})
+		r.Events.Publish(events.TypeDownload, id, "success")
+		r.recordAccess(c, id)
+	}
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	err = tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err != nil {
+		log.Printf("Failed to write archive manifest: %v", err)
+	}
+}
+
+// manifestName is the archive entry listing the archived and missing
+// files.
+const manifestName = "MANIFEST.json"
+
+// archiveEntryName picks the name of a file in an archive: its base name in
+// dir, or, while that is taken by an earlier entry or the manifest, the
+// name prefixed with the file ID and then with a counter as well.
+func archiveEntryName(names map[string]bool, dir string, id uint64, name string) string {
+	base := filepath.Base(name)
+	entryname := dir + base
+	for n := 1; names[entryname] || entryname == manifestName; n++ {
+		prefix := strconv.FormatUint(id, 10)
+		if n > 1 {
+			prefix += "-" + strconv.Itoa(n)
+		}
+		entryname = dir + prefix + "_" + base
+	}
+	return entryname
+}
+
+// writeTarEntry copies a stored file into the archive. The size of
+// uncompressed files comes from the file on disk since the header must
+// match the bytes written exactly.
+func writeTarEntry(tw *tar.Writer, name string, filerecord Files) (int64, error) {
+	content, size, err := openContent(filerecord)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: filerecord.CreatedAt,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(tw, io.LimitReader(content, size))
+	return size, err
+}
+
+// archivePeriod reads the :year, :month and, when the route has it, :day
+// parameters into the UTC range [from, to) of creation times.
+func archivePeriod(c *gin.Context) (from, to time.Time, ok bool) {
+	number := func(name string, min, max int) (int, bool) {
+		value := c.Param(name)
+		if value == "" || strings.Trim(value, "0123456789") != "" {
+			return 0, false
+		}
+		n, err := strconv.Atoi(value)
+		return n, err == nil && n >= min && n <= max
+	}
+	year, ok := number("year", 1970, 9999)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "year must be between 1970 and 9999",
+		})
+		return from, to, false
+	}
+	month, ok := number("month", 1, 12)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "month must be between 1 and 12",
+		})
+		return from, to, false
+	}
+	from = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	to = from.AddDate(0, 1, 0)
+	if c.Param("day") == "" {
+		return from, to, true
+	}
+	days := to.AddDate(0, 0, -1).Day()
+	day, ok := number("day", 1, days)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": fmt.Sprintf("day must be between 1 and %d", days),
+		})
+		return from, to, false
+	}
+	from = from.AddDate(0, 0, day-1)
+	return from, from.AddDate(0, 0, 1), true
+}
+
+// archiveListHandler lists the files created in a month or a day, oldest
+// first. The filters of GET /files apply as well.
+func (r *Repository) archiveListHandler(c *gin.Context) {
+	from, to, ok := archivePeriod(c)
+	if !ok {
+		return
+	}
+	limit, offset, ok := paginationParams(c)
+	if !ok {
+		return
+	}
+	filter := parseFileFilter(c)
+	query := func() *gorm.DB {
+		return filter.apply(r.DB.Model(&Files{})).Where("created_at >= ? AND created_at < ?", from, to)
+	}
+	var total int64
+	if err := query().Count(&total).Error; err != nil {
+		log.Printf("Failed to count archived files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't list files",
+		})
+		return
+	}
+	filerecords := []Files{}
+	if err := query().Order("created_at, id").Limit(limit).Offset(offset).Find(&filerecords).Error; err != nil {
+		log.Printf("Failed to list archived files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't list files",
+		})
+		return
+	}
+	c.Header("Link", pageLinks(c.Request.URL, limit, offset, total))
+	c.JSON(http.StatusOK, gin.H{
+		"data":     filerecords,
+		"from":     from,
+		"to":       to,
+		"total":    total,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": int64(offset+len(filerecords)) < total,
+	})
+}
+
+// archiveZipHandler streams the files created in a month or a day as a
+// zip archive, one directory per day. As with tarDownloadHandler, files
+// that can't be downloaded are left out and stored files that are gone
+// are listed in a trailing MANIFEST.json. The records are read in batches,
+// so a month of any size takes constant memory.
+func (r *Repository) archiveZipHandler(c *gin.Context) {
+	from, to, ok := archivePeriod(c)
+	if !ok {
+		return
+	}
+	name := "files-" + from.Format("2006-01") + ".zip"
+	if c.Param("day") != "" {
+		name = "files-" + from.Format("2006-01-02") + ".zip"
+	}
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", httpheader.ContentDisposition("attachment", name))
+	c.Status(http.StatusOK)
+
+	zw := zip.NewWriter(c.Writer)
+	manifest := archiveManifest{Files: []archiveEntry{}, Missing: []uint64{}}
+	names := map[string]bool{}
+	var batch []Files
+	// Files with a download limit are left out, an archive would hand
+	// them out without counting.
+	err := parseFileFilter(c).apply(r.DB.Model(&Files{})).
+		Where("created_at >= ? AND created_at < ?", from, to).
+		Where("status = ? AND max_downloads = 0 AND (expires_at IS NULL OR expires_at > ?)", StatusReady, time.Now()).
+		FindInBatches(&batch, 200, func(tx *gorm.DB, _ int) error {
+			for _, filerecord := range batch {
+				entryname := archiveEntryName(names, filerecord.CreatedAt.UTC().Format("2006-01-02")+"/", filerecord.ID, filerecord.Name)
+				size, err := writeZipEntry(zw, entryname, filerecord)
+				if errors.Is(err, errOutsideStorage) {
+					log.Printf("Refusing to archive file %d: %s is outside the storage directory", filerecord.ID, filerecord.StoragePath)
+				}
+				if errors.Is(err, os.ErrNotExist) || errors.Is(err, errOutsideStorage) {
+					manifest.Missing = append(manifest.Missing, filerecord.ID)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				names[entryname] = true
+				manifest.Files = append(manifest.Files, archiveEntry{ID: filerecord.ID, Name: entryname, Size: size})
+				r.Events.Publish(events.TypeDownload, filerecord.ID, "success")
+				r.recordAccess(c, filerecord.ID)
+			}
+			return nil
+		}).Error
+	if err != nil {
+		// The archive is cut short, without the central directory the
+		// client can tell it is incomplete.
+		log.Printf("Failed to stream archive %s: %v", name, err)
+		return
+	}
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	w, err := zw.Create(manifestName)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("Failed to write archive manifest: %v", err)
+	}
+}
+
+// writeZipEntry copies a stored file into the archive.
+func writeZipEntry(zw *zip.Writer, name string, filerecord Files) (int64, error) {
+	content, size, err := openContent(filerecord)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: filerecord.CreatedAt,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, io.LimitReader(content, size))
+}
+
+type bulkUpdateRequest struct {
+	IDs     []uint64 `json:"ids"`
+	Updates struct {
+		AddTags     []string   `json:"add_tags"`
+		RemoveTags  []string   `json:"remove_tags"`
+		Folder      *string    `json:"folder"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+		ClearExpiry bool       `json:"clear_expiry"`
+		// DownloadRateLimit in bytes per second, 0 resets to the default.
+		DownloadRateLimit *int64 `json:"download_rate_limit"`
+	} `json:"updates"`
+}
+
+type bulkUpdateResult struct {
+	ID     uint64 `json:"id"`
+	Status string `json:"status"`
+}
+
+// bulkUpdateHandler applies the same metadata changes to many files in one
+// transaction. Only the fields listed in bulkUpdateRequest can be changed;
+// anything else (storage_path, size, ...) is rejected as an unknown field.
+func (r *Repository) bulkUpdateHandler(c *gin.Context) {
+	var req bulkUpdateRequest
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxBulkUpdateIDs {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": fmt.Sprintf("between 1 and %d ids are required", maxBulkUpdateIDs),
+		})
+		return
+	}
+	for _, tags := range [][]string{req.Updates.AddTags, req.Updates.RemoveTags} {
+		for i, tag := range tags {
+			tags[i] = strings.TrimSpace(tag)
+			if tags[i] == "" {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": "tags must not be empty",
+				})
+				return
+			}
+		}
+	}
+	if req.Updates.ClearExpiry && req.Updates.ExpiresAt != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "expires_at and clear_expiry are mutually exclusive",
+		})
+		return
+	}
+
+	var existing []uint64
+	if err := r.DB.Model(&Files{}).Where("id IN ?", req.IDs).Pluck("id", &existing).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load files",
+		})
+		return
+	}
+	found := make(map[uint64]bool, len(existing))
+	for _, id := range existing {
+		found[id] = true
+	}
+
+	updates := map[string]any{
+		"updated_at": time.Now(),
+	}
+	if req.Updates.Folder != nil {
+		updates["folder"] = *req.Updates.Folder
+	}
+	if req.Updates.ExpiresAt != nil {
+		updates["expires_at"] = *req.Updates.ExpiresAt
+	}
+	if req.Updates.ClearExpiry {
+		updates["expires_at"] = nil
+	}
+	if req.Updates.DownloadRateLimit != nil {
+		if *req.Updates.DownloadRateLimit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "download_rate_limit must not be negative",
+			})
+			return
+		}
+		updates["download_rate_limit"] = *req.Updates.DownloadRateLimit
+	}
+	var tags []FileTag
+	for _, id := range existing {
+		for _, tag := range req.Updates.AddTags {
+			tags = append(tags, FileTag{FileID: id, Tag: tag})
+		}
+	}
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if len(existing) == 0 {
+			return nil
+		}
+		if err := tx.Model(&Files{}).Where("id IN ?", existing).Updates(updates).Error; err != nil {
+			return err
+		}
+		if len(tags) > 0 {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&tags, 1000).Error; err != nil {
+				return err
+			}
+		}
+		if len(req.Updates.RemoveTags) > 0 {
+			err := tx.Where("file_id IN ? AND tag IN ?", existing, req.Updates.RemoveTags).Delete(&FileTag{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// The cache is invalidated as the statements run, a lookup racing the
+	// transaction may have cached the old rows again before the commit.
+	r.Files.Purge()
+	if err != nil {
+		log.Printf("Bulk update failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't update files",
+		})
+		return
+	}
+
+	results := make([]bulkUpdateResult, 0, len(req.IDs))
+	missing := 0
+	for _, id := range req.IDs {
+		status := "updated"
+		if !found[id] {
+			status = "not_found"
+			missing++
+		}
+		results = append(results, bulkUpdateResult{ID: id, Status: status})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"updated": len(existing),
+		"missing": missing,
+		"results": results,
+	})
+}
+
+// readableFile loads the file from the :id parameter if the caller may read
+// it and answers 404 otherwise.
+func (r *Repository) readableFile(c *gin.Context) (Files, bool) {
+	id, ok := pathID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid id",
+		})
+		return Files{}, false
+	}
+	filerecord, err := r.lookupFile(id)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Failed to load file %d: %v", id, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"message": "file metadata is unavailable",
+		})
+		return filerecord, false
+	}
+	if err != nil || !r.canRead(c, filerecord) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "can't found",
+		})
+		return filerecord, false
+	}
+	return filerecord, true
+}
+
+// thumbnailHook renders a small JPEG preview of image uploads next to the
+// stored file.
+type thumbnailHook struct {
+	db         *gorm.DB
+	size       int
+	maxPixels  int64
+	autoOrient bool
+}
+
+func (h thumbnailHook) Name() string {
+	return "thumbnail"
+}
+
+func (h thumbnailHook) Process(ctx context.Context, file *Files) error {
+	if !thumbnail.Supported(file.Mimetype) {
+		return nil
+	}
+	root, ok := storageRootOf(file.StoragePath)
+	if !ok {
+		return errOutsideStorage
+	}
+	src, done, err := contentPath(*file)
+	if err != nil {
+		return err
+	}
+	defer done()
+	path := filepath.Join(root, strconv.FormatUint(file.ID, 10)+".thumb.jpg")
+	if err := thumbnail.Generate(src, path, h.size, h.maxPixels, h.autoOrient); err != nil {
+		return err
+	}
+	return saveVariant(h.db.WithContext(ctx), file.ID, VariantThumbnail, path, JSONMap{"size": h.size})
+}
+
+// imageVariantHook re-encodes JPEG and PNG uploads to the
+// IMAGE_VARIANT_FORMATS, stored next to the file as variants of the same
+// name. A variant that isn't smaller than the original is dropped, serving
+// it would only cost bandwidth.
+type imageVariantHook struct {
+	db        *gorm.DB
+	command   []string
+	formats   []string
+	quality   int
+	maxPixels int64
+}
+
+func (h imageVariantHook) Name() string {
+	return "image_variants"
+}
+
+func (h imageVariantHook) Process(ctx context.Context, file *Files) error {
+	if !imageconv.VariantSource(file.Mimetype) {
+		return nil
+	}
+	root, ok := storageRootOf(file.StoragePath)
+	if !ok {
+		return errOutsideStorage
+	}
+	src, done, err := contentPath(*file)
+	if err != nil {
+		return err
+	}
+	defer done()
+	for _, name := range h.formats {
+		format, _ := imageconv.LookupVariant(name)
+		path := filepath.Join(root, strconv.FormatUint(file.ID, 10)+".variant"+format.Extension)
+		if err := imageconv.Encode(ctx, h.command, src, path, h.quality, h.maxPixels); err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if uint64(info.Size()) >= file.Size {
+			log.Printf("Dropping %s variant of file %d: %d bytes, the original has %d", name, file.ID, info.Size(), file.Size)
+			os.Remove(path)
+			continue
+		}
+		if err := saveVariant(h.db.WithContext(ctx), file.ID, name, path, JSONMap{"quality": h.quality}); err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+	return nil
+}
+
+// perceptualHashHook stores the difference hash of image uploads for the
+// similarity search.
+type perceptualHashHook struct {
+	db        *gorm.DB
+	maxPixels int64
+}
+
+func (h perceptualHashHook) Name() string {
+	return "perceptual_hash"
+}
+
+func (h perceptualHashHook) Process(ctx context.Context, file *Files) error {
+	if !thumbnail.Supported(file.Mimetype) {
+		return nil
+	}
+	src, done, err := contentPath(*file)
+	if err != nil {
+		return err
+	}
+	defer done()
+	hash, err := thumbnail.DHash(src, h.maxPixels)
+	if err != nil {
+		return err
+	}
+	value := int64(hash)
+	file.PerceptualHash = &value
+	return h.db.WithContext(ctx).Model(&Files{ID: file.ID}).Update("perceptual_hash", value).Error
+}
+
+// maxSensitiveScanBytes bounds how much of a file the sensitive content
+// scan reads.
+const maxSensitiveScanBytes = 8 << 20
+
+// sensitiveHook flags text files and office documents containing data that
+// looks like card numbers, social security numbers or keys. Only the names
+// of the matching patterns are kept and logged, never the matched values.
+type sensitiveHook struct {
+	db       *gorm.DB
+	patterns []sensitive.Pattern
+}
+
+func (h sensitiveHook) Name() string {
+	return "sensitive_scan"
+}
+
+func (h sensitiveHook) Process(ctx context.Context, file *Files) error {
+	matched, err := h.scan(*file)
+	if err != nil {
+		return err
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+	found := strings.Join(matched, ",")
+	log.Printf("Sensitive content in file %d of %s: %s", file.ID, file.Owner, found)
+	file.Sensitive, file.SensitivePatterns = true, found
+	return h.db.WithContext(ctx).Model(&Files{ID: file.ID}).
+		Updates(map[string]any{"sensitive": true, "sensitive_patterns": found}).Error
+}
+
+// scan returns the patterns found in the text of a text file or an office
+// document. Other files are skipped.
+func (h sensitiveHook) scan(file Files) ([]string, error) {
+	if sensitive.Document(file.Mimetype) {
+		src, done, err := contentPath(file)
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+		return sensitive.ScanDocument(src, maxSensitiveScanBytes, h.patterns)
+	}
+	content, _, err := openContent(file)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	reader := bufio.NewReader(content)
+	head, _ := reader.Peek(512)
+	if !textual(file.Mimetype, head) {
+		return nil, nil
+	}
+	return sensitive.Scan(reader, maxSensitiveScanBytes, h.patterns)
+}
+
+// hlsHook packages videos for streaming. The playlist is stored as the hls
+// variant, the segments next to it in the <id>.hls directory.
+type hlsHook struct {
+	db      *gorm.DB
+	command []string
+	segment time.Duration
+}
+
+func (h hlsHook) Name() string {
+	return "hls"
+}
+
+func (h hlsHook) Process(ctx context.Context, file *Files) error {
+	if !hls.Supported(file.Mimetype) {
+		return nil
+	}
+	root, ok := storageRootOf(file.StoragePath)
+	if !ok {
+		return errOutsideStorage
+	}
+	src, done, err := contentPath(*file)
+	if err != nil {
+		return err
+	}
+	defer done()
+	dir := filepath.Join(root, strconv.FormatUint(file.ID, 10)+".hls")
+	os.RemoveAll(dir)
+	segments, err := hls.Package(ctx, h.command, src, dir, h.segment)
+	if err == nil {
+		err = saveVariant(h.db.WithContext(ctx), file.ID, VariantHLS, filepath.Join(dir, hls.Playlist), JSONMap{"segments": segments})
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+// hammingDistance is the number of bits a perceptual hash differs in from
+// the given one. The XOR of two hashes is cast to a bit string and its set
+// bits counted, a sequential scan over the hashed rows only.
+const hammingDistance = "length(replace((perceptual_hash # ?)::bit(64)::text, '0', ''))"
+
+type similarFile struct {
+	Files
+	Distance int `json:"distance"`
+}
+
+// similarHandler lists images that look like the given one, closest first.
+// Only files the caller can read are returned.
+func (r *Repository) similarHandler(c *gin.Context) {
+	filerecord, ok := r.readableFile(c)
+	if !ok {
+		return
+	}
+	if !thumbnail.Supported(filerecord.Mimetype) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"message": "similarity search is only available for images",
+		})
+		return
+	}
+	if filerecord.PerceptualHash == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "perceptual hash of this file isn't computed yet",
+		})
+		return
+	}
+	distance := r.Config.SimilarMaxDistance
+	if value := c.Query("distance"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 64 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "distance must be between 0 and 64",
+			})
+			return
+		}
+		distance = n
+	}
+	// Access is part of the query, the limit applies to readable files.
+	filter := fileFilter{User: middleware.CurrentUser(c), Admin: middleware.IsAdmin(c)}
+	candidates := filter.apply(r.DB.Model(&Files{})).
+		Select("files.*, "+hammingDistance+" AS distance", *filerecord.PerceptualHash).
+		Where("perceptual_hash IS NOT NULL AND id <> ?", filerecord.ID)
+	similar := []similarFile{}
+	err := r.DB.Table("(?) AS candidates", candidates).
+		Where("distance <= ?", distance).
+		Order("distance, id").Limit(maxPageLimit).
+		Scan(&similar).Error
+	if err != nil {
+		log.Printf("Failed to search similar files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't search similar files",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": similar,
+	})
+}
+
+// processingStatusHandler reports the state of the background processing
+// pool. Active counts on-demand work as well.
+func (r *Repository) processingStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"data": r.Hooks.Stats(),
+	})
+}
+
+func (r *Repository) processingPauseHandler(c *gin.Context) {
+	r.setProcessingPaused(c, true)
+}
+
+func (r *Repository) processingResumeHandler(c *gin.Context) {
+	r.setProcessingPaused(c, false)
+}
+
+// setProcessingPaused stores the flag before applying it, so the pool
+// comes back in the same state after a restart.
+func (r *Repository) setProcessingPaused(c *gin.Context, paused bool) {
+	state := ProcessingState{ID: 1, Paused: paused}
+	if err := r.DB.Save(&state).Error; err != nil {
+		log.Printf("Failed to store the processing state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't store the processing state",
+		})
+		return
+	}
+	r.Hooks.SetPaused(paused)
+	if paused {
+		log.Printf("Background processing paused by %s", c.ClientIP())
+	} else {
+		log.Printf("Background processing resumed by %s", c.ClientIP())
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": r.Hooks.Stats(),
+	})
+}
+
+func (r *Repository) failedJobsHandler(c *gin.Context) {
+	jobs := []FailedJob{}
+	if err := r.DB.Order("id").Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load failed jobs",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": jobs,
+	})
+}
+
+// failedJobRetryHandler queues a failed job again. The record is removed
+// once the job is queued; should it fail again a new one is created.
+func (r *Repository) failedJobRetryHandler(c *gin.Context) {
+	id, ok := pathID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid id",
+		})
+		return
+	}
+	failed := FailedJob{}
+	if err := r.DB.First(&failed, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "no such failed job",
+		})
+		return
+	}
+	filerecord := Files{}
+	if err := r.DB.First(&filerecord, failed.FileID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "the file of this job no longer exists",
+		})
+		return
+	}
+	if err := r.DB.Delete(&failed).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't remove the failed job",
+		})
+		return
+	}
+	if err := r.Hooks.Retry(filerecord, failed.Hook); err != nil {
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, hooks.ErrUnknownHook) {
+			// The hook was disabled since, keep the record.
+			r.DB.Create(&failed)
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "job queued",
+	})
+}
+
+func (r *Repository) hookStatusHandler(c *gin.Context) {
+	filerecord, ok := r.readableFile(c)
+	if !ok {
+		return
+	}
+	runs := []HookRun{}
+	if err := r.DB.Where("file_id = ?", filerecord.ID).Order("hook").Find(&runs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load processing state",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": runs,
+	})
+}
+
+type processingStep struct {
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	Attempts  int        `json:"attempts,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// fileStatusHandler sums up where a file is in its processing: the scan,
+// which follows from the file status, and every hook that was queued for
+// it, with the kinds of the variants made so far. complete is set once no
+// step is left to run, whether the steps succeeded or not.
+func (r *Repository) fileStatusHandler(c *gin.Context) {
+	filerecord, ok := r.readableFile(c)
+	if !ok {
+		return
+	}
+	var runs []HookRun
+	if err := r.DB.Where("file_id = ?", filerecord.ID).Find(&runs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load processing state",
+		})
+		return
+	}
+	variants := []string{}
+	if err := r.DB.Model(&FileVariant{}).Where("file_id = ?", filerecord.ID).Order("kind").
+		Pluck("kind", &variants).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load variants",
+		})
+		return
+	}
+	steps := map[string]processingStep{}
+	switch {
+	case filerecord.Status == StatusQuarantined:
+		steps["scan"] = processingStep{State: HookPending}
+	case filerecord.Status == StatusInfected:
+		steps["scan"] = processingStep{State: HookFailed, Error: "file is infected"}
+	case r.Config.QuarantineEnabled:
+		steps["scan"] = processingStep{State: HookDone}
+	}
+	for _, run := range runs {
+		steps[run.Hook] = processingStep{State: run.State, Error: run.Error, Attempts: run.Attempts, UpdatedAt: &run.UpdatedAt}
+	}
+	complete := true
+	for _, step := range steps {
+		if step.State != HookDone && step.State != HookFailed {
+			complete = false
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":       filerecord.ID,
+		"status":   filerecord.Status,
+		"complete": complete,
+		"steps":    steps,
+		"variants": variants,
+	})
+}
+
+func (r *Repository) variantsHandler(c *gin.Context) {
+	filerecord, ok := r.readableFile(c)
+	if !ok {
+		return
+	}
+	variants := []FileVariant{}
+	if err := r.DB.Where("file_id = ?", filerecord.ID).Order("kind").Find(&variants).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load variants",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": variants,
+	})
+}
+
+// variantHandler serves one derived file. Thumbnails go through
+// thumbnailHandler so a missing one can still be generated.
+func (r *Repository) variantHandler(c *gin.Context) {
+	if c.Param("kind") == VariantThumbnail {
+		r.thumbnailHandler(c)
+		return
+	}
+	filerecord, ok := r.servableFile(c)
+	if !ok {
+		return
+	}
+	variant, ok := r.storedVariant(filerecord.ID, c.Param("kind"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "no such variant of this file",
+		})
+		return
+	}
+	if name, _ := variant.Params["name"].(string); name != "" {
+		c.Header("Content-Disposition", httpheader.ContentDisposition("attachment", name))
+	}
+	r.serveDerived(c, filerecord, variant.StoragePath, true)
+}
+
+// serveDerived sends a file made from filerecord, a thumbnail, variant or
+// part of an HLS stream. With counts it takes one of the downloads of the
+// file, like the original would; HLS segments are covered by the playlist.
+func (r *Repository) serveDerived(c *gin.Context, filerecord Files, path string, counts bool) {
+	f, err := os.Open(path)
+	var info os.FileInfo
+	if err == nil {
+		if info, err = f.Stat(); err != nil {
+			f.Close()
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		downloadError(c, http.StatusNotFound, "can't found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to open file %s: %v", path, err)
+		readFailed(c, err)
+		return
+	}
+	defer f.Close()
+	if counts && countsAsDownload(c.Request, "", info.ModTime(), info.Size()) {
+		if _, ok := r.claimDownload(c, filerecord); !ok {
+			return
+		}
+	}
+	http.ServeContent(c.Writer, c.Request, filepath.Base(path), info.ModTime(), f)
+}
+
+// thumbnailHandler serves the preview of an image. Missing previews, e.g.
+// from a failed job or an older deployment, are rendered on the spot when
+// THUMBNAIL_ON_DEMAND is set, sharing the processing slots with the hooks.
+func (r *Repository) thumbnailHandler(c *gin.Context) {
+	filerecord, ok := r.servableImage(c)
+	if !ok {
+		return
+	}
+	if variant, ok := r.storedVariant(filerecord.ID, VariantThumbnail); ok {
+		r.serveDerived(c, filerecord, variant.StoragePath, true)
+		return
+	}
+	if !thumbnail.Supported(filerecord.Mimetype) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"message": "thumbnails are only available for images",
+		})
+		return
+	}
+	if !r.Config.ThumbnailOnDemand {
+		if r.placeholder(c, r.hookPending(filerecord.ID, thumbnailHook{}.Name())) {
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "no thumbnail for this file",
+		})
+		return
+	}
+	hook := thumbnailHook{db: r.DB, size: r.Config.ThumbnailSize, maxPixels: r.Config.ImageMaxPixels,
+		autoOrient: r.Config.ImageAutoOrient}
+	err := r.Hooks.Run(c.Request.Context(), func() error {
+		return hook.Process(c.Request.Context(), &filerecord)
+	})
+	if errors.Is(err, thumbnail.ErrTooLarge) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	variant, ok := r.storedVariant(filerecord.ID, VariantThumbnail)
+	if errors.Is(err, fs.ErrNotExist) && r.placeholder(c, false) {
+		return
+	}
+	if err != nil || !ok {
+		log.Printf("Failed to generate thumbnail for file %d: %v", filerecord.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't generate the thumbnail",
+		})
+		return
+	}
+	r.serveDerived(c, filerecord, variant.StoragePath, true)
+}
+
+type placeholderImage struct {
+	data     []byte
+	mimetype string
+}
+
+// loadPlaceholder reads PLACEHOLDER_IMAGE once at startup. The type comes
+// from the extension, SVG can't be sniffed.
+func loadPlaceholder(path string) (*placeholderImage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	mimetype := mime.TypeByExtension(filepath.Ext(path))
+	if mimetype == "" {
+		mimetype = http.DetectContentType(data)
+	}
+	return &placeholderImage{data: data, mimetype: mimetype}, nil
+}
+
+// placeholder answers with PLACEHOLDER_IMAGE instead of a 404 when the
+// client asked for it with ?placeholder=true, or PLACEHOLDER_DEFAULT is on
+// and it didn't opt out. An image still being processed gets 202, a lost
+// one 200; X-Placeholder tells them from the real image, which must not be
+// cached in their place.
+func (r *Repository) placeholder(c *gin.Context, processing bool) bool {
+	if r.Placeholder == nil {
+		return false
+	}
+	wanted, err := strconv.ParseBool(c.Query("placeholder"))
+	if err != nil {
+		wanted = r.Config.PlaceholderDefault
+	}
+	if !wanted {
+		return false
+	}
+	status, reason := http.StatusOK, "missing"
+	if processing {
+		status, reason = http.StatusAccepted, "processing"
+	}
+	c.Header("X-Placeholder", reason)
+	c.Header("Cache-Control", "no-store")
+	c.Data(status, r.Placeholder.mimetype, r.Placeholder.data)
+	return true
+}
+
+// hookPending reports whether the hook is yet to finish with the file.
+func (r *Repository) hookPending(fileID uint64, hook string) bool {
+	run := HookRun{}
+	err := r.DB.Where("file_id = ? AND hook = ?", fileID, hook).First(&run).Error
+	return err == nil && (run.State == HookPending || run.State == HookRunning || run.State == HookRetrying)
+}
+
+func isImage(filerecord Files) bool {
+	return strings.HasPrefix(strings.ToLower(filerecord.Mimetype), "image/")
+}
+
+// hlsHandler serves the HLS playlist and segments of a video. The playlist
+// names the segments relative to itself, so both share one route. Until
+// the hls hook has packaged the file it answers 409 with the state of the
+// run.
+func (r *Repository) hlsHandler(c *gin.Context) {
+	filerecord, ok := r.servableFile(c)
+	if !ok {
+		return
+	}
+	if !r.Config.HLSEnabled || !hls.Supported(filerecord.Mimetype) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "no HLS stream for this file",
+		})
+		return
+	}
+	variant, ok := r.storedVariant(filerecord.ID, VariantHLS)
+	if !ok {
+		run := HookRun{}
+		err := r.DB.Where("file_id = ? AND hook = ?", filerecord.ID, hlsHook{}.Name()).First(&run).Error
+		switch {
+		case err == nil && (run.State == HookPending || run.State == HookRunning || run.State == HookRetrying):
+			apierror.Set(c, apierror.Processing)
+			c.JSON(http.StatusConflict, gin.H{
+				"message": "processing",
+				"state":   run.State,
+			})
+		case err == nil && run.State == HookFailed:
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "packaging the video failed",
+			})
+		default:
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "no HLS stream for this file",
+			})
+		}
+		return
+	}
+	switch name := c.Param("name"); {
+	case name == hls.Playlist:
+		c.Header("Content-Type", hls.PlaylistType)
+		r.serveDerived(c, filerecord, variant.StoragePath, true)
+	case hls.ValidSegment(name):
+		c.Header("Content-Type", hls.SegmentType)
+		r.serveDerived(c, filerecord, filepath.Join(filepath.Dir(variant.StoragePath), name), false)
+	default:
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "no such segment",
+		})
+	}
+}
+
+// publicURL makes an absolute URL for path. Every link handed out goes
+// through it so they all point at the same place: PUBLIC_BASE_URL when set,
+// otherwise the host the request was sent to, with the scheme reported by
+// a TLS terminating proxy in X-Forwarded-Proto.
+func (r *Repository) publicURL(c *gin.Context, path string) string {
+	if r.Config.PublicBaseURL != "" {
+		return r.Config.PublicBaseURL + path
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host + path
+}
+
+// shareLink is the download URL handed out for a file. With a signing key
+// configured it carries a signature that lets anybody download the file
+// until it expires.
+func (r *Repository) shareLink(c *gin.Context, filerecord Files) string {
+	path := "/files/download/" + strconv.FormatUint(filerecord.ID, 10)
+	if r.Config.LinkSigningKey != "" {
+		expires := time.Now().Add(r.Config.LinkTTL)
+		query := url.Values{
+			"expires":   {strconv.FormatInt(expires.Unix(), 10)},
+			"signature": {signedlink.Sign(r.Config.LinkSigningKey, filerecord.ID, expires)},
+		}
+		path += "?" + query.Encode()
+	}
+	return r.publicURL(c, path)
+}
+
+// qrHandler renders the share link of a file as a QR code, PNG by default
+// or SVG with ?format=svg.
+func (r *Repository) qrHandler(c *gin.Context) {
+	filerecord, ok := r.ownedFile(c)
+	if !ok {
+		return
+	}
+	size := r.Config.QRSize
+	if value := c.Query("size"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 64 || n > 2048 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "size must be between 64 and 2048",
+			})
+			return
+		}
+		size = n
+	}
+	code, err := qrcode.New(r.shareLink(c, filerecord), qrcode.Medium)
+	if err != nil {
+		log.Printf("Failed to encode QR code for file %d: %v", filerecord.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't generate the QR code",
+		})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	switch c.DefaultQuery("format", "png") {
+	case "png":
+		png, err := code.PNG(size)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "couldn't generate the QR code",
+			})
+			return
+		}
+		c.Data(http.StatusOK, "image/png", png)
+	case "svg":
+		c.Data(http.StatusOK, "image/svg+xml", qrSVG(code.Bitmap(), size))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "format must be png or svg",
+		})
+	}
+}
+
+// qrSVG draws the modules of a QR code as one SVG path.
+func qrSVG(bitmap [][]bool, size int) []byte {
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	n := len(bitmap)
+	return fmt.Appendf(nil, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		size, size, n, n, n, n, path.String())
+}
+
+// canRead reports whether the caller may read the file. Files without an
+// owner are public; owned files are readable by the owner, by users the
+// file was shared with and by the admin. Inaccessible files are reported
+// as missing so their existence doesn't leak.
+func (r *Repository) canRead(c *gin.Context, filerecord Files) bool {
+	return r.canReadAs(middleware.CurrentUser(c), middleware.IsAdmin(c), filerecord)
+}
+
+func (r *Repository) canReadAs(user string, admin bool, filerecord Files) bool {
+	return r.readableAs(user, admin, []Files{filerecord})[filerecord.ID]
+}
+
+// readableAs reports which of the files the user may read, looking up the
+// shares of all of them with one query.
+func (r *Repository) readableAs(user string, admin bool, filerecords []Files) map[uint64]bool {
+	readable := make(map[uint64]bool, len(filerecords))
+	var shared []uint64
+	for _, filerecord := range filerecords {
+		if filerecord.Owner == "" || admin || (user != "" && filerecord.Owner == user) {
+			readable[filerecord.ID] = true
+		} else if user != "" {
+			shared = append(shared, filerecord.ID)
+		}
+	}
+	if len(shared) == 0 {
+		return readable
+	}
+	var ids []uint64
+	err := r.DB.Model(&FileShare{}).
+		Where("file_id IN ? AND user_id = ? AND permission = ?", shared, user, PermissionRead).
+		Pluck("file_id", &ids).Error
+	if err != nil {
+		log.Printf("Failed to check shares of files %v: %v", shared, err)
+		return readable
+	}
+	for _, id := range ids {
+		readable[id] = true
+	}
+	return readable
+}
+
+// ownedFile loads the file from the :id parameter and checks that the
+// caller owns it. It writes the error response itself.
+func (r *Repository) ownedFile(c *gin.Context) (Files, bool) {
+	id, ok := pathID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid id",
+		})
+		return Files{}, false
+	}
+	filerecord, err := r.lookupFile(id)
+	if err != nil || !r.canRead(c, filerecord) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "can't found",
+		})
+		return filerecord, false
+	}
+	user := middleware.CurrentUser(c)
+	if !middleware.IsAdmin(c) && (user == "" || filerecord.Owner != user) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "only the owner can manage sharing of this file",
+		})
+		return filerecord, false
+	}
+	return filerecord, true
+}
+
+type shareRequest struct {
+	UserID     string `json:"user_id" binding:"required"`
+	Permission string `json:"permission" binding:"required,oneof=read none"`
+}
+
+func (r *Repository) sharesListHandler(c *gin.Context) {
+	filerecord, ok := r.ownedFile(c)
+	if !ok {
+		return
+	}
+	shares := []FileShare{}
+	if err := r.DB.Where("file_id = ?", filerecord.ID).Order("user_id").Find(&shares).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load shares",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": shares,
+	})
+}
+
+func (r *Repository) shareGrantHandler(c *gin.Context) {
+	filerecord, ok := r.ownedFile(c)
+	if !ok {
+		return
+	}
+	var req shareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "user_id and permission (read or none) are required",
+		})
+		return
+	}
+	share := FileShare{
+		FileID:     filerecord.ID,
+		UserID:     req.UserID,
+		Permission: req.Permission,
+	}
+	err := r.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"permission"}),
+	}).Create(&share).Error
+	if field, unique := UniqueViolation(err); unique {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "share conflicts on " + field,
+			"field":   field,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't save the share",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "access granted",
+		"data":    share,
+	})
+}
+
+func (r *Repository) shareRevokeHandler(c *gin.Context) {
+	filerecord, ok := r.ownedFile(c)
+	if !ok {
+		return
+	}
+	result := r.DB.Where("file_id = ? AND user_id = ?", filerecord.ID, c.Param("user")).Delete(&FileShare{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't revoke the share",
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "file isn't shared with this user",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "access revoked",
+	})
+}
+
+// negotiateFormat picks the encoding of responses available as JSON and
+// protobuf. JSON is used unless the client asks for protobuf.
+func negotiateFormat(c *gin.Context) string {
+	c.Header("Vary", "Accept")
+	return c.NegotiateFormat(gin.MIMEJSON, filespb.ContentType)
+}
+
+func (r *Repository) fileInfoHandler(c *gin.Context) {
+	filerecord, ok := r.readableFile(c)
+	if !ok {
+		return
+	}
+	if negotiateFormat(c) == filespb.ContentType {
+		c.Data(http.StatusOK, filespb.ContentType, filespb.MarshalFileResponse(filerecord))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": filerecord,
+	})
+}
+
+const maxBatchIDs = 200
+
+// batchInfoHandler returns the metadata of several files at once, for
+// clients rendering many attachments. The body is a JSON array of IDs; data
+// has an entry per ID in the same order, null for files that don't exist
+// or the caller can't read, which are told apart no more than by
+// fileInfoHandler.
+func (r *Repository) batchInfoHandler(c *gin.Context) {
+	var ids []uint64
+	if err := c.ShouldBindJSON(&ids); err != nil || len(ids) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "the body must be a JSON array of file ids",
+		})
+		return
+	}
+	if len(ids) > maxBatchIDs {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": fmt.Sprintf("at most %d ids per request", maxBatchIDs),
+		})
+		return
+	}
+	byid := make(map[uint64]Files, len(ids))
+	var missing []uint64
+	for _, id := range ids {
+		if filerecord, ok := r.Files.Get(id); ok {
+			byid[id] = filerecord
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		var filerecords []Files
+		if err := r.DB.Where("id IN ?", missing).Find(&filerecords).Error; err != nil {
+			log.Printf("Failed to load files %v: %v", missing, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"message": "file metadata is unavailable",
+			})
+			return
+		}
+		for _, filerecord := range filerecords {
+			r.Files.Put(filerecord)
+			byid[filerecord.ID] = filerecord
+		}
+	}
+	filerecords := make([]Files, 0, len(byid))
+	for _, filerecord := range byid {
+		filerecords = append(filerecords, filerecord)
+	}
+	readable := r.readableAs(middleware.CurrentUser(c), middleware.IsAdmin(c), filerecords)
+	data := make([]*Files, len(ids))
+	errs := map[string]string{}
+	for i, id := range ids {
+		filerecord, ok := byid[id]
+		if !ok || !readable[id] {
+			errs[strconv.FormatUint(id, 10)] = "not found"
+			continue
+		}
+		data[i] = &filerecord
+	}
+	response := gin.H{
+		"data": data,
+	}
+	if len(errs) > 0 {
+		response["errors"] = errs
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// mergePatch applies an RFC 7386 JSON merge patch: null removes a key,
+// objects are merged recursively and any other value replaces the old one.
+func mergePatch(target, patch map[string]any) map[string]any {
+	if target == nil {
+		target = map[string]any{}
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+		if patchobject, ok := value.(map[string]any); ok {
+			targetobject, _ := target[key].(map[string]any)
+			target[key] = mergePatch(targetobject, patchobject)
+			continue
+		}
+		target[key] = value
+	}
+	return target
+}
+
+// metadataHandler updates the custom metadata of a file. The default mode
+// merges the body into the stored object (merge patch semantics); with
+// ?mode=replace the body replaces it.
+func (r *Repository) metadataHandler(c *gin.Context) {
+	filerecord, ok := r.ownedFile(c)
+	if !ok {
+		return
+	}
+	mode := c.DefaultQuery("mode", "merge")
+	if mode != "merge" && mode != "replace" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "mode must be merge or replace",
+		})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, int64(r.Config.MetadataMaxBytes)+1))
+	if err != nil || len(body) > r.Config.MetadataMaxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"message": fmt.Sprintf("metadata must not exceed %d bytes", r.Config.MetadataMaxBytes),
+		})
+		return
+	}
+	var patch map[string]any
+	if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "metadata must be a JSON object",
+		})
+		return
+	}
+
+	metadata := JSONMap(patch)
+	if mode == "merge" {
+		metadata = JSONMap(mergePatch(filerecord.Metadata, patch))
+	}
+	encoded, _ := json.Marshal(metadata)
+	if len(encoded) > r.Config.MetadataMaxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"message": fmt.Sprintf("metadata must not exceed %d bytes", r.Config.MetadataMaxBytes),
+		})
+		return
+	}
+	if err := r.DB.Model(&filerecord).Update("metadata", metadata).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't update metadata",
+		})
+		return
+	}
+	filerecord.Metadata = metadata
+	c.JSON(http.StatusOK, gin.H{
+		"data": filerecord,
+	})
+}
+
+type messageRequest struct {
+	Recipients []string `json:"recipients" binding:"required,min=1"`
+	FileIDs    []uint64 `json:"file_ids" binding:"required,min=1"`
+}
+
+// messageCreateHandler registers a chat message with its attachments. The
+// recipients get read access to the attached files owned by the sender.
+func (r *Repository) messageCreateHandler(c *gin.Context) {
+	sender := middleware.CurrentUser(c)
+	if sender == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "unauthorized",
+		})
+		return
+	}
+	var req messageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "recipients and file_ids are required",
+		})
+		return
+	}
+	var filerecords []Files
+	if err := r.DB.Where("id IN ?", req.FileIDs).Find(&filerecords).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load files",
+		})
+		return
+	}
+	readable := map[uint64]Files{}
+	for _, filerecord := range filerecords {
+		if r.canRead(c, filerecord) {
+			readable[filerecord.ID] = filerecord
+		}
+	}
+	for _, id := range req.FileIDs {
+		if _, ok := readable[id]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": fmt.Sprintf("file %d not found", id),
+			})
+			return
+		}
+	}
+
+	message := Message{Sender: sender}
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		for _, recipient := range req.Recipients {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+				Create(&MessageRecipient{MessageID: message.ID, UserID: recipient}).Error; err != nil {
+				return err
+			}
+		}
+		for id, filerecord := range readable {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+				Create(&MessageAttachment{MessageID: message.ID, FileID: id}).Error; err != nil {
+				return err
+			}
+			if filerecord.Owner != sender {
+				continue
+			}
+			for _, recipient := range req.Recipients {
+				share := FileShare{FileID: id, UserID: recipient, Permission: PermissionRead}
+				err := tx.Clauses(clause.OnConflict{
+					Columns:   []clause.Column{{Name: "file_id"}, {Name: "user_id"}},
+					DoUpdates: clause.AssignmentColumns([]string{"permission"}),
+				}).Create(&share).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to create message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't create the message",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": message,
+	})
+}
+
+type attachment struct {
+	Files
+	DownloadURL string `json:"download_url"`
+}
+
+// messageFilesHandler lists the attachments of a message for its sender and
+// recipients. Everybody else gets a 404, as if the message didn't exist.
+// Attachments the caller can't read themselves, such as files shared with
+// the sender only, and files that can't be downloaded are left out.
+func (r *Repository) messageFilesHandler(c *gin.Context) {
+	id, ok := pathID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid id",
+		})
+		return
+	}
+	user := middleware.CurrentUser(c)
+	message := Message{}
+	err := r.DB.Where("id = ?", id).First(&message).Error
+	if err == nil && message.Sender != user && !middleware.IsAdmin(c) {
+		var recipients int64
+		err = r.DB.Model(&MessageRecipient{}).
+			Where("message_id = ? AND user_id = ?", message.ID, user).Count(&recipients).Error
+		if err == nil && (user == "" || recipients == 0) {
+			err = gorm.ErrRecordNotFound
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "can't found",
+		})
+		return
+	}
+
+	var filerecords []Files
+	err = r.DB.Joins("JOIN message_attachments ON message_attachments.file_id = files.id").
+		Where("message_attachments.message_id = ?", message.ID).
+		Order("files.id").Find(&filerecords).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load attachments",
+		})
+		return
+	}
+	readable := r.readableAs(user, middleware.IsAdmin(c), filerecords)
+	attachments := make([]attachment, 0, len(filerecords))
+	for _, filerecord := range filerecords {
+		expired := filerecord.ExpiresAt != nil && time.Now().After(*filerecord.ExpiresAt)
+		if !readable[filerecord.ID] || filerecord.Status != StatusReady || expired {
+			continue
+		}
+		attachments = append(attachments, attachment{
+			Files:       filerecord,
+			DownloadURL: r.publicURL(c, "/files/download/"+strconv.FormatUint(filerecord.ID, 10)),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": attachments,
+	})
+}
+
+// scanFile runs the external scanner on a quarantined file in the
+// background and moves it to ready or infected depending on the result.
+// Scanner errors leave the file quarantined for manual review.
+func (r *Repository) scanFile(filerecord Files) {
+	src, done, err := contentPath(filerecord)
+	if err != nil {
+		log.Printf("Failed to scan file %d: %v", filerecord.ID, err)
+		return
+	}
+	defer done()
+	infected, err := scanner.Scan(r.Config.ScanCommand, src, r.Config.ScanTimeout)
+	if err != nil {
+		log.Printf("Failed to scan file %d: %v", filerecord.ID, err)
+		return
+	}
+	status := StatusReady
+	if infected {
+		status = StatusInfected
+		log.Printf("File %d is infected", filerecord.ID)
+	}
+	err = r.DB.Model(&Files{ID: filerecord.ID}).
+		Where("status = ?", StatusQuarantined).
+		Update("status", status).Error
+	if err != nil {
+		log.Printf("Failed to update status of file %d: %v", filerecord.ID, err)
+	}
+}
+
+func (r *Repository) quarantineListHandler(c *gin.Context) {
+	var filerecords []Files
+	err := r.DB.Where("status IN ?", []string{StatusQuarantined, StatusInfected}).
+		Order("id").Find(&filerecords).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load quarantined files",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": filerecords,
+	})
+}
+
+// sensitiveListHandler lists files flagged by the sensitive content scan,
+// newest first.
+func (r *Repository) sensitiveListHandler(c *gin.Context) {
+	var filerecords []Files
+	if err := r.DB.Where("sensitive").Order("id DESC").Find(&filerecords).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load flagged files",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": filerecords,
+	})
+}
+
+func (r *Repository) quarantineReleaseHandler(c *gin.Context) {
+	id, ok := pathID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid id",
+		})
+		return
+	}
+	result := r.DB.Model(&Files{ID: id}).
+		Where("status IN ?", []string{StatusQuarantined, StatusInfected}).
+		Update("status", StatusReady)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't release the file",
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "no quarantined file with this id",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "file released",
+	})
+}
+
+// confirmed guards a destructive operation. Called without
+// ?confirm_token it answers with a new token for the operation and the
+// summary of what would be affected, and the caller stops there; the
+// operation runs once the same call is repeated with the token within
+// CONFIRM_GRACE_PERIOD. Unknown, expired and used tokens get a 409.
+func (r *Repository) confirmed(c *gin.Context, operation string, summary gin.H) bool {
+	if r.Confirmations == nil {
+		return true
+	}
+	token := c.Query("confirm_token")
+	if token == "" {
+		token, expiresAt, err := r.Confirmations.Issue(operation)
+		if err != nil {
+			log.Printf("Failed to issue a confirmation token: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "couldn't issue a confirmation token",
+			})
+			return false
+		}
+		summary["dry_run"] = true
+		summary["confirm_token"] = token
+		summary["expires_at"] = expiresAt
+		c.JSON(http.StatusOK, summary)
+		return false
+	}
+	if !r.Confirmations.Redeem(token, operation) {
+		apierror.Set(c, apierror.ConfirmationInvalid)
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "confirmation token is invalid or expired, repeat the call without it for a new one",
+		})
+		return false
+	}
+	return true
+}
+
+// limitConfirmed applies the rate limit to the calls that run a confirmed
+// operation, the dry run asking for the token doesn't use up the budget.
+func (r *Repository) limitConfirmed(limit gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if r.Confirmations != nil && c.Query("confirm_token") == "" {
+			c.Next()
+			return
+		}
+		limit(c)
+	}
+}
+
+func (r *Repository) quarantinePurgeHandler(c *gin.Context) {
+	id, ok := pathID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid id",
+		})
+		return
+	}
+	filerecord := Files{}
+	err := r.DB.Where("id = ? AND status IN ?", id, []string{StatusQuarantined, StatusInfected}).
+		First(&filerecord).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "no quarantined file with this id",
+		})
+		return
+	}
+	summary := gin.H{"id": filerecord.ID, "name": filerecord.Name, "size": filerecord.Size}
+	if !r.confirmed(c, fmt.Sprintf("quarantine-purge:%d", filerecord.ID), summary) {
+		return
+	}
+	if err := r.DB.Delete(&filerecord).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't delete record from DB",
+		})
+		return
+	}
+	r.removeStoredFiles(filerecord)
+	r.Events.Publish(events.TypeDelete, filerecord.ID, "purged")
+	c.JSON(http.StatusOK, gin.H{
+		"message": "file purged",
+	})
+}
+
+// deleteRelations removes the rows referring to deleted files.
+func deleteRelations(tx *gorm.DB, ids ...uint64) error {
+	for _, model := range []any{&FileTag{}, &FileShare{}, &HookRun{}, &FailedJob{}, &FileAccess{}, &MessageAttachment{},
+		&IntegrityMismatch{}} {
+		if err := tx.Where("file_id IN ?", ids).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteFile removes a file record with everything referring to it, then
+// its stored files.
+func (r *Repository) deleteFile(filerecord Files) error {
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&Files{}, filerecord.ID).Error; err != nil {
+			return err
+		}
+		return deleteRelations(tx, filerecord.ID)
+	})
+	if err != nil {
+		return err
+	}
+	r.removeStoredFiles(filerecord)
+	r.Events.Publish(events.TypeDelete, filerecord.ID, "deleted")
+	return nil
+}
+
+// deleteHandler removes a file and everything attached to it. With If-Match
+// the file is only deleted while its content still has the given ETag, the
+// one downloads are served with, so a client can't remove content it
+// hasn't seen; otherwise it answers 412.
+func (r *Repository) deleteHandler(c *gin.Context) {
+	filerecord, ok := r.ownedFile(c)
+	if !ok {
+		return
+	}
+	precondition := c.GetHeader("If-Match")
+	if precondition != "" && !httpheader.Match(precondition, `"`+filerecord.Sha256+`"`) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{
+			"message": "file has changed",
+		})
+		return
+	}
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		query := tx.Where("id = ?", filerecord.ID)
+		if precondition != "" && strings.TrimSpace(precondition) != "*" {
+			// The check above ran on a possibly cached record, the hash is
+			// compared again by the delete itself.
+			query = query.Where("sha256 = ?", filerecord.Sha256)
+		}
+		result := query.Delete(&Files{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return deleteRelations(tx, filerecord.ID)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if precondition == "" {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "can't found",
+			})
+			return
+		}
+		c.JSON(http.StatusPreconditionFailed, gin.H{
+			"message": "file has changed",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete file %d: %v", filerecord.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't delete record from DB",
+		})
+		return
+	}
+	r.removeStoredFiles(filerecord)
+	r.Events.Publish(events.TypeDelete, filerecord.ID, "deleted")
+	c.JSON(http.StatusOK, gin.H{
+		"message": "file deleted",
+	})
+}
+
+// openSession reports whether the upload session exists, belongs to user
+// and still accepts uploads.
+func (r *Repository) openSession(id, user string) bool {
+	var session UploadSession
+	err := r.DB.Where("id = ? AND owner = ? AND expires_at > ?", id, user, time.Now()).First(&session).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Failed to load upload session %s: %v", id, err)
+	}
+	return err == nil
+}
+
+// mySession loads the upload session named in the path. Sessions of other
+// users are answered with 404 unless the caller is an admin.
+func (r *Repository) mySession(c *gin.Context) (UploadSession, bool) {
+	var session UploadSession
+	query := r.DB.Where("id = ?", c.Param("id"))
+	if !middleware.IsAdmin(c) {
+		query = query.Where("owner = ?", middleware.CurrentUser(c))
+	}
+	err := query.First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "upload session not found",
+		})
+		return session, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load the upload session",
+		})
+		return session, false
+	}
+	return session, true
+}
+
+func (r *Repository) sessionFilesHandler(c *gin.Context) {
+	session, ok := r.mySession(c)
+	if !ok {
+		return
+	}
+	var filerecords []Files
+	if err := r.DB.Where("session_id = ?", session.ID).Order("id").Find(&filerecords).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load the session files",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"session": session,
+		"data":    filerecords,
+	})
+}
+
+// sessionDeleteHandler removes a session together with all of its files.
+// The records go in one transaction; the stored files are removed once it
+// has committed.
+func (r *Repository) sessionDeleteHandler(c *gin.Context) {
+	session, ok := r.mySession(c)
+	if !ok {
+		return
+	}
+	var summary struct {
+		Files int64
+		Bytes int64
+	}
+	if err := r.DB.Model(&Files{}).Where("session_id = ?", session.ID).
+		Select("COUNT(*) AS files, COALESCE(SUM(size), 0) AS bytes").Scan(&summary).Error; err != nil {
+		log.Printf("Failed to count the files of upload session %s: %v", session.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load the upload session",
+		})
+		return
+	}
+	if !r.confirmed(c, "session-delete:"+session.ID, gin.H{"files": summary.Files, "bytes": summary.Bytes}) {
+		return
+	}
+	var filerecords []Files
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("session_id = ?", session.ID).Find(&filerecords).Error; err != nil {
+			return err
+		}
+		ids := make([]uint64, len(filerecords))
+		for i, filerecord := range filerecords {
+			ids[i] = filerecord.ID
+		}
+		if len(ids) > 0 {
+			if err := tx.Where("id IN ?", ids).Delete(&Files{}).Error; err != nil {
+				return err
+			}
+			if err := deleteRelations(tx, ids...); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&session).Error
+	})
+	if err != nil {
+		log.Printf("Failed to delete upload session %s: %v", session.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't delete the upload session",
+		})
+		return
+	}
+	r.Files.Purge()
+	for _, filerecord := range filerecords {
+		r.removeStoredFiles(filerecord)
+		r.Events.Publish(events.TypeDelete, filerecord.ID, "deleted")
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "upload session deleted",
+		"deleted": len(filerecords),
+	})
+}
+
+const sessionExpiryInterval = 10 * time.Minute
+
+// expireSessions drops expired upload sessions none of whose files were
+// attached to a message. The files themselves are kept, they only stop
+// being grouped.
+func expireSessions(db *gorm.DB) {
+	var ids []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&UploadSession{}).
+			Where("expires_at < ?", time.Now()).
+			Where(`NOT EXISTS (SELECT 1 FROM files
+				JOIN message_attachments ON message_attachments.file_id = files.id
+				WHERE files.session_id = upload_sessions.id)`).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		if err := tx.Model(&Files{}).Where("session_id IN ?", ids).Update("session_id", "").Error; err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&UploadSession{}).Error
+	})
+	if err != nil {
+		log.Printf("Failed to expire upload sessions: %v", err)
+		return
+	}
+	if len(ids) > 0 {
+		log.Printf("Expired %d upload sessions", len(ids))
+	}
+}
+
+// fileFilter holds the listing filters taken from the query string together
+// with the caller they are evaluated for. Scope narrows the listing to the
+// caller's own files ("mine") or files shared with them ("shared"); by
+// default every file the caller can read is listed.
+type fileFilter struct {
+	Mimetype string
+	Tag      string
+	Query    string
+	Scope    string
+	User     string
+	Admin    bool
+}
+
+func parseFileFilter(c *gin.Context) fileFilter {
+	return fileFilter{
+		Mimetype: c.Query("mimetype"),
+		Tag:      c.Query("tag"),
+		Query:    c.Query("q"),
+		Scope:    c.Query("scope"),
+		User:     middleware.CurrentUser(c),
+		Admin:    middleware.IsAdmin(c),
+	}
+}
+
+const sharedWithUserQuery = "SELECT file_id FROM file_shares WHERE user_id = ? AND permission = ?"
+
+func (f fileFilter) apply(db *gorm.DB) *gorm.DB {
+	switch f.Scope {
+	case "mine":
+		db = db.Where("owner = ? AND owner <> ''", f.User)
+	case "shared":
+		db = db.Where("id IN ("+sharedWithUserQuery+")", f.User, PermissionRead)
+	default:
+		if !f.Admin {
+			db = db.Where("owner = '' OR owner = ? OR id IN ("+sharedWithUserQuery+")", f.User, f.User, PermissionRead)
+		}
+	}
+	if f.Mimetype != "" {
+		db = db.Where("mimetype IN ?", mimetypes.Variants(f.Mimetype))
+	}
+	if f.Tag != "" {
+		db = db.Where("id IN (SELECT file_id FROM file_tags WHERE tag = ?)", f.Tag)
+	}
+	if f.Query != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(f.Query) + "%"
+		db = db.Where("name ILIKE ?", pattern)
+	}
+	return db
+}
+
+type tagByQueryRequest struct {
+	Tag           string     `json:"tag"`
+	Name          string     `json:"name"`
+	Mimetype      string     `json:"mimetype"`
+	CreatedAfter  *time.Time `json:"created_after"`
+	CreatedBefore *time.Time `json:"created_before"`
+}
+
+// tagByQueryHandler adds a tag to every file matching a filter: a name
+// substring as for ?q=, a mimetype and a creation date range. With
+// ?dry_run=true it only counts the files; otherwise ?confirm=true is
+// required and all matching files are tagged in one statement.
+func (r *Repository) tagByQueryHandler(c *gin.Context) {
+	var req tagByQueryRequest
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid request body: " + err.Error(),
+		})
+		return
+	}
+	req.Tag = strings.TrimSpace(req.Tag)
+	if req.Tag == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "tag is required",
+		})
+		return
+	}
+	if req.Name == "" && req.Mimetype == "" && req.CreatedAfter == nil && req.CreatedBefore == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "at least one of name, mimetype, created_after and created_before is required",
+		})
+		return
+	}
+	dryrun := c.Query("dry_run") == "true"
+	if !dryrun && c.Query("confirm") != "true" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "confirm=true is required to tag the matching files",
+		})
+		return
+	}
+
+	filter := fileFilter{Query: req.Name, Mimetype: req.Mimetype, Admin: true}
+	matching := func(tx *gorm.DB) *gorm.DB {
+		query := filter.apply(tx.Model(&Files{}))
+		if req.CreatedAfter != nil {
+			query = query.Where("created_at >= ?", *req.CreatedAfter)
+		}
+		if req.CreatedBefore != nil {
+			query = query.Where("created_at < ?", *req.CreatedBefore)
+		}
+		return query
+	}
+	var matched, tagged int64
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := matching(tx).Count(&matched).Error; err != nil {
+			return err
+		}
+		if dryrun {
+			return matching(tx).
+				Where("id NOT IN (SELECT file_id FROM file_tags WHERE tag = ?)", req.Tag).
+				Count(&tagged).Error
+		}
+		result := tx.Exec("INSERT INTO file_tags (file_id, tag) ? ON CONFLICT DO NOTHING",
+			matching(tx).Select("id, ?", req.Tag))
+		tagged = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		log.Printf("Failed to tag files by query: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't tag the files",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run": dryrun,
+		"matched": matched,
+		"tagged":  tagged,
+	})
+}
+
+// pageLinks builds the RFC 5988 Link header for a page of results. The
+// links keep every other query parameter so filters survive paging.
+func pageLinks(requestURL *url.URL, limit, offset int, total int64) string {
+	link := func(rel string, offset int) string {
+		query := requestURL.Query()
+		query.Set("limit", strconv.Itoa(limit))
+		query.Set("offset", strconv.Itoa(offset))
+		u := url.URL{Path: requestURL.Path, RawQuery: query.Encode()}
+		return fmt.Sprintf("<%s>; rel=\"%s\"", u.String(), rel)
+	}
+	last := 0
+	if total > 0 {
+		last = int((total - 1) / int64(limit) * int64(limit))
+	}
+	links := []string{link("first", 0)}
+	if offset > 0 {
+		links = append(links, link("prev", max(offset-limit, 0)))
+	}
+	if int64(offset+limit) < total {
+		links = append(links, link("next", offset+limit))
+	}
+	links = append(links, link("last", last))
+	return strings.Join(links, ", ")
+}
+
+func (r *Repository) listHandler(c *gin.Context) {
+	limit, offset, ok := paginationParams(c)
+	if !ok {
+		return
+	}
+	filter := parseFileFilter(c)
+	format := negotiateFormat(c)
+
+	// The count and the page are read from the same snapshot so that
+	// total and has_more agree with the returned rows. The ETag is derived
+	// from the row count and the latest change of the filtered set, scoped
+	// to the caller and the exact query, and lets unchanged polls end in a
+	// 304 without loading the page.
+	var total int64
+	var etag string
+	notmodified := false
+	filerecords := []Files{}
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		var state struct {
+			Count      int64
+			LastChange *time.Time
+		}
+		err := filter.apply(tx.Model(&Files{})).
+			Select("COUNT(*) AS count, MAX(COALESCE(updated_at, created_at)) AS last_change").
+			Scan(&state).Error
+		if err != nil {
+			return err
+		}
+		total = state.Count
+		etag = listingETag(c, filter, format, state.Count, state.LastChange)
+		if httpheader.NoneMatch(c.GetHeader("If-None-Match"), etag) {
+			notmodified = true
+			return nil
+		}
+		return filter.apply(tx).Order("id").Limit(limit).Offset(offset).Find(&filerecords).Error
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err == nil {
+		c.Header("ETag", etag)
+	}
+	if notmodified {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to list files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't list files",
+		})
+		return
+	}
+
+	c.Header("Link", pageLinks(c.Request.URL, limit, offset, total))
+	hasmore := int64(offset+len(filerecords)) < total
+	if format == filespb.ContentType {
+		c.Data(http.StatusOK, filespb.ContentType, filespb.MarshalFileList(filerecords, total, limit, offset, hasmore))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":     filerecords,
+		"total":    total,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": hasmore,
+	})
+}
+
+func listingETag(c *gin.Context, filter fileFilter, format string, count int64, lastChange *time.Time) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%t\x00%s\x00%s\x00%d\x00", filter.User, filter.Admin, c.Request.URL.Query().Encode(), format, count)
+	if lastChange != nil {
+		fmt.Fprint(h, lastChange.UnixNano())
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+const mimetypeCacheTTL = 30 * time.Second
+
+type mimetypeCount struct {
+	Mimetype string `json:"mimetype"`
+	Count    int64  `json:"count"`
+}
+
+type cachedMimetypes struct {
+	counts  []mimetypeCount
+	expires time.Time
+}
+
+// mimetypeCache keeps the mimetype counts per caller for a short while;
+// they only change with uploads and deletes and back a filter dropdown.
+type mimetypeCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedMimetypes
+}
+
+func (m *mimetypeCache) get(key string) ([]mimetypeCount, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.counts, true
+}
+
+func (m *mimetypeCache) put(key string, counts []mimetypeCount) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, entry := range m.entries {
+		if now.After(entry.expires) {
+			delete(m.entries, k)
+		}
+	}
+	m.entries[key] = cachedMimetypes{counts: counts, expires: now.Add(mimetypeCacheTTL)}
+}
+
+// normalizeMimetypesHandler rewrites stored mimetypes that are aliases to
+// their canonical form. With ?dry_run=true it only reports the changes.
+func (r *Repository) normalizeMimetypesHandler(c *gin.Context) {
+	var stored []string
+	if err := r.DB.Model(&Files{}).Distinct("mimetype").Pluck("mimetype", &stored).Error; err != nil {
+		log.Printf("Failed to load mimetypes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load mimetypes",
+		})
+		return
+	}
+	dryrun := c.Query("dry_run") == "true"
+	changes := map[string]string{}
+	var updated int64
+	for _, mimetype := range stored {
+		normalized := mimetypes.Normalize(mimetype)
+		if normalized == mimetype {
+			continue
+		}
+		changes[mimetype] = normalized
+		query := r.DB.Model(&Files{}).Where("mimetype = ?", mimetype)
+		if dryrun {
+			var count int64
+			if err := query.Count(&count).Error; err != nil {
+				log.Printf("Failed to count files of mimetype %s: %v", mimetype, err)
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"message": "couldn't count files",
+				})
+				return
+			}
+			updated += count
+			continue
+		}
+		result := query.Update("mimetype", normalized)
+		if result.Error != nil {
+			log.Printf("Failed to normalize mimetype %s: %v", mimetype, result.Error)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "couldn't update mimetypes",
+				"updated": updated,
+			})
+			return
+		}
+		updated += result.RowsAffected
+	}
+	if !dryrun && updated > 0 {
+		log.Printf("Normalized the mimetype of %d files", updated)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": gin.H{
+			"updated": updated,
+			"changes": changes,
+			"dry_run": dryrun,
+		},
+	})
+}
+
+// mimetypesHandler lists the mimetypes of the files the caller can access
+// with the number of files of each, most common first.
+func (r *Repository) mimetypesHandler(c *gin.Context) {
+	filter := fileFilter{User: middleware.CurrentUser(c), Admin: middleware.IsAdmin(c)}
+	key := fmt.Sprintf("%t\x00%s", filter.Admin, filter.User)
+	if counts, ok := r.Mimetypes.get(key); ok {
+		c.JSON(http.StatusOK, gin.H{
+			"data": counts,
+		})
+		return
+	}
+	counts := []mimetypeCount{}
+	err := filter.apply(r.DB.Model(&Files{})).
+		Select("mimetype, COUNT(*) AS count").
+		Group("mimetype").
+		Order("count DESC, mimetype").
+		Scan(&counts).Error
+	if err != nil {
+		log.Printf("Failed to count mimetypes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't count mimetypes",
+		})
+		return
+	}
+	r.Mimetypes.put(key, counts)
+	c.JSON(http.StatusOK, gin.H{
+		"data": counts,
+	})
+}
+
+// recordAccess counts the download and remembers that the caller
+// downloaded the file, for the recent files feed. Anonymous downloads are
+// only counted.
+func (r *Repository) recordAccess(c *gin.Context, fileID uint64) {
+	if !r.Health.Healthy() {
+		return
+	}
+	// The ID on the model lets the file cache drop just this entry.
+	err := r.DB.Model(&Files{ID: fileID}).
+		UpdateColumn("download_count", gorm.Expr("download_count + 1")).Error
+	if err != nil {
+		log.Printf("Failed to count download of file %d: %v", fileID, err)
+	}
+	user := middleware.CurrentUser(c)
+	if user == "" {
+		return
+	}
+	access := FileAccess{UserID: user, FileID: fileID, LastAccessedAt: time.Now()}
+	err = r.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "file_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_accessed_at"}),
+	}).Create(&access).Error
+	if err != nil {
+		log.Printf("Failed to record access of file %d by %s: %v", fileID, user, err)
+	}
+}
+
+type recentFile struct {
+	Files
+	LastAccessedAt time.Time `json:"last_accessed_at"`
+}
+
+// recentHandler lists the files the caller downloaded, most recent first.
+// Files the caller can't read anymore are left out.
+func (r *Repository) recentHandler(c *gin.Context) {
+	user := middleware.CurrentUser(c)
+	if user == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "unauthorized",
+		})
+		return
+	}
+	limit, offset, ok := paginationParams(c)
+	if !ok {
+		return
+	}
+	filter := fileFilter{User: user, Admin: middleware.IsAdmin(c)}
+	query := func() *gorm.DB {
+		return filter.apply(r.DB.Model(&Files{}).
+			Joins("JOIN file_accesses ON file_accesses.file_id = files.id AND file_accesses.user_id = ?", user))
+	}
+	var total int64
+	if err := query().Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't list recent files",
+		})
+		return
+	}
+	recent := []recentFile{}
+	err := query().Select("files.*, file_accesses.last_accessed_at").
+		Order("file_accesses.last_accessed_at DESC, files.id").
+		Limit(limit).Offset(offset).Scan(&recent).Error
+	if err != nil {
+		log.Printf("Failed to list recent files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't list recent files",
+		})
+		return
+	}
+	c.Header("Link", pageLinks(c.Request.URL, limit, offset, total))
+	c.JSON(http.StatusOK, gin.H{
+		"data":     recent,
+		"total":    total,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": int64(offset+len(recent)) < total,
+	})
+}
+
+// paginationParams reads limit and offset from the query string.
+func paginationParams(c *gin.Context) (limit, offset int, ok bool) {
+	limit, offset = defaultPageLimit, 0
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("limit must be between 1 and %d", maxPageLimit),
+			})
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if value := c.Query("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "offset must be a non-negative integer",
+			})
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
+
+// duplicateGroupsQuery groups records by content hash. Copies is the number
+// of distinct blobs on disk for the hash, so groups that were already
+// deduplicated report no wasted bytes.
+const duplicateGroupsQuery = `
+SELECT sha256,
+       COUNT(*) AS count,
+       COUNT(DISTINCT storage_path) AS copies,
+       (COUNT(DISTINCT storage_path) - 1) * MAX(size) AS wasted_bytes,
+       string_agg(id::text, ',' ORDER BY id) AS member_ids
+FROM files
+WHERE sha256 <> ''
+GROUP BY sha256
+HAVING COUNT(*) > 1`
+
+type duplicateGroup struct {
+	Sha256      string   `json:"sha256"`
+	Count       int64    `json:"count"`
+	Copies      int64    `json:"copies"`
+	WastedBytes uint64   `json:"wasted_bytes"`
+	MemberIDs   string   `json:"-"`
+	IDs         []uint64 `gorm:"-" json:"ids"`
+}
+
+func (r *Repository) duplicatesHandler(c *gin.Context) {
+	limit, offset, ok := paginationParams(c)
+	if !ok {
+		return
+	}
+	var total int64
+	if err := r.DB.Raw("SELECT COUNT(*) FROM (" + duplicateGroupsQuery + ") AS groups").Scan(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't count duplicate groups",
+		})
+		return
+	}
+	var groups []duplicateGroup
+	err := r.DB.Raw(duplicateGroupsQuery+" ORDER BY wasted_bytes DESC, sha256 LIMIT ? OFFSET ?", limit, offset).
+		Scan(&groups).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load duplicate groups",
+		})
+		return
+	}
+	for i := range groups {
+		for _, id := range strings.Split(groups[i].MemberIDs, ",") {
+			n, err := strconv.ParseUint(id, 10, 64)
+			if err == nil {
+				groups[i].IDs = append(groups[i].IDs, n)
+			}
+		}
+	}
+	c.Header("Link", pageLinks(c.Request.URL, limit, offset, total))
+	c.JSON(http.StatusOK, gin.H{
+		"data":     groups,
+		"total":    total,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": int64(offset+len(groups)) < total,
+	})
+}
+
+// dedupeHandler points every record of a duplicate group at a single blob
+// and removes the blobs that are no longer referenced. The first call only
+// reports the groups and the bytes that would be freed, see confirmed.
+func (r *Repository) dedupeHandler(c *gin.Context) {
+	var groups []duplicateGroup
+	if err := r.DB.Raw(duplicateGroupsQuery + " AND COUNT(DISTINCT storage_path) > 1").Scan(&groups).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load duplicate groups",
+		})
+		return
+	}
+	var wasted uint64
+	for _, group := range groups {
+		wasted += group.WastedBytes
+	}
+	if !r.confirmed(c, "dedupe", gin.H{"groups": len(groups), "bytes_freed": wasted}) {
+		return
+	}
+
+	var freed uint64
+	collapsed := 0
+	for _, group := range groups {
+		var members []Files
+		if err := r.DB.Where("sha256 = ?", group.Sha256).Order("id").Find(&members).Error; err != nil {
+			log.Printf("Failed to load duplicate group %s: %v", group.Sha256, err)
+			continue
+		}
+		// The blob is checked and the group repointed under its lock, a
+		// delete releasing it meanwhile would otherwise find no other
+		// reference and remove it.
+		canonical := ""
+		var err error
+		for _, member := range members {
+			found := false
+			err = withBlobLock(r.DB, member.StoragePath, func(tx *gorm.DB) error {
+				if _, err := os.Stat(member.StoragePath); err != nil {
+					return nil
+				}
+				found = true
+				return tx.Model(&Files{}).
+					Where("sha256 = ? AND storage_path <> ?", group.Sha256, member.StoragePath).
+					Updates(map[string]any{"storage_path": member.StoragePath, "compressed": member.Compressed}).Error
+			})
+			if found || err != nil {
+				canonical = member.StoragePath
+				break
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to collapse duplicate group %s: %v", group.Sha256, err)
+			continue
+		}
+		if canonical == "" {
+			log.Printf("No stored blob left for duplicate group %s", group.Sha256)
+			continue
+		}
+
+		stale := map[string]bool{}
+		for _, member := range members {
+			if member.StoragePath != canonical {
+				stale[member.StoragePath] = true
+			}
+		}
+		for path := range stale {
+			info, err := os.Stat(path)
+			if r.releaseBlob(path, 0) && err == nil {
+				freed += uint64(info.Size())
+			}
+		}
+		collapsed++
+	}
+	log.Printf("Deduplicated %d groups, freed %d bytes", collapsed, freed)
+	c.JSON(http.StatusOK, gin.H{
+		"groups":      collapsed,
+		"bytes_freed": freed,
+	})
+}
+
+// backfillJob tracks the background hash backfill. Rows are processed in
+// ID order and a row is done once its hash is set, so an interrupted run
+// simply continues where it stopped when started again.
+type backfillJob struct {
+	mu         sync.Mutex
+	Running    bool
+	Processed  int
+	Updated    int
+	Missing    []uint64
+	LastID     uint64
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+	Error      string
+}
+
+func (j *backfillJob) snapshot() gin.H {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return gin.H{
+		"running":     j.Running,
+		"processed":   j.Processed,
+		"updated":     j.Updated,
+		"missing":     j.Missing,
+		"last_id":     j.LastID,
+		"started_at":  j.StartedAt,
+		"finished_at": j.FinishedAt,
+		"error":       j.Error,
+	}
+}
+
+func (r *Repository) backfillStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, r.Backfill.snapshot())
+}
+
+func (r *Repository) backfillHashesHandler(c *gin.Context) {
+	job := r.Backfill
+	job.mu.Lock()
+	if job.Running {
+		job.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "backfill is already running",
+		})
+		return
+	}
+	now := time.Now()
+	job.Running = true
+	job.Processed, job.Updated, job.LastID = 0, 0, 0
+	job.Missing = []uint64{}
+	job.StartedAt, job.FinishedAt, job.Error = &now, nil, ""
+	job.mu.Unlock()
+
+	go r.backfillHashes()
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "backfill started",
+	})
+}
+
+func (r *Repository) backfillHashes() {
+	job := r.Backfill
+	var lastID uint64
+	for {
+		var batch []Files
+		err := r.DB.Where("sha256 = '' AND id > ?", lastID).Order("id").Limit(backfillBatchSize).Find(&batch).Error
+		if err != nil {
+			log.Printf("Hash backfill stopped: %v", err)
+			job.mu.Lock()
+			job.Error = err.Error()
+			break
+		}
+		if len(batch) == 0 {
+			job.mu.Lock()
+			break
+		}
+		updated := 0
+		var missing []uint64
+		for _, filerecord := range batch {
+			sum, err := filehash.SHA256File(filerecord.StoragePath)
+			if err != nil {
+				log.Printf("Skipping hash backfill of file %d: %v", filerecord.ID, err)
+				missing = append(missing, filerecord.ID)
+				continue
+			}
+			err = r.DB.Model(&Files{ID: filerecord.ID}).Update("sha256", sum).Error
+			if err != nil {
+				log.Printf("Failed to store hash of file %d: %v", filerecord.ID, err)
+				continue
+			}
+			updated++
+		}
+		lastID = batch[len(batch)-1].ID
+
+		job.mu.Lock()
+		job.Processed += len(batch)
+		job.Updated += updated
+		job.LastID = lastID
+		for _, id := range missing {
+			if len(job.Missing) < maxReportedMissing {
+				job.Missing = append(job.Missing, id)
+			}
+		}
+		log.Printf("Hash backfill: %d processed, %d updated, last id %d", job.Processed, job.Updated, lastID)
+		job.mu.Unlock()
+	}
+	now := time.Now()
+	job.Running = false
+	job.FinishedAt = &now
+	log.Printf("Hash backfill finished: %d processed, %d updated, %d missing", job.Processed, job.Updated, len(job.Missing))
+	job.mu.Unlock()
+}
+
+// integrityScanner periodically rehashes the content of every stored file
+// and records the files whose hash no longer matches as IntegrityMismatch
+// rows. Reading is paced to rate bytes per second so the scan doesn't
+// starve downloads of disk bandwidth.
+type integrityScanner struct {
+	db        *gorm.DB
+	interval  time.Duration
+	batchSize int
+	rate      int64
+	corrupt   atomic.Int64
+}
+
+func newIntegrityScanner(db *gorm.DB, cfg *config.Config) *integrityScanner {
+	s := &integrityScanner{db: db, interval: cfg.IntegrityInterval, batchSize: max(cfg.IntegrityBatchSize, 1), rate: cfg.IntegrityRate}
+	metrics.NewGaugeFunc("corrupt_files", "Files whose content doesn't match the stored hash.", func() float64 {
+		return float64(s.corrupt.Load())
+	})
+	return s
+}
+
+func (s *integrityScanner) run() {
+	// Files deleted before their rows went with them left mismatches behind.
+	if err := s.db.Where("file_id NOT IN (?)", s.db.Model(&Files{}).Select("id")).
+		Delete(&IntegrityMismatch{}).Error; err != nil {
+		log.Printf("Failed to remove integrity mismatches of deleted files: %v", err)
+	}
+	s.countCorrupt()
+	for {
+		if err := s.pass(); err != nil {
+			log.Printf("Integrity scan stopped: %v", err)
+		}
+		time.Sleep(s.interval)
+	}
+}
+
+// pass scans from the saved position to the end of the table, then starts
+// the next pass from the beginning.
+func (s *integrityScanner) pass() error {
+	state := IntegrityScanState{ID: 1}
+	if err := s.db.FirstOrCreate(&state).Error; err != nil {
+		return err
+	}
+	log.Printf("Integrity scan started after file %d", state.LastID)
+	scanned := 0
+	for {
+		var batch []Files
+		err := s.db.Where("sha256 <> '' AND id > ?", state.LastID).Order("id").Limit(s.batchSize).Find(&batch).Error
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, filerecord := range batch {
+			s.check(filerecord)
+		}
+		scanned += len(batch)
+		state.LastID = batch[len(batch)-1].ID
+		if err := s.db.Save(&state).Error; err != nil {
+			return err
+		}
+		s.countCorrupt()
+	}
+	state.LastID = 0
+	if err := s.db.Save(&state).Error; err != nil {
+		return err
+	}
+	log.Printf("Integrity scan finished: %d files checked, %d corrupt", scanned, s.corrupt.Load())
+	return nil
+}
+
+func (s *integrityScanner) check(filerecord Files) {
+	started := time.Now()
+	sum, size, err := contentHash(filerecord)
+	if s.rate > 0 {
+		time.Sleep(time.Duration(float64(size)/float64(s.rate)*float64(time.Second)) - time.Since(started))
+	}
+	if err == nil && sum == filerecord.Sha256 {
+		s.db.Where("file_id = ?", filerecord.ID).Delete(&IntegrityMismatch{})
+		return
+	}
+	// A file deleted, or moved by dedupe, since the batch was loaded isn't
+	// corrupt; a moved one is checked again on the next pass.
+	current := Files{}
+	if err := s.db.Limit(1).Find(&current, filerecord.ID).Error; err != nil || current.ID == 0 ||
+		current.StoragePath != filerecord.StoragePath || current.Sha256 != filerecord.Sha256 {
+		return
+	}
+	mismatch := IntegrityMismatch{FileID: filerecord.ID, Expected: filerecord.Sha256, Actual: sum, DetectedAt: time.Now()}
+	if err != nil {
+		mismatch.Error = err.Error()
+		log.Printf("!!! INTEGRITY: file %d (%s) can't be read: %v", filerecord.ID, filerecord.StoragePath, err)
+	} else {
+		log.Printf("!!! INTEGRITY: file %d (%s) has hash %s, expected %s", filerecord.ID, filerecord.StoragePath, sum, filerecord.Sha256)
+	}
+	err = s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"expected", "actual", "error"}),
+	}).Create(&mismatch).Error
+	if err != nil {
+		log.Printf("Failed to record integrity mismatch of file %d: %v", filerecord.ID, err)
+	}
+}
+
+func (s *integrityScanner) countCorrupt() {
+	var count int64
+	if err := s.db.Model(&IntegrityMismatch{}).Count(&count).Error; err != nil {
+		log.Printf("Failed to count integrity mismatches: %v", err)
+		return
+	}
+	s.corrupt.Store(count)
+}
+
+// contentHash hashes the original content of a stored file, inflating it
+// when it is stored compressed, and returns the number of bytes read from
+// storage.
+func contentHash(filerecord Files) (string, int64, error) {
+	if !insideStorage(filerecord.StoragePath) {
+		return "", 0, errOutsideStorage
+	}
+	content, _, err := openContent(filerecord)
+	if err != nil {
+		return "", 0, err
+	}
+	defer content.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, content)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func (r *Repository) integrityHandler(c *gin.Context) {
+	var mismatches []IntegrityMismatch
+	if err := r.DB.Order("file_id").Find(&mismatches).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't load the integrity report",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": mismatches,
+	})
+}
+
+// downloadError answers in the format the client asked for: JSON for API
+// clients, an HTML page for browsers and plain text for everything else.
+func downloadError(c *gin.Context, status int, message string) {
+	switch c.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON, gin.MIMEHTML) {
+	case gin.MIMEJSON:
+		c.JSON(status, gin.H{
+			"message": message,
+		})
+	case gin.MIMEHTML:
+		page := fmt.Sprintf("<!DOCTYPE html><html><head><meta charset=\"utf-8\"><title>%d %s</title></head>"+
+			"<body><h1>%d %s</h1><p>%s</p></body></html>",
+			status, http.StatusText(status), status, http.StatusText(status), html.EscapeString(message))
+		c.Data(status, "text/html; charset=utf-8", []byte(page))
+	default:
+		c.String(status, message)
+	}
+}
+
+func (r *Repository) eventsHandler(c *gin.Context) {
+	recent, ch, err := r.Events.Subscribe()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"message": "too many event subscribers",
+		})
+		return
+	}
+	defer r.Events.Unsubscribe(ch)
+
+	for _, event := range recent {
+		c.SSEvent(event.Type, event)
+	}
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-ch:
+			c.SSEvent(event.Type, event)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+type sizeMismatch struct {
+	ID       uint64 `json:"id"`
+	Recorded uint64 `json:"recorded"`
+	Actual   uint64 `json:"actual"`
+}
+
+// contentSize measures the original content of a stored file on disk.
+// Compressed files are inflated to count their bytes.
+func contentSize(filerecord Files) (uint64, error) {
+	if !filerecord.Compressed {
+		info, err := os.Stat(filerecord.StoragePath)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(info.Size()), nil
+	}
+	content, _, err := openContent(filerecord)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+	n, err := io.Copy(io.Discard, content)
+	return uint64(n), err
+}
+
+// auditSizes compares the recorded size of every file with the content on
+// disk in batches of backfillBatchSize, and corrects the column when
+// repair is set.
+func (r *Repository) auditSizes(repair bool) (gin.H, error) {
+	mismatches := []sizeMismatch{}
+	missing := []uint64{}
+	checked, repaired := 0, 0
+	var lastID uint64
+	for {
+		var batch []Files
+		if err := r.DB.Where("id > ?", lastID).Order("id").Limit(backfillBatchSize).Find(&batch).Error; err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, filerecord := range batch {
+			actual, err := contentSize(filerecord)
+			if err != nil {
+				if len(missing) < maxReportedMissing {
+					missing = append(missing, filerecord.ID)
+				}
+				continue
+			}
+			if actual == filerecord.Size {
+				continue
+			}
+			if len(mismatches) < maxReportedMissing {
+				mismatches = append(mismatches, sizeMismatch{ID: filerecord.ID, Recorded: filerecord.Size, Actual: actual})
+			}
+			if !repair {
+				continue
+			}
+			err = r.DB.Model(&Files{ID: filerecord.ID}).Update("size", actual).Error
+			if err != nil {
+				log.Printf("Failed to repair size of file %d: %v", filerecord.ID, err)
+				continue
+			}
+			repaired++
+		}
+		checked += len(batch)
+		lastID = batch[len(batch)-1].ID
+		log.Printf("Size audit: %d checked, %d mismatched, %d repaired, last id %d", checked, len(mismatches), repaired, lastID)
+	}
+	return gin.H{
+		"checked":    checked,
+		"mismatches": mismatches,
+		"missing":    missing,
+		"repaired":   repaired,
+	}, nil
+}
+
+func (r *Repository) sizeAuditHandler(c *gin.Context) {
+	r.respondSizeAudit(c, false)
+}
+
+func (r *Repository) sizeRepairHandler(c *gin.Context) {
+	r.respondSizeAudit(c, true)
+}
+
+func (r *Repository) respondSizeAudit(c *gin.Context, repair bool) {
+	result, err := r.auditSizes(repair)
+	if err != nil {
+		log.Printf("Size audit failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't audit file sizes",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": result,
+	})
+}
+
+// exportHandler streams the catalog as CSV, filtered like the listing. Rows
+// are read from a cursor and written as they arrive, so the export doesn't
+// hold the table in memory.
+func (r *Repository) exportHandler(c *gin.Context) {
+	filter := parseFileFilter(c)
+	filter.Admin = true
+	rows, err := filter.apply(r.DB.WithContext(c.Request.Context()).Model(&Files{})).
+		Select("id, name, mimetype, size, created_at, download_count").
+		Order("id").Rows()
+	if err != nil {
+		log.Printf("Failed to export files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't export files",
+		})
+		return
+	}
+	defer rows.Close()
+
+	filename := "files-" + time.Now().UTC().Format("20060102T150405Z") + ".csv"
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", httpheader.ContentDisposition("attachment", filename))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "name", "mimetype", "size", "created_at", "download_count"})
+	exported := 0
+	for rows.Next() {
+		var id, size uint64
+		var name, mimetype string
+		var created time.Time
+		var downloads int64
+		if err := rows.Scan(&id, &name, &mimetype, &size, &created, &downloads); err != nil {
+			log.Printf("Export stopped after %d files: %v", exported, err)
+			break
+		}
+		w.Write([]string{
+			strconv.FormatUint(id, 10),
+			csvText(name),
+			csvText(mimetype),
+			strconv.FormatUint(size, 10),
+			created.UTC().Format(time.RFC3339),
+			strconv.FormatInt(downloads, 10),
+		})
+		exported++
+		if exported%1000 == 0 {
+			if w.Flush(); w.Error() != nil {
+				// The client went away.
+				return
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Export stopped after %d files: %v", exported, err)
+	}
+	w.Flush()
+}
+
+// snapshotTables are the tables a metadata snapshot holds, the files and
+// the rows that belong to them, each in primary key order. Attachments come
+// with their messages, they would point at nothing otherwise.
+var snapshotTables = []struct {
+	name  string
+	model func() any
+	order string
+}{
+	{"files", func() any { return &Files{} }, "id"},
+	{"file_tags", func() any { return &FileTag{} }, "file_id, tag"},
+	{"file_shares", func() any { return &FileShare{} }, "file_id, user_id"},
+	{"file_variants", func() any { return &FileVariant{} }, "file_id, kind"},
+	{"messages", func() any { return &Message{} }, "id"},
+	{"message_recipients", func() any { return &MessageRecipient{} }, "message_id, user_id"},
+	{"message_attachments", func() any { return &MessageAttachment{} }, "message_id, file_id"},
+}
+
+const snapshotPrefix, snapshotSuffix = "snapshot-", ".jsonl.gz"
+
+// snapshotLayout is the time in snapshot names. Snapshots taken within the
+// same second keep apart by the microseconds; names of older snapshots
+// have whole seconds, see oldSnapshotLayout.
+const snapshotLayout, oldSnapshotLayout = "20060102T150405.000000Z", "20060102T150405Z"
+
+var errSnapshotRunning = errors.New("a snapshot is already being taken")
+
+type snapshotInfo struct {
+	Name      string           `json:"name"`
+	Size      int64            `json:"size"`
+	CreatedAt time.Time        `json:"created_at"`
+	Rows      map[string]int64 `json:"rows,omitempty"`
+}
+
+// snapshotter writes metadata snapshots to SNAPSHOT_DIR and keeps the
+// last SNAPSHOT_KEEP of them.
+type snapshotter struct {
+	db   *gorm.DB
+	dir  string
+	keep int
+	mu   sync.Mutex
+}
+
+func (s *snapshotter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if info, err := s.take(); err != nil {
+			log.Printf("Failed to take a metadata snapshot: %v", err)
+		} else {
+			log.Printf("Took metadata snapshot %s, %d bytes", info.Name, info.Size)
+		}
+	}
+}
+
+// take streams the tables into a gzipped JSON lines file, one
+// {"table", "row"} object per row. All tables are read in one repeatable
+// read transaction, a consistent view Postgres serves without blocking
+// writers. The file only gets its name once it is complete.
+func (s *snapshotter) take() (snapshotInfo, error) {
+	if !s.mu.TryLock() {
+		return snapshotInfo{}, errSnapshotRunning
+	}
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return snapshotInfo{}, err
+	}
+	out, err := os.CreateTemp(s.dir, ".snapshot-*")
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	info := snapshotInfo{CreatedAt: time.Now().UTC().Truncate(time.Microsecond), Rows: map[string]int64{}}
+	gz := gzip.NewWriter(out)
+	encoder := json.NewEncoder(gz)
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for _, table := range snapshotTables {
+			rows, err := tx.Model(table.model()).Order(table.order).Rows()
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				row := table.model()
+				if err := tx.ScanRows(rows, row); err != nil {
+					rows.Close()
+					return err
+				}
+				if err := encoder.Encode(gin.H{"table": table.name, "row": row}); err != nil {
+					rows.Close()
+					return err
+				}
+				info.Rows[table.name]++
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+	// Snapshots are taken one at a time, a name is only taken already when
+	// the clock went back.
+	for {
+		info.Name = snapshotPrefix + info.CreatedAt.Format(snapshotLayout) + snapshotSuffix
+		if _, err := os.Lstat(filepath.Join(s.dir, info.Name)); err != nil {
+			break
+		}
+		info.CreatedAt = info.CreatedAt.Add(time.Microsecond)
+	}
+	if err := os.Rename(out.Name(), filepath.Join(s.dir, info.Name)); err != nil {
+		return snapshotInfo{}, err
+	}
+	if stat, err := os.Stat(filepath.Join(s.dir, info.Name)); err == nil {
+		info.Size = stat.Size()
+	}
+	s.prune()
+	return info, nil
+}
+
+// list returns the snapshots in the directory, newest first.
+func (s *snapshotter) list() ([]snapshotInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []snapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []snapshotInfo{}
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(name, snapshotPrefix)
+		if !ok || !strings.HasSuffix(stamp, snapshotSuffix) || !entry.Type().IsRegular() {
+			continue
+		}
+		stamp = strings.TrimSuffix(stamp, snapshotSuffix)
+		created, err := time.Parse(snapshotLayout, stamp)
+		if err != nil {
+			created, err = time.Parse(oldSnapshotLayout, stamp)
+		}
+		if err != nil {
+			continue
+		}
+		info := snapshotInfo{Name: name, CreatedAt: created}
+		if stat, err := entry.Info(); err == nil {
+			info.Size = stat.Size()
+		}
+		snapshots = append(snapshots, info)
+	}
+	slices.SortFunc(snapshots, func(a, b snapshotInfo) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return snapshots, nil
+}
+
+// prune removes the snapshots beyond the newest keep.
+func (s *snapshotter) prune() {
+	if s.keep <= 0 {
+		return
+	}
+	snapshots, err := s.list()
+	if err != nil {
+		log.Printf("Failed to list metadata snapshots: %v", err)
+		return
+	}
+	for _, old := range snapshots[min(s.keep, len(snapshots)):] {
+		if err := os.Remove(filepath.Join(s.dir, old.Name)); err != nil {
+			log.Printf("Failed to remove metadata snapshot %s: %v", old.Name, err)
+		}
+	}
+}
+
+// snapshotHandler takes a metadata snapshot right away and answers once
+// it is written.
+func (r *Repository) snapshotHandler(c *gin.Context) {
+	info, err := r.Snapshots.take()
+	if errors.Is(err, errSnapshotRunning) {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to take a metadata snapshot: %v", err)
+		if errors.Is(err, fs.ErrPermission) {
+			apierror.Set(c, apierror.PermissionDenied)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't take the snapshot",
+		})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"data": info,
+	})
+}
+
+func (r *Repository) snapshotsHandler(c *gin.Context) {
+	snapshots, err := r.Snapshots.list()
+	if err != nil {
+		log.Printf("Failed to list metadata snapshots: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't list the snapshots",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": snapshots,
+	})
+}
+
+// csvText keeps spreadsheets from evaluating a cell as a formula; user
+// supplied names starting with one of these are prefixed with a quote.
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// usageReconcileInterval is how often the running total of file sizes is
+// replaced by the sum in the DB, catching changes the increments missed
+// such as updates by the integrity scan.
+const usageReconcileInterval = 10 * time.Minute
+
+// storageUsage tracks the total size of all files for MAX_TOTAL_BYTES
+// without a SUM query per upload: uploads reserve their size, removed
+// files release it.
+type storageUsage struct {
+	db    *gorm.DB
+	limit int64
+	mu    sync.Mutex
+	used  int64
+	// changed sums every change of used, so reconcile can tell what
+	// happened while its query ran.
+	changed int64
+}
+
+func newStorageUsage(db *gorm.DB, limit int64) *storageUsage {
+	u := &storageUsage{db: db, limit: limit}
+	metrics.NewGaugeFunc("storage_used_bytes", "Total size of all stored files.", func() float64 {
+		return float64(u.total())
+	})
+	metrics.NewGaugeFunc("storage_limit_bytes", "MAX_TOTAL_BYTES, 0 when unlimited.", func() float64 {
+		return float64(u.limit)
+	})
+	return u
+}
+
+func (u *storageUsage) total() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.used
+}
+
+func (u *storageUsage) add(n int64) {
+	u.mu.Lock()
+	u.used += n
+	u.changed += n
+	u.mu.Unlock()
+}
+
+// fits reports whether n more bytes stay within the limit.
+func (u *storageUsage) fits(n int64) bool {
+	if u.limit <= 0 {
+		return true
+	}
+	return u.total()+n <= u.limit
+}
+
+// reserve counts n bytes unless they would exceed the limit.
+func (u *storageUsage) reserve(n int64) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.limit > 0 && u.used+n > u.limit {
+		return false
+	}
+	u.used += n
+	u.changed += n
+	return true
+}
+
+// reconcile replaces the running total by the sum in the DB. Reservations
+// and releases made while the query ran are added on top: their records
+// were written after the query started or not at all yet.
+func (u *storageUsage) reconcile() error {
+	u.mu.Lock()
+	before := u.changed
+	u.mu.Unlock()
+	var used int64
+	if err := u.db.Model(&Files{}).Select("COALESCE(SUM(size), 0)").Scan(&used).Error; err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.used = used + u.changed - before
+	u.mu.Unlock()
+	return nil
+}
+
+// run reconciles every usageReconcileInterval, the first time is done at
+// startup before any upload is accepted.
+func (u *storageUsage) run() {
+	for {
+		time.Sleep(usageReconcileInterval)
+		if err := u.reconcile(); err != nil {
+			log.Printf("Failed to sum up the storage usage: %v", err)
+		}
+	}
+}
+
+const diagnosticsTTL = 5 * time.Minute
+
+// storeDiagnostics summarises how the DB and the storage directories
+// agree. Orphaned files are on disk without a record or variant pointing
+// at them, dangling records point at a file that is gone; temporary
+// uploads are neither.
+type storeDiagnostics struct {
+	Rows            int64     `json:"rows"`
+	DBBytes         int64     `json:"db_bytes"`
+	DiskFiles       int64     `json:"disk_files"`
+	DiskBytes       int64     `json:"disk_bytes"`
+	OrphanedFiles   int64     `json:"orphaned_files"`
+	OrphanedBytes   int64     `json:"orphaned_bytes"`
+	DanglingRecords int64     `json:"dangling_records"`
+	HashMismatches  int64     `json:"hash_mismatches"`
+	ComputedAt      time.Time `json:"computed_at"`
+}
+
+// diagnosticsCache keeps the last report, walking the storage is too slow
+// to do on every call. The lock is held while a report is assembled, so
+// concurrent callers wait for it instead of walking again.
+type diagnosticsCache struct {
+	mu     sync.Mutex
+	report *storeDiagnostics
+}
+
+func (d *diagnosticsCache) get(db *gorm.DB, refresh bool) (storeDiagnostics, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.report != nil && !refresh && time.Since(d.report.ComputedAt) < diagnosticsTTL {
+		return *d.report, nil
+	}
+	report, err := diagnose(db)
+	if err != nil {
+		return report, err
+	}
+	d.report = &report
+	return report, nil
+}
+
+func diagnose(db *gorm.DB) (storeDiagnostics, error) {
+	report := storeDiagnostics{ComputedAt: time.Now()}
+	var totals struct {
+		Count int64
+		Bytes int64
+	}
+	if err := db.Model(&Files{}).Select("COUNT(*) AS count, COALESCE(SUM(size), 0) AS bytes").Scan(&totals).Error; err != nil {
+		return report, err
+	}
+	report.Rows, report.DBBytes = totals.Count, totals.Bytes
+	if err := db.Model(&IntegrityMismatch{}).Count(&report.HashMismatches).Error; err != nil {
+		return report, err
+	}
+
+	// Blobs can be shared after deduplication, so records are counted per
+	// path.
+	var blobs []struct {
+		StoragePath string
+		Count       int64
+	}
+	err := db.Model(&Files{}).Select("storage_path, COUNT(*) AS count").
+		Where("storage_path <> ''").Group("storage_path").Scan(&blobs).Error
+	if err != nil {
+		return report, err
+	}
+	var variants []FileVariant
+	if err := db.Select("kind", "storage_path").Find(&variants).Error; err != nil {
+		return report, err
+	}
+	referenced := make(map[string]bool, len(blobs)+len(variants))
+	streams := map[string]bool{}
+	for _, blob := range blobs {
+		path := filepath.Clean(blob.StoragePath)
+		referenced[path] = true
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			report.DanglingRecords += blob.Count
+		}
+	}
+	for _, variant := range variants {
+		referenced[filepath.Clean(variant.StoragePath)] = true
+		if variant.Kind == VariantHLS {
+			streams[filepath.Dir(filepath.Clean(variant.StoragePath))] = true
+		}
+	}
+
+	for _, dir := range storageDirs {
+		err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+			if err != nil || !entry.Type().IsRegular() {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			report.DiskFiles++
+			report.DiskBytes += info.Size()
+			path = filepath.Clean(path)
+			if referenced[path] || streams[filepath.Dir(path)] {
+				return nil
+			}
+			// Uploads in progress, see cleanupOrphanTemps.
+			if name := entry.Name(); len(name) >= 36 {
+				if _, err := uuid.Parse(name[:36]); err == nil {
+					return nil
+				}
+			}
+			report.OrphanedFiles++
+			report.OrphanedBytes += info.Size()
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// diagnosticsHandler reports totals of the DB and the storage and where
+// they diverge, from a cache refreshed every diagnosticsTTL or with
+// ?refresh=true.
+func (r *Repository) diagnosticsHandler(c *gin.Context) {
+	report, err := r.Diagnostics.get(r.DB, c.Query("refresh") == "true")
+	if err != nil {
+		log.Printf("Failed to assemble diagnostics: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't assemble diagnostics",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": report,
+	})
+}
+
+const (
+	maxStatsDays  = 366
+	dailyStatsTTL = time.Minute
+)
+
+const dailyStatsQuery = `
+SELECT to_char(date_trunc('day', created_at AT TIME ZONE ?), 'YYYY-MM-DD') AS day,
+	COUNT(*) AS uploads,
+	COALESCE(SUM(size), 0) AS bytes
+FROM files
+WHERE created_at >= ?
+GROUP BY 1
+ORDER BY 1`
+
+type dailyStat struct {
+	Day     string `json:"day"`
+	Uploads int64  `json:"uploads"`
+	Bytes   int64  `json:"bytes"`
+}
+
+type cachedStats struct {
+	series  []dailyStat
+	expires time.Time
+}
+
+// statsCache keeps recent daily series per requested range, the group-by
+// scans the whole range of the files table.
+type statsCache struct {
+	mu      sync.Mutex
+	entries map[int]cachedStats
+}
+
+func (s *statsCache) get(days int) ([]dailyStat, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[days]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.series, true
+}
+
+func (s *statsCache) put(days int, series []dailyStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[days] = cachedStats{series: series, expires: time.Now().Add(dailyStatsTTL)}
+}
+
+// dailyStatsHandler returns upload counts and bytes for each of the last
+// days days, today included, with days bounded in STATS_TIMEZONE. Days
+// without uploads are reported with zeros so the series has no gaps.
+func (r *Repository) dailyStatsHandler(c *gin.Context) {
+	days := 30
+	if value := c.Query("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxStatsDays {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("days must be between 1 and %d", maxStatsDays),
+			})
+			return
+		}
+		days = n
+	}
+	loc := r.Config.StatsTimezone
+	if series, ok := r.Stats.get(days); ok {
+		c.JSON(http.StatusOK, gin.H{
+			"data":     series,
+			"timezone": loc.String(),
+		})
+		return
+	}
+
+	now := time.Now().In(loc)
+	start := time.Date(now.Year(), now.Month(), now.Day()-days+1, 0, 0, 0, 0, loc)
+	var rows []dailyStat
+	if err := r.DB.Raw(dailyStatsQuery, loc.String(), start).Scan(&rows).Error; err != nil {
+		log.Printf("Failed to compute daily stats: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "couldn't compute statistics",
+		})
+		return
+	}
+	byday := make(map[string]dailyStat, len(rows))
+	for _, row := range rows {
+		byday[row.Day] = row
+	}
+	series := make([]dailyStat, 0, days)
+	for i := 0; i < days; i++ {
+		day := start.AddDate(0, 0, i).Format("2006-01-02")
+		stat, ok := byday[day]
+		if !ok {
+			stat = dailyStat{Day: day}
+		}
+		series = append(series, stat)
+	}
+	r.Stats.put(days, series)
+	c.JSON(http.StatusOK, gin.H{
+		"data":     series,
+		"timezone": loc.String(),
+	})
+}
+
+// storageSelfTest writes a marker file to the storage directory, reads it
+// back and removes it, so a read-only or missing mount is reported at
+// startup instead of on the first upload. Files are only stored on the
+// local disk, it is the only backend to check.
+func storageSelfTest(dir string) error {
+	path := filepath.Join(dir, ".selftest-"+uuid.New().String())
+	marker := []byte("storage self-test " + time.Now().UTC().Format(time.RFC3339Nano))
+	if err := os.WriteFile(path, marker, 0644); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	defer os.Remove(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read back: %w", err)
+	}
+	if !bytes.Equal(data, marker) {
+		return errors.New("read back different bytes than written")
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	return nil
+}
+
+const writableCheckTTL = 30 * time.Second
+
+// writableCheck runs the storage self-test for /healthz, at most every
+// writableCheckTTL, so a mount that turns read-only or loses its
+// permissions shows up before uploads fail.
+type writableCheck struct {
+	mu       sync.Mutex
+	checked  time.Time
+	writable bool
+}
+
+func (w *writableCheck) check() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if time.Since(w.checked) < writableCheckTTL {
+		return w.writable
+	}
+	w.checked, w.writable = time.Now(), true
+	for _, dir := range storageDirs {
+		if err := storageSelfTest(dir); err != nil {
+			log.Printf("Storage directory %s is not writable: %v", dir, err)
+			w.writable = false
+		}
+	}
+	return w.writable
+}
+
+// cleanupOrphanTemps removes temporary upload files left behind by a crash.
+// Uploads are received into files named by a random UUID (conversions add
+// a suffix to that name) and renamed to their numeric ID once stored, so
+// only UUID-named files older than age are removed.
+func cleanupOrphanTemps(dir string, age time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Failed to scan %s for orphaned temporary files: %v", dir, err)
+		return
+	}
+	cutoff := time.Now().Add(-age)
+	removed, reclaimed := 0, int64(0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || len(name) < 36 {
+			continue
+		}
+		if _, err := uuid.Parse(name[:36]); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			log.Printf("Failed to remove orphaned temporary file %s: %v", name, err)
+			continue
+		}
+		removed++
+		reclaimed += info.Size()
+	}
+	if removed > 0 {
+		log.Printf("Removed %d orphaned temporary files, %d bytes reclaimed", removed, reclaimed)
+	}
+}
+
+func main() {
+	migrateOnly := flag.Bool("migrate", false, "run database migrations and exit")
+	migrateLayoutOnly := flag.Bool("migrate-layout", false, "move stored files into the hash layout and exit")
+	flag.Parse()
+	cfg := config.Load()
+	mimetypes = mimealias.New(cfg.MimetypeAliases)
+	extraHashes = slices.DeleteFunc(slices.Clone(cfg.HashAlgorithms), func(name string) bool {
+		return name == filehash.SHA256
+	})
+	for _, route := range cfg.StorageRoutes {
+		if !slices.Contains(storageDirs, route.Dir) {
+			storageDirs = append(storageDirs, route.Dir)
+		}
+	}
+
+	db, err := Connection()
+	if err != nil {
+		log.Fatal("could not load the database")
+	}
+	if cfg.TracingEndpoint != "" {
+		if err := tracing.Setup(cfg.TracingEndpoint, cfg.TracingSampleRatio, cfg.TracingService); err != nil {
+			log.Fatalf("could not set up tracing: %v", err)
+		}
+		if err := tracing.InstrumentDB(db); err != nil {
+			log.Fatalf("could not set up tracing: %v", err)
+		}
+		log.Printf("Exporting traces to %s", cfg.TracingEndpoint)
+	}
+	sqldb, err := db.DB()
+	if err != nil {
+		log.Fatalf("could not get the database handle: %v", err)
+	}
+	if *migrateOnly {
+		if err := MigrateDB(db); err != nil {
+			log.Fatalf("could not migrate db: %v", err)
+		}
+		log.Println("Migrations applied, exiting")
+		return
+	}
+	if *migrateLayoutOnly {
+		if err := migrateLayout(db); err != nil {
+			log.Fatalf("could not migrate the storage layout: %v", err)
+		}
+		return
+	}
+	if cfg.AutoMigrate {
+		if err := MigrateDB(db); err != nil {
+			log.Fatal("could not migrate db")
+		}
+		log.Println("Migrations applied on startup")
+	} else {
+		log.Println("AUTO_MIGRATE is off, assuming the schema is current")
+	}
+
+	for _, dir := range storageDirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Fatalf("coudn't create the directory %s: %v", dir, err)
+		}
+		if err := storageSelfTest(dir); err != nil {
+			log.Fatalf("Storage backend local (%s) failed the self-test: %v", dir, err)
+		}
+		log.Printf("Storage backend local (%s) passed the self-test", dir)
+		cleanupOrphanTemps(dir, cfg.TempCleanupAge)
+	}
+	if cfg.TempCleanupInterval > 0 {
+		go func() {
+			for range time.Tick(cfg.TempCleanupInterval) {
+				for _, dir := range storageDirs {
+					cleanupOrphanTemps(dir, cfg.TempCleanupAge)
+				}
+			}
+		}()
+	}
+	go func() {
+		for ; ; time.Sleep(sessionExpiryInterval) {
+			expireSessions(db)
+		}
+	}()
+	// The headers are masked in every log line that includes them.
+	redactor := middleware.NewRedactor(cfg.RedactHeaders)
+	router := gin.New()
+	router.Use(gin.Logger(), middleware.Recovery(redactor))
+	if cfg.TracingEndpoint != "" {
+		router.Use(middleware.Tracing())
+	}
+	router.Use(middleware.ErrorCodes())
+	router.Use(middleware.HSTS(cfg.HSTSMaxAge))
+	r := Repository{
+		DB:        db,
+		Config:    cfg,
+		Events:    events.NewHub(cfg.EventBufferSize, cfg.EventMaxSubscribers),
+		Backfill:  &backfillJob{},
+		Hooks:     hooks.NewPool(db, cfg.ProcessingWorkers, cfg.ProcessingQueueSize, cfg.HookTimeout, cfg.HookAttempts, cfg.HookRetryBackoff),
+		Stats:     &statsCache{entries: map[int]cachedStats{}},
+		Files:     filecache.New(cfg.FileCacheSize),
+		Mimetypes: &mimetypeCache{entries: map[string]cachedMimetypes{}},
+		Health:    dbhealth.NewMonitor(sqldb, cfg.DBHealthInterval),
+
+		Diagnostics: &diagnosticsCache{},
+		Usage:       newStorageUsage(db, cfg.MaxTotalBytes),
+		Writable:    &writableCheck{},
+		Snapshots:   &snapshotter{db: db, dir: cfg.SnapshotDir, keep: cfg.SnapshotKeep},
+
+		UserDownloads: throttle.NewSlots(cfg.UserDownloadSlots),
+		FileDownloads: throttle.NewSlots(cfg.FileDownloadSlots),
+	}
+	if err := r.Files.Register(db); err != nil {
+		log.Fatalf("could not set up the file cache: %v", err)
+	}
+	if cfg.ConfirmGracePeriod > 0 {
+		r.Confirmations = confirmation.NewStore(cfg.ConfirmGracePeriod)
+	}
+	if cfg.PlaceholderImage != "" {
+		if r.Placeholder, err = loadPlaceholder(cfg.PlaceholderImage); err != nil {
+			log.Fatalf("could not read the placeholder image: %v", err)
+		}
+	}
+	processing := ProcessingState{}
+	if err := db.Limit(1).Find(&processing, 1).Error; err != nil {
+		log.Printf("Failed to load the processing state: %v", err)
+	} else if processing.Paused {
+		log.Println("Background processing is paused, resume it with POST /admin/processing/resume")
+		r.Hooks.SetPaused(true)
+	}
+	r.NamePolicy = namepolicy.Policy{
+		Pattern:   cfg.NamePattern,
+		Prefixes:  cfg.NamePrefixes,
+		NoSpaces:  cfg.NameNoSpaces,
+		Forbidden: cfg.NameForbidden,
+		MaxLength: cfg.NameMaxLength,
+	}
+	if cfg.SignatureCheck {
+		if r.Signatures, err = signature.Load(cfg.SignaturesFile); err != nil {
+			log.Fatalf("could not load file signatures: %v", err)
+		}
+	}
+	go r.Health.Run(context.Background())
+	if err := r.Usage.reconcile(); err != nil {
+		log.Fatalf("could not sum up the storage usage: %v", err)
+	}
+	go r.Usage.run()
+	if cfg.IntegrityScan {
+		go newIntegrityScanner(db, cfg).run()
+	}
+	if cfg.SnapshotInterval > 0 {
+		go r.Snapshots.run(cfg.SnapshotInterval)
+	}
+	router.Use(middleware.ReadOnly(r.Health.Healthy))
+	router.GET("/healthz", r.healthHandler)
+	r.Hooks.Register(thumbnailHook{db: db, size: cfg.ThumbnailSize, maxPixels: cfg.ImageMaxPixels,
+		autoOrient: cfg.ImageAutoOrient})
+	r.Hooks.Register(perceptualHashHook{db: db, maxPixels: cfg.ImageMaxPixels})
+	if len(cfg.ImageVariantFormats) > 0 {
+		r.Hooks.Register(imageVariantHook{db: db, command: cfg.ImageVariantCommand,
+			formats: cfg.ImageVariantFormats, quality: cfg.ImageVariantQuality, maxPixels: cfg.ImageMaxPixels})
+	}
+	if cfg.SensitiveScan {
+		patterns, err := sensitive.Load(cfg.SensitivePatterns)
+		if err != nil {
+			log.Fatalf("could not load sensitive content patterns: %v", err)
+		}
+		r.Hooks.Register(sensitiveHook{db: db, patterns: patterns})
+	}
+	if cfg.HLSEnabled {
+		r.Hooks.Register(hlsHook{db: db, command: cfg.HLSCommand, segment: cfg.HLSSegmentLength})
+	}
+	anonymous := scope.Anonymous(len(cfg.APITokens) > 0)
+	api := router.Group("/files", middleware.Audit(), middleware.UserAuth(cfg.APITokens, cfg.AdminToken),
+		middleware.MethodScope(anonymous, "/files/metadata/batch", "/files/validate-name"))
+	if cfg.ChaosMode {
+		log.Println("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+		log.Printf("!!! CHAOS_MODE is on: /files requests get up to %v of latency, %.0f%% fail with 503, %.0f%% are dropped",
+			cfg.ChaosLatency, cfg.ChaosErrorRate*100, cfg.ChaosDropRate*100)
+		log.Println("!!! This is for client testing only, never run it in production")
+		log.Println("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+		api.Use(middleware.Chaos(cfg.ChaosLatency, cfg.ChaosErrorRate, cfg.ChaosDropRate))
+	}
+	{
+		api.GET("/download/:id", r.downloadHandler)
+		api.GET("/download.tar", r.tarDownloadHandler)
+		api.GET("/archive/:year/:month", r.archiveListHandler)
+		api.GET("/archive/:year/:month/download.zip", r.archiveZipHandler)
+		api.GET("/archive/:year/:month/:day", r.archiveListHandler)
+		api.GET("/archive/:year/:month/:day/download.zip", r.archiveZipHandler)
+		api.GET("/by-external/:externalId", r.externalDownloadHandler)
+		api.GET("/by-hash/:sha256", r.hashLookupHandler)
+		api.HEAD("/by-hash/:sha256", r.hashLookupHandler)
+		api.POST("/ref", r.fileRefHandler)
+		api.POST("/validate-name", r.validateNameHandler)
+		api.POST("/metadata/batch", r.batchInfoHandler)
+		// The metrics are registered once, and a key can't be replayed
+		// through another upload route.
+		telemetry := middleware.UploadTelemetry(cfg.UploadSizeBuckets, cfg.UploadDurationBuckets, cfg.TelemetrySampleRate, redactor)
+		idempotent := middleware.Idempotency(idempotency.NewStore(cfg.IdempotencyTTL))
+		api.POST("/upload", telemetry, middleware.BodyLimit(cfg.MaxUploadBytes), idempotent, r.uploadHandler)
+		for _, method := range []string{http.MethodPost, http.MethodPut} {
+			api.Handle(method, "/raw", telemetry, middleware.BodyLimit(cfg.MaxUploadBytes), idempotent, r.rawUploadHandler)
+		}
+		api.PATCH("", middleware.AdminAuth(cfg.AdminToken, cfg.APITokens), r.bulkUpdateHandler)
+		api.POST("/tag-by-query", middleware.AdminAuth(cfg.AdminToken, cfg.APITokens), r.tagByQueryHandler)
+		api.GET("", r.listHandler)
+		api.GET("/recent", r.recentHandler)
+		api.GET("/mimetypes", r.mimetypesHandler)
+		api.GET("/:id", r.fileInfoHandler)
+		api.DELETE("/:id", r.deleteHandler)
+		api.GET("/:id/bytes", r.byteRangeHandler)
+		api.GET("/:id/hooks", r.hookStatusHandler)
+		api.GET("/:id/status", r.fileStatusHandler)
+		api.PATCH("/:id/metadata", r.metadataHandler)
+		api.GET("/:id/thumbnail", r.thumbnailHandler)
+		api.GET("/:id/variants", r.variantsHandler)
+		api.GET("/:id/variants/:kind", r.variantHandler)
+		api.GET("/:id/hls/:name", r.hlsHandler)
+		api.GET("/:id/similar", r.similarHandler)
+		api.GET("/:id/qr", r.qrHandler)
+		api.GET("/:id/preview", r.previewHandler)
+		api.GET("/:id/datauri", r.datauriHandler)
+		api.PUT("/:id/download-limit", r.downloadLimitHandler)
+		api.GET("/:id/shares", r.sharesListHandler)
+		api.POST("/:id/shares", r.shareGrantHandler)
+		api.DELETE("/:id/shares/:user", r.shareRevokeHandler)
+	}
+	messages := router.Group("/messages", middleware.Audit(), middleware.UserAuth(cfg.APITokens, cfg.AdminToken),
+		middleware.MethodScope(anonymous))
+	{
+		messages.POST("", r.messageCreateHandler)
+		messages.GET("/:id/files", r.messageFilesHandler)
+	}
+	sessions := router.Group("/sessions", middleware.Audit(), middleware.UserAuth(cfg.APITokens, cfg.AdminToken),
+		middleware.MethodScope(anonymous))
+	{
+		sessions.GET("/:id/files", r.sessionFilesHandler)
+		sessions.DELETE("/:id", r.sessionDeleteHandler)
+	}
+	router.GET("/metrics", middleware.AdminAuth(cfg.AdminToken, cfg.APITokens), gin.WrapF(metrics.Handler))
+	admin := router.Group("/admin", middleware.Audit(), middleware.AdminAuth(cfg.AdminToken, cfg.APITokens))
+	{
+		admin.GET("/events", r.eventsHandler)
+		admin.GET("/quarantine", r.quarantineListHandler)
+		admin.POST("/quarantine/:id/release", r.quarantineReleaseHandler)
+		admin.DELETE("/quarantine/:id", r.quarantinePurgeHandler)
+		admin.GET("/sensitive", r.sensitiveListHandler)
+		dedupeLimit := middleware.RateLimit(cfg.DuplicatesRateLimit, time.Minute)
+		admin.GET("/duplicates", dedupeLimit, r.duplicatesHandler)
+		admin.POST("/dedupe", r.limitConfirmed(dedupeLimit), r.dedupeHandler)
+		admin.GET("/backfill-hashes", r.backfillStatusHandler)
+		admin.POST("/backfill-hashes", r.backfillHashesHandler)
+		admin.GET("/stats/daily", r.dailyStatsHandler)
+		admin.GET("/size-audit", r.sizeAuditHandler)
+		admin.GET("/integrity", r.integrityHandler)
+		admin.GET("/diagnostics", r.diagnosticsHandler)
+		admin.GET("/export.csv", r.exportHandler)
+		admin.POST("/snapshot", r.snapshotHandler)
+		admin.GET("/snapshots", r.snapshotsHandler)
+		admin.GET("/processing/status", r.processingStatusHandler)
+		admin.POST("/processing/pause", r.processingPauseHandler)
+		admin.POST("/processing/resume", r.processingResumeHandler)
+		admin.GET("/failed-jobs", r.failedJobsHandler)
+		admin.POST("/failed-jobs/:id/retry", r.failedJobRetryHandler)
+		admin.POST("/normalize-mimetypes", r.normalizeMimetypesHandler)
+		admin.POST("/size-audit/repair", r.sizeRepairHandler)
+	}
+
+	if !cfg.TLSEnabled() {
+		router.Run(listenAddr)
+		return
+	}
+	if cfg.HTTPRedirectAddr != "" {
+		go func() {
+			log.Printf("Redirecting plain HTTP on %s to HTTPS", cfg.HTTPRedirectAddr)
+			if err := http.ListenAndServe(cfg.HTTPRedirectAddr, http.HandlerFunc(redirectToHTTPS)); err != nil {
+				log.Fatalf("HTTP redirect listener failed: %v", err)
+			}
+		}()
+	}
+	server := &http.Server{
+		Addr:      listenAddr,
+		Handler:   router,
+		TLSConfig: &tls.Config{MinVersion: tlsVersions[cfg.TLSMinVersion]},
+	}
+	log.Printf("Listening on %s with TLS %s or newer", listenAddr, cfg.TLSMinVersion)
+	log.Fatal(server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile))
+}
+
+const listenAddr = ":9090"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same path on the TLS
+// listener.
+func redirectToHTTPS(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(listenAddr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	target := url.URL{Scheme: "https", Host: host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+	http.Redirect(w, req, target.String(), http.StatusPermanentRedirect)
 }
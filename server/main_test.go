@@ -0,0 +1,1750 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"messangere/apierror"
+	"messangere/config"
+	"messangere/confirmation"
+	. "messangere/database"
+	"messangere/dbhealth"
+	"messangere/events"
+	"messangere/filecache"
+	"messangere/hooks"
+	"messangere/httpheader"
+	"messangere/idempotency"
+	"messangere/middleware"
+	"messangere/scope"
+	"messangere/signature"
+	"messangere/throttle"
+	"messangere/thumbnail"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testContext returns a context for a GET of target and its recorder.
+func testContext(target string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", target, nil)
+	return c, w
+}
+
+// dryRunDB is a database that builds statements without running them:
+// writes succeed and reads find nothing.
+func dryRunDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 port=1"}), &gorm.Config{
+		DryRun:                 true,
+		DisableAutomaticPing:   true,
+		SkipDefaultTransaction: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// scriptedConn is a database/sql connection answering queries with the rows
+// query returns and passing statements to exec, which returns the number
+// of rows they affected. Either may be nil, statements then affect one row.
+type scriptedConn struct {
+	query func(query string, args []driver.Value) (columns []string, rows [][]driver.Value)
+	exec  func(query string, args []driver.Value) int64
+}
+
+func (c *scriptedConn) Prepare(query string) (driver.Stmt, error) {
+	return scriptedStmt{c, query}, nil
+}
+func (c *scriptedConn) Close() error              { return nil }
+func (c *scriptedConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *scriptedConn) Commit() error             { return nil }
+func (c *scriptedConn) Rollback() error           { return nil }
+
+// BeginTx accepts the isolation levels database/sql refuses for drivers
+// without it.
+func (c *scriptedConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *scriptedConn) Connect(context.Context) (driver.Conn, error) { return c, nil }
+func (c *scriptedConn) Driver() driver.Driver                        { return nil }
+
+type scriptedStmt struct {
+	conn  *scriptedConn
+	query string
+}
+
+func (s scriptedStmt) Close() error  { return nil }
+func (s scriptedStmt) NumInput() int { return -1 }
+func (s scriptedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.conn.exec != nil {
+		return driver.RowsAffected(s.conn.exec(s.query, args)), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s scriptedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := &scriptedRows{}
+	if s.conn.query != nil {
+		rows.columns, rows.rows = s.conn.query(s.query, args)
+	}
+	return rows, nil
+}
+
+type scriptedRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *scriptedRows) Columns() []string { return r.columns }
+func (r *scriptedRows) Close() error      { return nil }
+func (r *scriptedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// scriptedDB is a database running its statements on conn.
+func scriptedDB(t *testing.T, conn *scriptedConn) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(conn)}), &gorm.Config{
+		SkipDefaultTransaction: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// storedFile writes content to a file in a temporary storage directory,
+// gzipped when compressed is set, and returns its record.
+func storedFile(t *testing.T, content string, compressed bool) Files {
+	t.Helper()
+	dir := t.TempDir()
+	dirs := storageDirs
+	t.Cleanup(func() { storageDirs = dirs })
+	storageDirs = []string{dir}
+	path := filepath.Join(dir, "blob")
+	data := []byte(content)
+	if compressed {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		data = buf.Bytes()
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return Files{
+		ID:          1,
+		Name:        "notes.txt",
+		Mimetype:    "text/plain",
+		StoragePath: path,
+		Size:        uint64(len(content)),
+		Sha256:      sha256Hex(content),
+		Compressed:  compressed,
+		CreatedAt:   time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestSetDownloadHeadersActiveContent(t *testing.T) {
+	const csp = "default-src 'none'; sandbox"
+	tests := []struct {
+		name        string
+		file        Files
+		target      string
+		inline      bool
+		contentType string
+		disposition string
+		csp         string
+	}{
+		{
+			name:        "svg asked inline is still an attachment",
+			file:        Files{Name: "logo.svg", Mimetype: "image/svg+xml"},
+			target:      "/?inline=true",
+			contentType: "image/svg+xml",
+			disposition: "attachment",
+			csp:         csp,
+		},
+		{
+			name:        "html shown inline when allowed keeps the policy",
+			file:        Files{Name: "page.html", Mimetype: "text/html"},
+			target:      "/?inline=true",
+			inline:      true,
+			contentType: "text/html",
+			disposition: "inline",
+			csp:         csp,
+		},
+		{
+			name:        "html named as text is active by its extension",
+			file:        Files{Name: "page.html", Mimetype: "text/plain"},
+			target:      "/?inline=true",
+			contentType: "text/plain",
+			disposition: "attachment",
+			csp:         csp,
+		},
+		{
+			name:        "html without an extension is served as its stored type",
+			file:        Files{Name: "page", Mimetype: "application/octet-stream"},
+			target:      "/?inline=true",
+			contentType: "application/octet-stream",
+			disposition: "inline",
+			csp:         "sandbox",
+		},
+		{
+			name:        "html stored as html without an extension",
+			file:        Files{Name: "page", Mimetype: "text/html; charset=utf-8"},
+			target:      "/?inline=true",
+			contentType: "text/html; charset=utf-8",
+			disposition: "attachment",
+			csp:         csp,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Repository{Config: &config.Config{ActiveContentCSP: csp, ActiveContentInline: tt.inline}}
+			c, w := testContext(tt.target)
+			r.setDownloadHeaders(c, tt.file, tt.file.Name)
+			h := w.Header()
+			if got := h.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := h.Get("Content-Disposition"); !strings.HasPrefix(got, tt.disposition+";") {
+				t.Errorf("Content-Disposition = %q, want %s", got, tt.disposition)
+			}
+			if got := h.Get("Content-Security-Policy"); got != tt.csp {
+				t.Errorf("Content-Security-Policy = %q, want %q", got, tt.csp)
+			}
+			if got := h.Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+			}
+		})
+	}
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestCheckChecksum(t *testing.T) {
+	sum := sha256Hex("hello")
+	tests := []struct {
+		name     string
+		expected string
+		wantErr  bool
+	}{
+		{"no expected hash", "", false},
+		{"match", sum, false},
+		{"match in upper case", strings.ToUpper(sum), false},
+		{"mismatch", sha256Hex("other"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploaderr := checkChecksum(pendingUpload{Name: "a.txt", Sha256: sum, ExpectedSha256: tt.expected})
+			if (uploaderr != nil) != tt.wantErr {
+				t.Fatalf("checkChecksum() = %v, want error %v", uploaderr, tt.wantErr)
+			}
+			if uploaderr != nil && uploaderr.code != apierror.ChecksumMismatch {
+				t.Errorf("code = %s, want %s", uploaderr.code, apierror.ChecksumMismatch)
+			}
+		})
+	}
+}
+
+func TestUploadDescriptorSha256(t *testing.T) {
+	upload := pendingUpload{Name: "a.txt", ExpectedSha256: "from-part"}
+	uploadDescriptor{}.apply(&upload)
+	if upload.ExpectedSha256 != "from-part" {
+		t.Errorf("descriptor without sha256 replaced it with %q", upload.ExpectedSha256)
+	}
+	uploadDescriptor{Sha256: " abc "}.apply(&upload)
+	if upload.ExpectedSha256 != "abc" {
+		t.Errorf("ExpectedSha256 = %q, want abc", upload.ExpectedSha256)
+	}
+}
+
+// uploadRequest builds an atomic multipart upload of files, name to
+// content, with the optional metadata field.
+func uploadRequest(t *testing.T, files [][2]string, metadata string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, file := range files {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="file"; filename="`+file[0]+`"`)
+		header.Set("Content-Type", "text/plain")
+		part, err := form.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(file[1]))
+	}
+	if metadata != "" {
+		form.WriteField("metadata", metadata)
+	}
+	form.Close()
+	req := httptest.NewRequest("POST", "/files/upload?atomic=true", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+// The rejected cases all fail before anything is stored, so they run
+// without a database.
+func TestUploadChecksumMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    [][2]string
+		header   string
+		metadata string
+		file     string
+	}{
+		{
+			name:   "request header on a single file",
+			files:  [][2]string{{"a.txt", "aaa"}},
+			header: sha256Hex("other"),
+			file:   "a.txt",
+		},
+		{
+			name:     "descriptor of the second file",
+			files:    [][2]string{{"a.txt", "aaa"}, {"b.txt", "bbb"}},
+			metadata: `[{"file": "a.txt"}, {"file": "b.txt", "sha256": "` + sha256Hex("other") + `"}]`,
+			file:     "b.txt",
+		},
+		{
+			// The header matches b.txt only, it must not be applied to
+			// a.txt, which would fail first.
+			name:     "request header ignored with several files",
+			files:    [][2]string{{"a.txt", "aaa"}, {"b.txt", "bbb"}},
+			header:   sha256Hex("bbb"),
+			metadata: `[{"file": "a.txt"}, {"file": "b.txt", "sha256": "` + sha256Hex("other") + `"}]`,
+			file:     "b.txt",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Repository{
+				Config: &config.Config{
+					MetadataMaxBytes: 1 << 16,
+					StorageRoutes:    []config.StorageRoute{{Prefix: "", Dir: t.TempDir()}},
+				},
+				Usage:  &storageUsage{},
+				Events: events.NewHub(1, 1),
+			}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = uploadRequest(t, tt.files, tt.metadata)
+			if tt.header != "" {
+				c.Request.Header.Set("X-Expected-Sha256", tt.header)
+			}
+			r.uploadHandler(c)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400: %s", w.Code, w.Body)
+			}
+			var response struct {
+				Message string `json:"message"`
+				File    string `json:"file"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.File != tt.file || !strings.HasPrefix(response.Message, "sha256 mismatch") {
+				t.Errorf("response = %+v, want a sha256 mismatch for %s", response, tt.file)
+			}
+			if code := apierror.Of(c, w.Code); code != apierror.ChecksumMismatch {
+				t.Errorf("code = %s, want %s", code, apierror.ChecksumMismatch)
+			}
+		})
+	}
+}
+
+func TestCheckRefSignature(t *testing.T) {
+	dir := t.TempDir()
+	defer func(dirs []string) { storageDirs = dirs }(storageDirs)
+	storageDirs = []string{dir}
+	path := filepath.Join(dir, "blob")
+	if err := os.WriteFile(path, []byte("MZ\x90\x00\x03\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := &Repository{Config: &config.Config{SignatureCheck: true}, Signatures: signature.Defaults}
+	source := Files{StoragePath: path, Mimetype: "application/x-msdownload"}
+	for _, tt := range []struct {
+		mimetype string
+		wantErr  bool
+	}{
+		{"application/x-dosexec", false},
+		{"text/plain", true},
+		{"image/png", true},
+	} {
+		uploaderr := r.checkRefSignature(source, pendingUpload{Name: "ref", Mimetype: tt.mimetype})
+		if (uploaderr != nil) != tt.wantErr {
+			t.Errorf("checkRefSignature(%s) = %v, want error %v", tt.mimetype, uploaderr, tt.wantErr)
+		}
+		if uploaderr != nil && uploaderr.status != http.StatusUnsupportedMediaType {
+			t.Errorf("checkRefSignature(%s) status = %d, want 415", tt.mimetype, uploaderr.status)
+		}
+	}
+}
+
+func TestServableQuarantinedPlaceholder(t *testing.T) {
+	r := &Repository{
+		Config:      &config.Config{PlaceholderDefault: true},
+		Events:      events.NewHub(1, 1),
+		Files:       filecache.New(10),
+		Placeholder: &placeholderImage{data: []byte("placeholder"), mimetype: "image/png"},
+	}
+	r.Files.Put(Files{ID: 7, Name: "photo.png", Mimetype: "image/png", Status: StatusQuarantined})
+	for _, tt := range []struct {
+		name     string
+		servable func(*gin.Context) (Files, bool)
+		status   int
+		body     string
+	}{
+		{"image handlers", r.servableImage, http.StatusAccepted, "placeholder"},
+		{"other handlers", r.servableFile, http.StatusLocked, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := testContext("/files/7")
+			c.Params = gin.Params{{Key: "id", Value: "7"}}
+			if _, ok := tt.servable(c); ok {
+				t.Fatal("a quarantined file is servable")
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body, tt.body)
+			}
+			if placeholder := w.Header().Get("X-Placeholder"); (placeholder != "") != (tt.body != "") {
+				t.Errorf("X-Placeholder = %q", placeholder)
+			}
+		})
+	}
+}
+
+func TestLimitConfirmedSkipsDryRuns(t *testing.T) {
+	r := &Repository{Confirmations: confirmation.NewStore(time.Minute)}
+	router := gin.New()
+	router.POST("/dedupe", r.limitConfirmed(middleware.RateLimit(1, time.Hour)), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	for _, tt := range []struct {
+		target string
+		want   int
+	}{
+		{"/dedupe", http.StatusOK},
+		{"/dedupe", http.StatusOK},
+		{"/dedupe?confirm_token=a", http.StatusOK},
+		{"/dedupe", http.StatusOK},
+		{"/dedupe?confirm_token=b", http.StatusTooManyRequests},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", tt.target, nil))
+		if w.Code != tt.want {
+			t.Errorf("POST %s = %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+}
+
+func TestServeEncodedNegotiation(t *testing.T) {
+	const content = "some text worth compressing, some text worth compressing"
+	tests := []struct {
+		name       string
+		compressed bool
+		headers    map[string]string
+		coding     string
+		status     int
+	}{
+		{"stored gzip to a gzip client", true, map[string]string{"Accept-Encoding": "gzip"}, "gzip", http.StatusOK},
+		{"stored gzip to a plain client", true, nil, "", http.StatusOK},
+		{"stored gzip to a brotli client", true, map[string]string{"Accept-Encoding": "br"}, "br", http.StatusOK},
+		{"plain to a gzip client", false, map[string]string{"Accept-Encoding": "gzip"}, "gzip", http.StatusOK},
+		{"gzip preferred by quality", false, map[string]string{"Accept-Encoding": "br;q=0.5, gzip"}, "gzip", http.StatusOK},
+		{"matching gzip ETag", true, map[string]string{"Accept-Encoding": "gzip", "If-None-Match": `"SUM-gzip"`}, "gzip", http.StatusNotModified},
+		{"ETag of another coding", true, map[string]string{"Accept-Encoding": "gzip", "If-None-Match": `"SUM-br"`}, "gzip", http.StatusOK},
+		{"matching plain ETag", true, map[string]string{"If-None-Match": `W/"SUM"`}, "", http.StatusNotModified},
+		{"matching br ETag", false, map[string]string{"Accept-Encoding": "br", "If-None-Match": `"SUM-br"`}, "br", http.StatusNotModified},
+		{"not modified since", true, map[string]string{"Accept-Encoding": "gzip", "If-Modified-Since": "Sat, 03 Jan 2026 00:00:00 GMT"}, "gzip", http.StatusNotModified},
+		{"modified since", false, map[string]string{"Accept-Encoding": "gzip", "If-Modified-Since": "Thu, 01 Jan 2026 00:00:00 GMT"}, "gzip", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filerecord := storedFile(t, content, tt.compressed)
+			r := &Repository{
+				DB: dryRunDB(t),
+				Config: &config.Config{
+					DownloadCompression: true,
+					DownloadEncodings:   []string{"br", "gzip"},
+					CompressTypes:       []string{"text/"},
+					CompressLevel:       6,
+				},
+				Events: events.NewHub(1, 1),
+				Health: dbhealth.NewMonitor(nil, time.Second),
+			}
+			c, w := testContext("/files/1")
+			for name, value := range tt.headers {
+				c.Request.Header.Set(name, strings.ReplaceAll(value, "SUM", filerecord.Sha256))
+			}
+			claims := 0
+			claim := func() bool {
+				claims++
+				return true
+			}
+			if tt.compressed {
+				r.serveCompressed(c, filerecord, filerecord.Name, claim)
+			} else {
+				coding := httpheader.NegotiateEncoding(c.GetHeader("Accept-Encoding"), r.Config.DownloadEncodings)
+				r.serveEncoded(c, filerecord, filerecord.Name, coding, claim)
+			}
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			etag := `"` + filerecord.Sha256 + `"`
+			if tt.coding != "" {
+				etag = `"` + filerecord.Sha256 + "-" + tt.coding + `"`
+			}
+			if got := w.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %s, want %s", got, etag)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			if tt.status == http.StatusNotModified {
+				if claims != 0 || w.Body.Len() != 0 {
+					t.Errorf("304 claimed %d downloads and sent %d bytes", claims, w.Body.Len())
+				}
+				return
+			}
+			if claims != 1 {
+				t.Errorf("claimed %d downloads, want 1", claims)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.coding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.coding)
+			}
+			body, err := decodeBody(tt.coding, w.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body != content {
+				t.Errorf("decoded body = %q, want %q", body, content)
+			}
+		})
+	}
+}
+
+// decodeBody undoes the content coding of a response body.
+func decodeBody(coding string, body []byte) (string, error) {
+	var reader io.Reader = bytes.NewReader(body)
+	switch coding {
+	case "gzip":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return "", err
+		}
+		reader = gz
+	case "br":
+		reader = brotli.NewReader(reader)
+	}
+	decoded, err := io.ReadAll(reader)
+	return string(decoded), err
+}
+
+func TestDownloadImageVariantNegotiation(t *testing.T) {
+	filerecord := storedFile(t, "jpeg bytes", false)
+	filerecord.Name, filerecord.Mimetype = "photo.jpg", "image/jpeg"
+	filerecord.Hashes = JSONMap{"md5": "0123456789abcdef0123456789abcdef"}
+	webp := filepath.Join(filepath.Dir(filerecord.StoragePath), "1.variant.webp")
+	if err := os.WriteFile(webp, []byte("webp bytes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db := dryRunDB(t)
+	// The dry run finds nothing, the stored variants are filled in.
+	db.Callback().Query().After("gorm:query").Register("test:variants", func(tx *gorm.DB) {
+		if variants, ok := tx.Statement.Dest.(*[]FileVariant); ok {
+			*variants = []FileVariant{{FileID: 1, Kind: "webp", StoragePath: webp}}
+		}
+	})
+	tests := []struct {
+		accept      string
+		contentType string
+		body        string
+		etag        string
+	}{
+		{"image/webp,image/*;q=0.8", "image/webp", "webp bytes", `"SUM-webp"`},
+		{"image/avif,image/jpeg;q=0.9,image/webp;q=0.5", "image/jpeg", "jpeg bytes", `"SUM"`},
+		{"image/*", "image/jpeg", "jpeg bytes", `"SUM"`},
+		{"", "image/jpeg", "jpeg bytes", `"SUM"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := &Repository{
+				DB: db,
+				Config: &config.Config{
+					ImageVariantFormats: []string{"avif", "webp"},
+					NameTemplate:        "{name}",
+				},
+				Events:        events.NewHub(1, 1),
+				Files:         filecache.New(10),
+				Health:        dbhealth.NewMonitor(nil, time.Second),
+				UserDownloads: throttle.NewSlots(0),
+				FileDownloads: throttle.NewSlots(0),
+			}
+			r.Files.Put(filerecord)
+			c, w := testContext("/files/1")
+			c.Params = gin.Params{{Key: "id", Value: "1"}}
+			c.Request.Header.Set("Accept", tt.accept)
+			r.downloadHandler(c)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			h := w.Header()
+			if got := h.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body, tt.body)
+			}
+			if etag := strings.ReplaceAll(tt.etag, "SUM", filerecord.Sha256); h.Get("ETag") != etag {
+				t.Errorf("ETag = %s, want %s", h.Get("ETag"), etag)
+			}
+			if !strings.Contains(strings.Join(h.Values("Vary"), ","), "Accept") {
+				t.Errorf("Vary = %q, want Accept", h.Values("Vary"))
+			}
+			// The checksums are of the original bytes.
+			original := tt.contentType == filerecord.Mimetype
+			if got := h.Get("X-Checksum-md5"); (got != "") != original {
+				t.Errorf("X-Checksum-md5 = %q on the %s response", got, tt.contentType)
+			}
+			if got := h.Get("Content-MD5"); (got != "") != original {
+				t.Errorf("Content-MD5 = %q on the %s response", got, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestCoalesceRangesResponses(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	filerecord := storedFile(t, content, false)
+	many := make([]string, maxRanges+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("%d-%d", i*10, i*10+4)
+	}
+	tests := []struct {
+		name   string
+		header string
+		status int
+		check  func(t *testing.T, w *httptest.ResponseRecorder)
+	}{
+		{"single range", "bytes=10-19", http.StatusPartialContent, func(t *testing.T, w *httptest.ResponseRecorder) {
+			if w.Body.String() != content[10:20] {
+				t.Errorf("body = %q", w.Body)
+			}
+		}},
+		{"overlapping ranges are merged", "bytes=0-9,5-14", http.StatusPartialContent, func(t *testing.T, w *httptest.ResponseRecorder) {
+			if got := w.Header().Get("Content-Range"); got != "bytes 0-14/1000" {
+				t.Errorf("Content-Range = %q", got)
+			}
+		}},
+		{"distinct ranges", "bytes=0-9,100-109", http.StatusPartialContent, func(t *testing.T, w *httptest.ResponseRecorder) {
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "multipart/byteranges") {
+				t.Errorf("Content-Type = %q", got)
+			}
+		}},
+		{"unsatisfiable", "bytes=5000-6000", http.StatusRequestedRangeNotSatisfiable, func(t *testing.T, w *httptest.ResponseRecorder) {
+			if got := w.Header().Get("Content-Range"); got != "bytes */1000" {
+				t.Errorf("Content-Range = %q", got)
+			}
+		}},
+		{"too many ranges send the whole file", "bytes=" + strings.Join(many, ","), http.StatusOK, func(t *testing.T, w *httptest.ResponseRecorder) {
+			if w.Body.String() != content {
+				t.Errorf("body is %d bytes, want the whole file", w.Body.Len())
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(filerecord.StoragePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			c, w := testContext("/files/1")
+			c.Request.Header.Set("Range", tt.header)
+			coalesceRanges(c, f, tt.header)
+			http.ServeContent(c.Writer, c.Request, filerecord.Name, filerecord.CreatedAt, f)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			tt.check(t, w)
+		})
+	}
+}
+
+func TestCreateConflict(t *testing.T) {
+	upload := pendingUpload{Name: "a.txt"}
+	uploaderr := createConflict(upload, &pgconn.PgError{Code: "23505", Detail: "Key (external_id)=(abc) already exists."})
+	if uploaderr.status != http.StatusConflict || uploaderr.code != apierror.Conflict ||
+		uploaderr.message != "a file with the same external_id already exists" {
+		t.Errorf("unique violation = %+v, want a 409 naming external_id", uploaderr)
+	}
+	uploaderr = createConflict(upload, errors.New("connection reset"))
+	if uploaderr.status != http.StatusInternalServerError || uploaderr.code != apierror.Internal {
+		t.Errorf("other error = %+v, want a 500", uploaderr)
+	}
+}
+
+func TestStorageUsageReconcile(t *testing.T) {
+	u := &storageUsage{limit: 1000}
+	u.db = scriptedDB(t, &scriptedConn{query: func(string, []driver.Value) ([]string, [][]driver.Value) {
+		// An upload reserving its size while the sum runs, its record
+		// isn't in the sum.
+		if !u.reserve(100) {
+			t.Error("reservation refused")
+		}
+		return []string{"sum"}, [][]driver.Value{{int64(500)}}
+	}})
+	u.add(700)
+	if err := u.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if got := u.total(); got != 600 {
+		t.Errorf("total() = %d, want the sum of 500 and the 100 reserved meanwhile", got)
+	}
+	if !u.fits(400) || u.fits(401) {
+		t.Errorf("fits() disagrees with a total of %d", u.total())
+	}
+}
+
+func TestBatchInfoChecksSharesOnce(t *testing.T) {
+	db := dryRunDB(t)
+	var queries int
+	db.Callback().Query().After("gorm:query").Register("test:shares", func(tx *gorm.DB) {
+		if tx.Statement.Table != "file_shares" {
+			return
+		}
+		queries++
+		if ids, ok := tx.Statement.Dest.(*[]uint64); ok {
+			*ids = []uint64{2, 4}
+		}
+	})
+	r := &Repository{DB: db, Files: filecache.New(10)}
+	for id, owner := range map[uint64]string{1: "alice", 2: "alice", 3: "", 4: "alice", 5: "bob"} {
+		r.Files.Put(Files{ID: id, Owner: owner, Status: StatusReady})
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/files/metadata/batch", strings.NewReader("[1, 2, 3, 4, 5]"))
+	c.Request.Header.Set("Authorization", "Bearer bob-token")
+	middleware.UserAuth(map[string]scope.Token{"bob-token": {User: "bob", Scopes: scope.Default}}, "")(c)
+	r.batchInfoHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if queries != 1 {
+		t.Errorf("%d share queries, want 1", queries)
+	}
+	var body struct {
+		Data   []*Files          `json:"data"`
+		Errors map[string]string `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	var got []uint64
+	for _, filerecord := range body.Data {
+		if filerecord != nil {
+			got = append(got, filerecord.ID)
+		}
+	}
+	if fmt.Sprint(got) != "[2 3 4 5]" || len(body.Errors) != 1 || body.Errors["1"] == "" {
+		t.Errorf("readable = %v, errors = %v; want 2 to 5 and 1 not found", got, body.Errors)
+	}
+}
+
+func TestBulkUpdateTrimsTags(t *testing.T) {
+	var statements []string
+	db := scriptedDB(t, &scriptedConn{
+		query: func(string, []driver.Value) ([]string, [][]driver.Value) {
+			return []string{"id"}, [][]driver.Value{{int64(1)}}
+		},
+		exec: func(query string, args []driver.Value) int64 {
+			statements = append(statements, fmt.Sprint(query, args))
+			return 1
+		},
+	})
+	r := &Repository{DB: db, Files: filecache.New(10)}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	body := `{"ids": [1], "updates": {"add_tags": [" urgent "], "remove_tags": [" draft\t"]}}`
+	c.Request = httptest.NewRequest("PATCH", "/files", strings.NewReader(body))
+	r.bulkUpdateHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var inserted, deleted bool
+	for _, statement := range statements {
+		switch {
+		case strings.HasPrefix(statement, `INSERT INTO "file_tags"`):
+			inserted = strings.HasSuffix(statement, " urgent]")
+		case strings.HasPrefix(statement, `DELETE FROM "file_tags"`):
+			deleted = strings.HasSuffix(statement, " draft]")
+		}
+	}
+	if !inserted || !deleted {
+		t.Errorf("tags weren't trimmed in %q", statements)
+	}
+}
+
+func TestHooksReadInflatedContent(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 64 * 4)
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(t.TempDir(), "plain.png")
+	if err := os.WriteFile(plain, encoded.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := thumbnail.DHash(plain, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filerecord := storedFile(t, encoded.String(), true)
+	filerecord.Name, filerecord.Mimetype = "gradient.png", "image/png"
+	db := dryRunDB(t)
+	if err := (perceptualHashHook{db: db}).Process(context.Background(), &filerecord); err != nil {
+		t.Fatalf("perceptual hash: %v", err)
+	}
+	if filerecord.PerceptualHash == nil || uint64(*filerecord.PerceptualHash) != want {
+		t.Errorf("perceptual hash = %v, want %d", filerecord.PerceptualHash, want)
+	}
+	if err := (thumbnailHook{db: db, size: 16}).Process(context.Background(), &filerecord); err != nil {
+		t.Fatalf("thumbnail: %v", err)
+	}
+	dir := filepath.Dir(filerecord.StoragePath)
+	if _, err := os.Stat(filepath.Join(dir, "1.thumb.jpg")); err != nil {
+		t.Errorf("no thumbnail: %v", err)
+	}
+	if copies, _ := filepath.Glob(filepath.Join(dir, ".inflated-*")); len(copies) > 0 {
+		t.Errorf("inflated copies left behind: %v", copies)
+	}
+}
+
+// untouchedBody fails the test when a handler reads it.
+type untouchedBody struct{ t *testing.T }
+
+func (b untouchedBody) Read([]byte) (int, error) {
+	b.t.Error("the request body was read")
+	return 0, io.EOF
+}
+
+func (b untouchedBody) Close() error { return nil }
+
+func TestUploadRequiresMultipart(t *testing.T) {
+	tests := []struct {
+		contentType string
+		require     bool
+		status      int
+	}{
+		{"application/json", true, http.StatusUnsupportedMediaType},
+		{"", true, http.StatusUnsupportedMediaType},
+		{"multipart/mixed; boundary=x", true, http.StatusUnsupportedMediaType},
+		{"multipart/form-data; boundary", true, http.StatusUnsupportedMediaType},
+		// Without the check the multipart reader refuses them later.
+		{"application/json", false, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := &Repository{Config: &config.Config{RequireMultipart: tt.require}, Usage: &storageUsage{}}
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/files/upload", nil)
+		c.Request.Body = untouchedBody{t}
+		if tt.contentType != "" {
+			c.Request.Header.Set("Content-Type", tt.contentType)
+		}
+		r.uploadHandler(c)
+		if w.Code != tt.status {
+			t.Errorf("Content-Type %q, required %v: status = %d, want %d", tt.contentType, tt.require, w.Code, tt.status)
+		}
+	}
+
+	// A multipart/form-data upload gets past the check.
+	r := &Repository{
+		Config: &config.Config{RequireMultipart: true, StorageRoutes: []config.StorageRoute{{Prefix: "", Dir: t.TempDir()}}},
+		Usage:  &storageUsage{},
+		Events: events.NewHub(1, 1),
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = uploadRequest(t, [][2]string{{"a.txt", "aaa"}}, "")
+	c.Request.Header.Set("X-Expected-Sha256", sha256Hex("other"))
+	r.uploadHandler(c)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "sha256 mismatch") {
+		t.Errorf("multipart upload: status = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAtomicUploadRollsBack(t *testing.T) {
+	dir := t.TempDir()
+	defer func(dirs []string) { storageDirs = dirs }(storageDirs)
+	storageDirs = []string{dir}
+	var nextID int64
+	var deleted []string
+	db := scriptedDB(t, &scriptedConn{
+		query: func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+			switch {
+			case strings.HasPrefix(query, `INSERT INTO "files"`):
+				nextID++
+				return []string{"id"}, [][]driver.Value{{nextID}}
+			case strings.Contains(query, "count("):
+				return []string{"count"}, [][]driver.Value{{int64(0)}}
+			}
+			return nil, nil
+		},
+		exec: func(query string, args []driver.Value) int64 {
+			if strings.HasPrefix(query, `DELETE FROM "files"`) {
+				deleted = append(deleted, fmt.Sprint(args))
+			}
+			return 1
+		},
+	})
+	r := &Repository{
+		DB: db,
+		Config: &config.Config{
+			MetadataMaxBytes: 1 << 16,
+			StorageRoutes:    []config.StorageRoute{{Prefix: "", Dir: dir}},
+		},
+		// The first file fits, the second one doesn't.
+		Usage:  &storageUsage{limit: 5},
+		Events: events.NewHub(10, 1),
+		Files:  filecache.New(10),
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = uploadRequest(t, [][2]string{{"a.txt", "aaa"}, {"b.txt", "bbbb"}}, "")
+	// Chunked, the declared length would be refused before any file is
+	// stored.
+	c.Request.ContentLength = -1
+	r.uploadHandler(c)
+
+	if w.Code != http.StatusInsufficientStorage || !strings.Contains(w.Body.String(), `"file":"b.txt"`) {
+		t.Fatalf("status = %d, want 507 for b.txt: %s", w.Code, w.Body)
+	}
+	if fmt.Sprint(deleted) != "[[1]]" {
+		t.Errorf("deleted records %v, want the one of a.txt", deleted)
+	}
+	if used := r.Usage.total(); used != 0 {
+		t.Errorf("%d bytes still counted as used", used)
+	}
+	var left []string
+	filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			left = append(left, path)
+		}
+		return nil
+	})
+	if len(left) > 0 {
+		t.Errorf("files left in the storage: %v", left)
+	}
+	var kinds []string
+	for _, event := range r.Events.Recent() {
+		kinds = append(kinds, event.Type+":"+event.Status)
+	}
+	if got := strings.Join(kinds, " "); got != "upload:success upload:failed delete:rolled_back" {
+		t.Errorf("events = %s", got)
+	}
+}
+
+func TestCheckUploadEmptyFiles(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		size   int64
+		want   apierror.Code
+	}{
+		{config.EmptyUploadsReject, 0, apierror.EmptyFile},
+		{config.EmptyUploadsReject, 1, ""},
+		{config.EmptyUploadsAllow, 0, ""},
+	} {
+		r := &Repository{Config: &config.Config{EmptyUploads: tt.policy}}
+		uploaderr := r.checkUpload(pendingUpload{Name: "empty.txt", Size: tt.size})
+		var got apierror.Code
+		if uploaderr != nil {
+			got = uploaderr.code
+		}
+		if got != tt.want {
+			t.Errorf("%s, %d bytes: code %q, want %q", tt.policy, tt.size, got, tt.want)
+		}
+	}
+
+	r := &Repository{
+		Config: &config.Config{
+			EmptyUploads:  config.EmptyUploadsReject,
+			StorageRoutes: []config.StorageRoute{{Prefix: "", Dir: t.TempDir()}},
+		},
+		Usage:  &storageUsage{},
+		Events: events.NewHub(1, 1),
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = uploadRequest(t, [][2]string{{"a.txt", "aaa"}, {"empty.txt", ""}}, "")
+	r.uploadHandler(c)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"file":"empty.txt"`) {
+		t.Errorf("status = %d, want 400 for empty.txt: %s", w.Code, w.Body)
+	}
+	if code := apierror.Of(c, w.Code); code != apierror.EmptyFile {
+		t.Errorf("code = %s, want %s", code, apierror.EmptyFile)
+	}
+}
+
+func TestChunkedUploadOverTheLimit(t *testing.T) {
+	dir := t.TempDir()
+	r := &Repository{
+		Config: &config.Config{
+			MetadataMaxBytes: 1 << 16,
+			StorageRoutes:    []config.StorageRoute{{Prefix: "", Dir: dir}},
+		},
+		Usage:  &storageUsage{},
+		Events: events.NewHub(1, 1),
+	}
+	router := gin.New()
+	router.POST("/files/upload", middleware.BodyLimit(1024), r.uploadHandler)
+	req := uploadRequest(t, [][2]string{{"big.txt", strings.Repeat("x", 4096)}}, "")
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "exceeds 1024 bytes") {
+		t.Errorf("status = %d, want 413: %s", w.Code, w.Body)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("the partial file was kept: %v", entries)
+	}
+}
+
+// Every node serving the shared storage has to answer with the same
+// validators, whatever the mtime of its copy.
+func TestDownloadValidatorsAcrossNodes(t *testing.T) {
+	filerecord := storedFile(t, "notes content", false)
+	if err := os.Chtimes(filerecord.StoragePath, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	etag := `"` + filerecord.Sha256 + `"`
+	lastmodified := filerecord.CreatedAt.Format(http.TimeFormat)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+		body    string
+	}{
+		{"plain", nil, http.StatusOK, "notes content"},
+		{"range with a matching If-Range", map[string]string{"Range": "bytes=0-4", "If-Range": etag}, http.StatusPartialContent, "notes"},
+		{"range with the creation date", map[string]string{"Range": "bytes=6-", "If-Range": lastmodified}, http.StatusPartialContent, "content"},
+		{"range with a stale If-Range", map[string]string{"Range": "bytes=0-4", "If-Range": `"other"`}, http.StatusOK, "notes content"},
+		{"revalidation", map[string]string{"If-None-Match": etag}, http.StatusNotModified, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Repository{
+				DB:            dryRunDB(t),
+				Config:        &config.Config{NameTemplate: "{name}"},
+				Events:        events.NewHub(1, 1),
+				Files:         filecache.New(10),
+				Health:        dbhealth.NewMonitor(nil, time.Second),
+				UserDownloads: throttle.NewSlots(0),
+				FileDownloads: throttle.NewSlots(0),
+			}
+			r.Files.Put(filerecord)
+			c, w := testContext("/files/download/1")
+			c.Params = gin.Params{{Key: "id", Value: "1"}}
+			for name, value := range tt.headers {
+				c.Request.Header.Set(name, value)
+			}
+			r.downloadHandler(c)
+			// The engine does this for bodiless responses after the
+			// handlers.
+			c.Writer.WriteHeaderNow()
+			if w.Code != tt.status || w.Body.String() != tt.body {
+				t.Fatalf("status = %d, body %q; want %d, %q", w.Code, w.Body, tt.status, tt.body)
+			}
+			if got := w.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %s, want %s", got, etag)
+			}
+			// A 304 carries the ETag only, as net/http does.
+			if got := w.Header().Get("Last-Modified"); got != lastmodified && tt.status != http.StatusNotModified {
+				t.Errorf("Last-Modified = %s, want the creation time %s", got, lastmodified)
+			}
+		})
+	}
+}
+
+func TestPathID(t *testing.T) {
+	for param, want := range map[string]bool{
+		"1":                    true,
+		"18446744073709551615": true,
+		"0":                    true,
+		"":                     false,
+		"abc":                  false,
+		"-1":                   false,
+		"1.5":                  false,
+		"0x10":                 false,
+		"1 OR 1=1":             false,
+		"18446744073709551616": false,
+	} {
+		c, _ := testContext("/")
+		c.Params = gin.Params{{Key: "id", Value: param}}
+		if _, ok := pathID(c); ok != want {
+			t.Errorf("pathID(%q) ok = %v, want %v", param, ok, want)
+		}
+	}
+}
+
+func TestInvalidIDNeverQueries(t *testing.T) {
+	db := dryRunDB(t)
+	for _, callbacks := range []interface {
+		Register(string, func(*gorm.DB)) error
+	}{db.Callback().Query(), db.Callback().Update(), db.Callback().Delete()} {
+		callbacks.Register("test:no-queries", func(tx *gorm.DB) {
+			t.Errorf("queried with an invalid id: %s", tx.Statement.SQL.String())
+		})
+	}
+	r := &Repository{
+		DB:     db,
+		Config: &config.Config{},
+		Events: events.NewHub(1, 1),
+		Files:  filecache.New(10),
+		Health: dbhealth.NewMonitor(nil, time.Second),
+	}
+	handlers := map[string]gin.HandlerFunc{
+		"download":           r.downloadHandler,
+		"info":               r.fileInfoHandler,
+		"shares":             r.sharesListHandler,
+		"message files":      r.messageFilesHandler,
+		"quarantine release": r.quarantineReleaseHandler,
+		"quarantine purge":   r.quarantinePurgeHandler,
+	}
+	for name, handler := range handlers {
+		c, w := testContext("/files/abc")
+		c.Params = gin.Params{{Key: "id", Value: "abc"}}
+		handler(c)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid id") {
+			t.Errorf("%s: status = %d, want 400: %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestStorageRootOf(t *testing.T) {
+	base := t.TempDir()
+	first, second := filepath.Join(base, "storage"), filepath.Join(base, "archive")
+	defer func(dirs []string) { storageDirs = dirs }(storageDirs)
+	storageDirs = []string{first, second}
+	tests := []struct {
+		path string
+		root string
+	}{
+		{filepath.Join(first, "1"), first},
+		{filepath.Join(first, "ab", "cd", "1"), first},
+		{filepath.Join(second, "2"), second},
+		{filepath.Join(first, "..", "archive", "2"), second},
+		{first, ""},
+		{filepath.Join(first, ".."), ""},
+		{filepath.Join(first, "..", "secret"), ""},
+		{first + "-other/1", ""},
+		{"/etc/passwd", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		root, ok := storageRootOf(tt.path)
+		if root != tt.root || ok != (tt.root != "") {
+			t.Errorf("storageRootOf(%q) = %q, %v; want %q", tt.path, root, ok, tt.root)
+		}
+	}
+}
+
+func TestStoragePathOutsideStorage(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("not yours"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	filerecord := storedFile(t, "notes", false)
+	filerecord.StoragePath = filepath.Join(filepath.Dir(filerecord.StoragePath), "..", filepath.Base(filepath.Dir(outside)), "secret")
+	r := &Repository{
+		DB:            dryRunDB(t),
+		Config:        &config.Config{NameTemplate: "{name}"},
+		Events:        events.NewHub(1, 1),
+		Files:         filecache.New(10),
+		Usage:         &storageUsage{},
+		Health:        dbhealth.NewMonitor(nil, time.Second),
+		UserDownloads: throttle.NewSlots(0),
+		FileDownloads: throttle.NewSlots(0),
+	}
+	r.Files.Put(filerecord)
+	c, w := testContext("/files/download/1")
+	c.Params = gin.Params{{Key: "id", Value: "1"}}
+	r.downloadHandler(c)
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "not yours") {
+		t.Errorf("status = %d, want 500 without the content: %s", w.Code, w.Body)
+	}
+
+	r.removeStoredFiles(filerecord)
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("the file outside the storage was removed: %v", err)
+	}
+	if _, _, err := openContent(filerecord); !errors.Is(err, errOutsideStorage) {
+		t.Errorf("openContent() = %v, want errOutsideStorage", err)
+	}
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		ifMatch  string
+		affected int64
+		status   int
+		// condition is the sha256 the delete is made conditional on.
+		condition bool
+	}{
+		{"no precondition", "", 1, http.StatusOK, false},
+		{"matching ETag", `"SUM"`, 1, http.StatusOK, true},
+		{"one of several ETags", `"other", "SUM"`, 1, http.StatusOK, true},
+		{"any", "*", 1, http.StatusOK, false},
+		{"changed in the database meanwhile", `"SUM"`, 0, http.StatusPreconditionFailed, true},
+		{"gone meanwhile", "", 0, http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filerecord := storedFile(t, "notes", false)
+			filerecord.Owner = "alice"
+			var deletes []string
+			db := scriptedDB(t, &scriptedConn{
+				query: func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+					if strings.Contains(query, "count(") {
+						return []string{"count"}, [][]driver.Value{{int64(0)}}
+					}
+					return nil, nil
+				},
+				exec: func(query string, args []driver.Value) int64 {
+					if strings.HasPrefix(query, `DELETE FROM "files"`) {
+						deletes = append(deletes, fmt.Sprint(query, args))
+						return tt.affected
+					}
+					return 1
+				},
+			})
+			r := &Repository{DB: db, Events: events.NewHub(1, 1), Files: filecache.New(10), Usage: &storageUsage{}}
+			r.Files.Put(filerecord)
+			c, w := testContext("/files/1")
+			c.Request.Method = http.MethodDelete
+			c.Params = gin.Params{{Key: "id", Value: "1"}}
+			c.Request.Header.Set("Authorization", "Bearer alice-token")
+			if tt.ifMatch != "" {
+				c.Request.Header.Set("If-Match", strings.ReplaceAll(tt.ifMatch, "SUM", filerecord.Sha256))
+			}
+			middleware.UserAuth(map[string]scope.Token{"alice-token": {User: "alice", Scopes: scope.Default}}, "")(c)
+			r.deleteHandler(c)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if len(deletes) != 1 {
+				t.Fatalf("deletes = %q, want one", deletes)
+			}
+			if conditional := strings.Contains(deletes[0], filerecord.Sha256); conditional != tt.condition {
+				t.Errorf("delete %q conditional on the sha256: %v, want %v", deletes[0], conditional, tt.condition)
+			}
+			_, err := os.Stat(filerecord.StoragePath)
+			if removed := os.IsNotExist(err); removed != (tt.status == http.StatusOK) {
+				t.Errorf("stored file removed: %v", removed)
+			}
+		})
+	}
+
+	// A stale ETag is refused before anything is deleted.
+	filerecord := storedFile(t, "notes", false)
+	filerecord.Owner = "alice"
+	db := dryRunDB(t)
+	db.Callback().Delete().Register("test:no-deletes", func(tx *gorm.DB) {
+		t.Error("deleted with a stale If-Match")
+	})
+	r := &Repository{DB: db, Events: events.NewHub(1, 1), Files: filecache.New(10), Usage: &storageUsage{}}
+	r.Files.Put(filerecord)
+	c, w := testContext("/files/1")
+	c.Params = gin.Params{{Key: "id", Value: "1"}}
+	c.Request.Header.Set("Authorization", "Bearer alice-token")
+	c.Request.Header.Set("If-Match", `"`+sha256Hex("older")+`", W/"`+filerecord.Sha256+`"`)
+	middleware.UserAuth(map[string]scope.Token{"alice-token": {User: "alice", Scopes: scope.Default}}, "")(c)
+	r.deleteHandler(c)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale If-Match: status = %d, want 412", w.Code)
+	}
+}
+
+// A client sending Expect: 100-continue only uploads the body once the
+// handler reads it, everything decided from the headers must come first.
+func TestUploadRejectedBeforeBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  int64
+		limit   int64
+		header  [2]string
+		healthy bool
+		status  int
+	}{
+		{"read-only", 1000, 0, [2]string{}, false, http.StatusServiceUnavailable},
+		{"declared size over the body limit", 2048, 0, [2]string{}, true, http.StatusRequestEntityTooLarge},
+		{"declared size over the storage limit", 1000, 512, [2]string{}, true, http.StatusInsufficientStorage},
+		{"not multipart", 1000, 0, [2]string{"Content-Type", "application/json"}, true, http.StatusUnsupportedMediaType},
+		{"unknown upload session", 1000, 0, [2]string{"X-Upload-Session", "missing"}, true, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Repository{
+				// No upload session is found.
+				DB:     scriptedDB(t, &scriptedConn{}),
+				Config: &config.Config{RequireMultipart: true},
+				Usage:  &storageUsage{limit: tt.limit},
+				Events: events.NewHub(1, 1),
+			}
+			router := gin.New()
+			router.POST("/files/upload",
+				middleware.ReadOnly(func() bool { return tt.healthy }),
+				middleware.BodyLimit(1024),
+				r.uploadHandler)
+			req := httptest.NewRequest("POST", "/files/upload", nil)
+			req.Body = untouchedBody{t}
+			req.ContentLength = tt.length
+			req.Header.Set("Expect", "100-continue")
+			req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+			if tt.header[0] != "" {
+				req.Header.Set(tt.header[0], tt.header[1])
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestFileStatus(t *testing.T) {
+	scanned := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	resized := scanned.Add(time.Minute)
+	tests := []struct {
+		name       string
+		status     string
+		quarantine bool
+		runs       [][]driver.Value
+		complete   bool
+		steps      string
+	}{
+		{"nothing to run", StatusReady, false, nil, true, ""},
+		{"scanned", StatusReady, true, nil, true, "scan:done"},
+		{"waiting for the scan", StatusQuarantined, true, nil, false, "scan:pending"},
+		{"infected", StatusInfected, true, nil, true, "scan:failed"},
+		{"hook running", StatusReady, true, [][]driver.Value{
+			{int64(1), "thumbnail", HookDone, "", int64(1), scanned},
+			{int64(1), "webp", HookRunning, "", int64(1), resized},
+		}, false, "scan:done thumbnail:done webp:running"},
+		{"hook failed", StatusReady, false, [][]driver.Value{
+			{int64(1), "thumbnail", HookFailed, "decode image", int64(3), scanned},
+		}, true, "thumbnail:failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := scriptedDB(t, &scriptedConn{query: func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+				switch {
+				case strings.Contains(query, `"hook_runs"`):
+					return []string{"file_id", "hook", "state", "error", "attempts", "updated_at"}, tt.runs
+				case strings.Contains(query, `"file_variants"`):
+					return []string{"kind"}, [][]driver.Value{{"thumbnail"}}
+				}
+				return nil, nil
+			}})
+			r := &Repository{DB: db, Config: &config.Config{QuarantineEnabled: tt.quarantine}, Files: filecache.New(10)}
+			r.Files.Put(Files{ID: 1, Status: tt.status})
+			c, w := testContext("/files/1/status")
+			c.Params = gin.Params{{Key: "id", Value: "1"}}
+			r.fileStatusHandler(c)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			var body struct {
+				Complete bool                      `json:"complete"`
+				Steps    map[string]processingStep `json:"steps"`
+				Variants []string                  `json:"variants"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			var steps []string
+			for name, step := range body.Steps {
+				steps = append(steps, name+":"+step.State)
+			}
+			sort.Strings(steps)
+			if got := strings.Join(steps, " "); got != tt.steps {
+				t.Errorf("steps = %q, want %q", got, tt.steps)
+			}
+			if body.Complete != tt.complete {
+				t.Errorf("complete = %v, want %v", body.Complete, tt.complete)
+			}
+			if fmt.Sprint(body.Variants) != "[thumbnail]" {
+				t.Errorf("variants = %v", body.Variants)
+			}
+			for _, run := range tt.runs {
+				step := body.Steps[run[1].(string)]
+				if step.UpdatedAt == nil || !step.UpdatedAt.Equal(run[5].(time.Time)) || step.Error != run[3] {
+					t.Errorf("%s: step = %+v, want the stored run", run[1], step)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageFilesRespectAccess(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	db := scriptedDB(t, &scriptedConn{query: func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		switch {
+		case strings.Contains(query, `FROM "messages"`):
+			return []string{"id", "sender"}, [][]driver.Value{{int64(7), "alice"}}
+		case strings.Contains(query, "count("):
+			return []string{"count"}, [][]driver.Value{{int64(1)}}
+		case strings.Contains(query, "message_attachments"):
+			return []string{"id", "name", "owner", "status", "expires_at"}, [][]driver.Value{
+				{int64(1), "own.txt", "alice", StatusReady, nil},
+				// Shared with alice by carol, never with the recipients.
+				{int64(2), "carol.txt", "carol", StatusReady, nil},
+				{int64(3), "pending.txt", "alice", StatusQuarantined, nil},
+				{int64(4), "old.txt", "alice", StatusReady, past},
+			}
+		case strings.Contains(query, `"file_shares"`):
+			// The message shared alice's files with bob.
+			return []string{"file_id"}, [][]driver.Value{{int64(1)}, {int64(3)}, {int64(4)}}
+		}
+		return nil, nil
+	}})
+	r := &Repository{DB: db, Config: &config.Config{}}
+	c, w := testContext("/messages/7/files")
+	c.Params = gin.Params{{Key: "id", Value: "7"}}
+	c.Request.Header.Set("Authorization", "Bearer bob-token")
+	middleware.UserAuth(map[string]scope.Token{"bob-token": {User: "bob", Scopes: scope.Default}}, "")(c)
+	r.messageFilesHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Data []attachment `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Data) != 1 || body.Data[0].ID != 1 || !strings.HasSuffix(body.Data[0].DownloadURL, "/files/download/1") {
+		t.Errorf("attachments = %+v, want only file 1", body.Data)
+	}
+	if strings.Contains(w.Body.String(), "carol") {
+		t.Errorf("response mentions the file shared with the sender only: %s", w.Body)
+	}
+}
+
+func TestDedupeLocksCanonicalBlob(t *testing.T) {
+	first := storedFile(t, "duplicate", false)
+	dir := filepath.Dir(first.StoragePath)
+	second := filepath.Join(dir, "copy")
+	if err := os.WriteFile(second, []byte("duplicate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{filepath.Join(dir, "missing"), first.StoragePath, second}
+	var statements []string
+	db := scriptedDB(t, &scriptedConn{
+		query: func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+			switch {
+			case strings.Contains(query, "string_agg"):
+				return []string{"sha256", "count", "copies", "wasted_bytes", "member_ids"},
+					[][]driver.Value{{first.Sha256, int64(3), int64(3), int64(18), "1,2,3"}}
+			case strings.Contains(query, "count("):
+				return []string{"count"}, [][]driver.Value{{int64(0)}}
+			}
+			var rows [][]driver.Value
+			for i, path := range paths {
+				rows = append(rows, []driver.Value{int64(i + 1), first.Sha256, path})
+			}
+			return []string{"id", "sha256", "storage_path"}, rows
+		},
+		exec: func(query string, args []driver.Value) int64 {
+			if strings.Contains(query, "pg_advisory_xact_lock") {
+				statements = append(statements, fmt.Sprint("lock ", args[0]))
+				// A delete of the first stored copy took the lock
+				// first and removed its blob.
+				if args[0] == first.StoragePath {
+					os.Remove(first.StoragePath)
+				}
+			} else if strings.HasPrefix(query, `UPDATE "files"`) {
+				statements = append(statements, fmt.Sprint("update ", args[1]))
+			}
+			return 1
+		},
+	})
+	r := &Repository{DB: db}
+	c, w := testContext("/admin/dedupe")
+	c.Request.Method = http.MethodPost
+	r.dedupeHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	want := []string{"lock " + paths[0], "lock " + paths[1], "lock " + second, "update " + second}
+	if got := statements[:min(len(statements), len(want))]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("statements = %q, want them to start with %q", statements, want)
+	}
+	if _, err := os.Stat(second); err != nil {
+		t.Errorf("the blob the group points at is gone: %v", err)
+	}
+}
+
+func TestIdempotentUploadReplaysRedirect(t *testing.T) {
+	dir := t.TempDir()
+	defer func(dirs []string) { storageDirs = dirs }(storageDirs)
+	storageDirs = []string{dir}
+	var inserts int64
+	db := scriptedDB(t, &scriptedConn{query: func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		switch {
+		case strings.HasPrefix(query, `INSERT INTO "files"`):
+			inserts++
+			return []string{"id"}, [][]driver.Value{{inserts}}
+		case strings.Contains(query, "count("):
+			return []string{"count"}, [][]driver.Value{{int64(0)}}
+		}
+		return nil, nil
+	}})
+	r := &Repository{
+		DB: db,
+		Config: &config.Config{
+			MetadataMaxBytes: 1 << 16,
+			StorageRoutes:    []config.StorageRoute{{Prefix: "", Dir: dir}},
+		},
+		Usage:  &storageUsage{limit: 1 << 20},
+		Events: events.NewHub(10, 1),
+		Files:  filecache.New(10),
+		Hooks:  hooks.NewPool(db, 1, 1, time.Second, 1, 0),
+	}
+	router := gin.New()
+	router.POST("/files/upload", middleware.Idempotency(idempotency.NewStore(time.Minute)), r.uploadHandler)
+
+	var locations []string
+	for range 2 {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("redirect", "/done")
+		part, _ := form.CreateFormFile("file", "a.txt")
+		part.Write([]byte("aaa"))
+		form.Close()
+		req := httptest.NewRequest("POST", "/files/upload", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Sec-Fetch-Mode", "navigate")
+		req.Header.Set("Idempotency-Key", "form-1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("status = %d, want 303: %s", w.Code, w.Body)
+		}
+		locations = append(locations, w.Header().Get("Location"))
+	}
+	if inserts != 1 {
+		t.Errorf("%d records created, want 1", inserts)
+	}
+	if locations[0] != "/done?file_id=1" || locations[1] != locations[0] {
+		t.Errorf("locations = %q, want the replay to redirect like the upload", locations)
+	}
+}
+
+func TestByteRangeChunksTakeOneDownload(t *testing.T) {
+	filerecord := storedFile(t, "0123456789", false)
+	remaining := int64(1)
+	db := scriptedDB(t, &scriptedConn{query: func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		switch {
+		case strings.HasPrefix(query, `UPDATE "files"`) && strings.Contains(query, "downloads_remaining"):
+			if remaining == 0 {
+				return nil, nil
+			}
+			remaining--
+			return []string{"downloads_remaining"}, [][]driver.Value{{remaining}}
+		case strings.Contains(query, `FROM "files"`):
+			return []string{"id", "name", "storage_path", "size", "sha256", "status", "max_downloads", "downloads_remaining"},
+				[][]driver.Value{{int64(1), filerecord.Name, filerecord.StoragePath, int64(filerecord.Size), filerecord.Sha256, StatusReady, int64(1), remaining}}
+		}
+		return nil, nil
+	}})
+	r := &Repository{
+		DB:            db,
+		Config:        &config.Config{},
+		Events:        events.NewHub(10, 1),
+		Files:         filecache.New(10),
+		Health:        dbhealth.NewMonitor(nil, time.Second),
+		UserDownloads: throttle.NewSlots(0),
+		FileDownloads: throttle.NewSlots(0),
+	}
+	// Taking the download drops the cached record, as it does in the
+	// server, so each chunk sees the remaining downloads.
+	if err := r.Files.Register(db); err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(start, end int) *httptest.ResponseRecorder {
+		c, w := testContext(fmt.Sprintf("/files/1/bytes?start=%d&end=%d", start, end))
+		c.Params = gin.Params{{Key: "id", Value: "1"}}
+		r.byteRangeHandler(c)
+		return w
+	}
+
+	var content string
+	for _, chunk := range [][2]int{{0, 3}, {4, 7}, {8, 9}} {
+		w := fetch(chunk[0], chunk[1])
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("chunk %v: status = %d: %s", chunk, w.Code, w.Body)
+		}
+		content += w.Body.String()
+	}
+	if content != "0123456789" {
+		t.Errorf("chunks = %q", content)
+	}
+	if remaining != 0 {
+		t.Errorf("downloads remaining = %d, want the first chunk to take the only one", remaining)
+	}
+	if w := fetch(0, 9); w.Code != http.StatusGone {
+		t.Errorf("new fetch of the exhausted file: status = %d, want 410", w.Code)
+	}
+}
+
+func TestArchiveEntryNames(t *testing.T) {
+	path := storedFile(t, "x", false).StoragePath
+	// The second x is renamed to the name file 3 already has, the file
+	// named like the manifest makes way for it.
+	records := [][]driver.Value{
+		{int64(1), "x", path, StatusReady},
+		{int64(2), "x", path, StatusReady},
+		{int64(3), "2_x", path, StatusReady},
+		{int64(4), "MANIFEST.json", path, StatusReady},
+	}
+	db := scriptedDB(t, &scriptedConn{query: func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		return []string{"id", "name", "storage_path", "status"}, records
+	}})
+	r := &Repository{DB: db, Config: &config.Config{}, Events: events.NewHub(10, 1), Health: dbhealth.NewMonitor(nil, time.Second)}
+	c, w := testContext("/files/download.tar?ids=3,1,2,4")
+	r.tarDownloadHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var names []string
+	tr := tar.NewReader(w.Body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+	want := "[2_x x 2-2_x 4_MANIFEST.json MANIFEST.json]"
+	if fmt.Sprint(names) != want {
+		t.Errorf("entries = %v, want %s", names, want)
+	}
+
+	if got := archiveEntryName(map[string]bool{"2021-01-01/x": true}, "2021-01-01/", 7, "a/x"); got != "2021-01-01/7_x" {
+		t.Errorf("archiveEntryName() = %s, want it in the day directory", got)
+	}
+}
+
+func TestSnapshotHoldsMessages(t *testing.T) {
+	db := scriptedDB(t, &scriptedConn{query: func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		switch {
+		case strings.Contains(query, `FROM "messages"`):
+			return []string{"id", "sender"}, [][]driver.Value{{int64(7), "alice"}}
+		case strings.Contains(query, `FROM "message_recipients"`):
+			return []string{"message_id", "user_id"}, [][]driver.Value{{int64(7), "bob"}}
+		case strings.Contains(query, `FROM "message_attachments"`):
+			return []string{"message_id", "file_id"}, [][]driver.Value{{int64(7), int64(1)}}
+		}
+		return nil, nil
+	}})
+	s := &snapshotter{db: db, dir: t.TempDir()}
+	old := filepath.Join(s.dir, snapshotPrefix+"20260102T030405Z"+snapshotSuffix)
+	if err := os.WriteFile(old, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both snapshots are taken within the same second.
+	first, err := s.take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Name == second.Name {
+		t.Fatalf("both snapshots are named %s", first.Name)
+	}
+	for _, table := range []string{"messages", "message_recipients", "message_attachments"} {
+		if first.Rows[table] != 1 {
+			t.Errorf("%d rows of %s, want 1", first.Rows[table], table)
+		}
+	}
+
+	snapshots, err := s.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+	if want := fmt.Sprint([]string{second.Name, first.Name, filepath.Base(old)}); fmt.Sprint(names) != want {
+		t.Errorf("snapshots = %v, want %v", names, want)
+	}
+	if !snapshots[0].CreatedAt.Equal(second.CreatedAt) {
+		t.Errorf("listed at %v, taken at %v", snapshots[0].CreatedAt, second.CreatedAt)
+	}
+}
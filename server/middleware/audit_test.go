@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAudit(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	router := gin.New()
+	group := router.Group("/files", Audit(), UserAuth(testTokens, "root"), MethodScope(nil))
+	group.Any("/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	tests := []struct {
+		method string
+		token  string
+		audit  string
+	}{
+		{"GET", "reader", ""},
+		{"POST", "writer", `Audit: POST /files/1 status=200 user="bob" required=write scopes=read+write`},
+		{"DELETE", "reader", `Audit: DELETE /files/1 status=403 user="alice" required=delete scopes=read`},
+		{"PUT", "root", `Audit: PUT /files/1 status=200 user="admin" required=write`},
+		{"POST", "", ""},
+	}
+	for _, tt := range tests {
+		logged.Reset()
+		req := httptest.NewRequest(tt.method, "/files/1", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		line := logged.String()
+		if tt.audit == "" && line != "" || !strings.Contains(line, tt.audit) {
+			t.Errorf("%s with %q logged %q, want %q", tt.method, tt.token, line, tt.audit)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"messangere/apierror"
+	"messangere/scope"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	token, found := strings.CutPrefix(header, "Bearer ")
+	if !found {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// AdminAuth guards the admin routes with the shared admin token or an API
+// token with the admin scope. When neither is configured the admin API
+// stays disabled.
+func AdminAuth(adminToken string, tokens map[string]scope.Token) gin.HandlerFunc {
+	enabled := adminToken != ""
+	for _, t := range tokens {
+		enabled = enabled || t.Scopes.Has(scope.Admin)
+	}
+	return func(c *gin.Context) {
+		c.Set(requiredKey, scope.Admin)
+		if !enabled {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"message": "admin api is disabled",
+			})
+			return
+		}
+		token := bearerToken(c)
+		if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			c.Set(adminKey, true)
+			c.Set(scopesKey, scope.All)
+			c.Next()
+			return
+		}
+		t, ok := tokens[token]
+		if token == "" || !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"message": "unauthorized",
+			})
+			return
+		}
+		c.Set(userKey, t.User)
+		c.Set(scopesKey, t.Scopes)
+		if !t.Scopes.Has(scope.Admin) {
+			missingScope(c, scope.Admin)
+			return
+		}
+		c.Set(adminKey, true)
+		c.Next()
+	}
+}
+
+const (
+	userKey     = "user"
+	adminKey    = "admin"
+	scopesKey   = "scopes"
+	requiredKey = "scope.required"
+)
+
+// UserAuth identifies the caller from the bearer token. Requests without a
+// token stay anonymous and an unknown token is rejected. The admin token is
+// accepted as well so admin-only routes can live next to user routes.
+func UserAuth(tokens map[string]scope.Token, adminToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			c.Next()
+			return
+		}
+		if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			c.Set(adminKey, true)
+			c.Set(scopesKey, scope.All)
+			c.Next()
+			return
+		}
+		t, ok := tokens[token]
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"message": "unauthorized",
+			})
+			return
+		}
+		c.Set(userKey, t.User)
+		c.Set(scopesKey, t.Scopes)
+		if t.Scopes.Has(scope.Admin) {
+			c.Set(adminKey, true)
+		}
+		c.Next()
+	}
+}
+
+// MethodScope requires the scope a request needs from its token: read for
+// GET and HEAD and the POST routes in reads, which only look things up,
+// delete for DELETE and write for everything else. The admin scope covers
+// all of them. Requests without a token may do what anonymous allows, so
+// dropping a read-only token doesn't give write access.
+func MethodScope(anonymous scope.Set, reads ...string) gin.HandlerFunc {
+	readRoutes := make(map[string]bool, len(reads))
+	for _, route := range reads {
+		readRoutes[route] = true
+	}
+	return func(c *gin.Context) {
+		required := scope.Write
+		switch {
+		case c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || readRoutes[c.FullPath()]:
+			required = scope.Read
+		case c.Request.Method == http.MethodDelete:
+			required = scope.Delete
+		}
+		c.Set(requiredKey, required)
+		set, authenticated := c.Get(scopesKey)
+		scopes, _ := set.(scope.Set)
+		if !authenticated {
+			scopes = anonymous
+		}
+		if !scopes.Has(required) && !scopes.Has(scope.Admin) {
+			missingScope(c, required)
+			return
+		}
+		c.Next()
+	}
+}
+
+// missingScope answers 403 naming the scope the token lacks, or 401 when
+// the request came without a token.
+func missingScope(c *gin.Context, required scope.Scope) {
+	apierror.Set(c, apierror.InsufficientScope)
+	if _, authenticated := c.Get(scopesKey); !authenticated {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"message":        fmt.Sprintf("this request needs a token with the %s scope", required),
+			"required_scope": required,
+		})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"message":        fmt.Sprintf("this token lacks the %s scope", required),
+		"required_scope": required,
+	})
+}
+
+// CurrentUser returns the authenticated user or "" for anonymous callers.
+func CurrentUser(c *gin.Context) string {
+	return c.GetString(userKey)
+}
+
+// IsAdmin reports whether the request was made with the admin token or a
+// token with the admin scope.
+func IsAdmin(c *gin.Context) bool {
+	return c.GetBool(adminKey)
+}
+
+// Scopes returns the scopes of the token the request was made with, nil
+// for anonymous callers.
+func Scopes(c *gin.Context) scope.Set {
+	scopes, _ := c.Get(scopesKey)
+	set, _ := scopes.(scope.Set)
+	return set
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"messangere/scope"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+var testTokens = map[string]scope.Token{
+	"reader":  {User: "alice", Scopes: scope.Set{scope.Read}},
+	"writer":  {User: "bob", Scopes: scope.Set{scope.Read, scope.Write}},
+	"deleter": {User: "carol", Scopes: scope.Set{scope.Delete}},
+	"admin":   {User: "dave", Scopes: scope.Set{scope.Admin}},
+}
+
+// scopedRouter serves every method on /files/:id and on the read route
+// /files/lookup behind UserAuth and MethodScope.
+func scopedRouter(anonymous scope.Set) *gin.Engine {
+	router := gin.New()
+	group := router.Group("/files", UserAuth(testTokens, "root"), MethodScope(anonymous, "/files/lookup"))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	group.Any("/:id", ok)
+	group.POST("/lookup", ok)
+	return router
+}
+
+func TestMethodScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		anonymous scope.Set
+		method    string
+		path      string
+		token     string
+		want      int
+	}{
+		{"reader reads", nil, "GET", "/files/1", "reader", http.StatusOK},
+		{"reader heads", nil, "HEAD", "/files/1", "reader", http.StatusOK},
+		{"reader uses a read route", nil, "POST", "/files/lookup", "reader", http.StatusOK},
+		{"reader can't write", nil, "POST", "/files/1", "reader", http.StatusForbidden},
+		{"reader can't delete", nil, "DELETE", "/files/1", "reader", http.StatusForbidden},
+		{"writer writes", nil, "PATCH", "/files/1", "writer", http.StatusOK},
+		{"writer can't delete", nil, "DELETE", "/files/1", "writer", http.StatusForbidden},
+		{"deleter deletes", nil, "DELETE", "/files/1", "deleter", http.StatusOK},
+		{"deleter can't read", nil, "GET", "/files/1", "deleter", http.StatusForbidden},
+		{"admin scope covers all", nil, "DELETE", "/files/1", "admin", http.StatusOK},
+		{"admin token covers all", nil, "PUT", "/files/1", "root", http.StatusOK},
+		{"unknown token", scope.Default, "GET", "/files/1", "nope", http.StatusUnauthorized},
+		{"anonymous without tokens writes", scope.Anonymous(false), "POST", "/files/1", "", http.StatusOK},
+		{"anonymous with tokens reads", scope.Anonymous(true), "GET", "/files/1", "", http.StatusOK},
+		{"anonymous with tokens can't write", scope.Anonymous(true), "POST", "/files/1", "", http.StatusUnauthorized},
+		{"anonymous with tokens can't delete", scope.Anonymous(true), "DELETE", "/files/1", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			scopedRouter(tt.anonymous).ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		adminToken string
+		token      string
+		want       int
+	}{
+		{"admin token", "root", "root", http.StatusOK},
+		{"token with the admin scope", "", "admin", http.StatusOK},
+		{"token without the admin scope", "root", "writer", http.StatusForbidden},
+		{"no token", "root", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/admin", AdminAuth(tt.adminToken, testTokens), func(c *gin.Context) {
+				if !IsAdmin(c) {
+					t.Error("request isn't marked as admin")
+				}
+				c.Status(http.StatusOK)
+			})
+			req := httptest.NewRequest("GET", "/admin", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	router := gin.New()
+	router.GET("/admin", AdminAuth("", map[string]scope.Token{"reader": testTokens["reader"]}))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("admin api without an admin token: status = %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BodyLimit caps the request body at limit bytes. Requests announcing a
+// larger Content-Length are rejected up front; chunked bodies, which carry
+// no length, are counted while the handler reads them and fail with an
+// *http.MaxBytesError once the cap is crossed. The up-front check never
+// reads the body, so a client waiting for "100 Continue" gets the 413 right
+// away. A limit of zero or less disables the check.
+func BodyLimit(limit int64) gin.HandlerFunc {
+	if limit <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+				"message": "request body is too large",
+			})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBodyLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int64
+		body   string
+		length int64
+		status int
+		read   string
+	}{
+		{"announced length over the limit", 4, "hello", 5, http.StatusRequestEntityTooLarge, ""},
+		{"announced length within the limit", 5, "hello", 5, http.StatusOK, "hello"},
+		{"chunked body within the limit", 5, "hello", -1, http.StatusOK, "hello"},
+		{"chunked body over the limit", 4, "hello", -1, http.StatusRequestEntityTooLarge, "hell"},
+		{"no limit", 0, "hello", -1, http.StatusOK, "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var read string
+			router := gin.New()
+			router.POST("/upload", BodyLimit(tt.limit), func(c *gin.Context) {
+				data, err := io.ReadAll(c.Request.Body)
+				read = string(data)
+				var maxerr *http.MaxBytesError
+				if errors.As(err, &maxerr) {
+					c.Status(http.StatusRequestEntityTooLarge)
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+			req := httptest.NewRequest("POST", "/upload", strings.NewReader(tt.body))
+			req.ContentLength = tt.length
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.status || read != tt.read {
+				t.Errorf("status = %d, read %q; want %d, %q", w.Code, read, tt.status, tt.read)
+			}
+		})
+	}
+}
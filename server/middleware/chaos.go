@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Chaos makes the wrapped routes slow and flaky so clients can exercise
+// their retry and timeout logic: every request is delayed by up to
+// latency, fails with a 503 with probability errorRate and has its
+// connection closed without a response with probability dropRate.
+func Chaos(latency time.Duration, errorRate, dropRate float64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if latency > 0 {
+			select {
+			case <-time.After(rand.N(latency)):
+			case <-c.Request.Context().Done():
+				c.Abort()
+				return
+			}
+		}
+		roll := rand.Float64()
+		if roll < dropRate {
+			if conn, _, err := c.Writer.Hijack(); err == nil {
+				conn.Close()
+				c.Abort()
+				return
+			}
+		}
+		if roll < dropRate+errorRate {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"message": "chaos mode: injected failure",
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"messangere/apierror"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorCodes gives every error response a stable code. The code is sent in
+// the X-Error-Code header, and JSON error bodies of the form
+// {"message": ...} also get {"error": {"code": ..., "message": ...}}; the
+// other fields, message included, are kept for older clients. Handlers pick
+// a specific code with apierror.Set, otherwise it follows from the status.
+func ErrorCodes() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w := &errorWriter{ResponseWriter: c.Writer, c: c}
+		c.Writer = w
+		c.Next()
+		w.flush()
+	}
+}
+
+// errorWriter holds back JSON error bodies until the handler is done, they
+// are small, and passes everything else through.
+type errorWriter struct {
+	gin.ResponseWriter
+	c         *gin.Context
+	started   bool
+	buffering bool
+	body      bytes.Buffer
+}
+
+func (w *errorWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	status := w.Status()
+	if status < http.StatusBadRequest {
+		return
+	}
+	w.Header().Set("X-Error-Code", string(apierror.Of(w.c, status)))
+	w.buffering = strings.HasPrefix(w.Header().Get("Content-Type"), gin.MIMEJSON)
+}
+
+func (w *errorWriter) Write(p []byte) (int, error) {
+	w.start()
+	if w.buffering {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *errorWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *errorWriter) WriteHeaderNow() {
+	w.start()
+	if !w.buffering {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *errorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *errorWriter) flush() {
+	if !w.buffering {
+		return
+	}
+	w.buffering = false
+	w.Header().Del("Content-Length")
+	data := w.body.Bytes()
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err == nil {
+		if message, ok := body["message"].(string); ok {
+			body["error"] = gin.H{
+				"code":    apierror.Of(w.c, w.Status()),
+				"message": message,
+			}
+			if encoded, err := json.Marshal(body); err == nil {
+				data = encoded
+			}
+		}
+	}
+	w.ResponseWriter.Write(data)
+}
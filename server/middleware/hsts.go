@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HSTS sets Strict-Transport-Security on responses served over TLS. A
+// maxAge of zero or less disables the header.
+func HSTS(maxAge time.Duration) gin.HandlerFunc {
+	if maxAge <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	value := "max-age=" + strconv.FormatInt(int64(maxAge.Seconds()), 10)
+	return func(c *gin.Context) {
+		if c.Request.TLS != nil {
+			c.Header("Strict-Transport-Security", value)
+		}
+		c.Next()
+	}
+}
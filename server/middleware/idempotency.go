@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"messangere/idempotency"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// replayedHeaders are stored with a response and sent again on a replay.
+// A redirect without its Location would leave a retried form post on an
+// empty page.
+var replayedHeaders = []string{"Location"}
+
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotencyScope keeps keys of different callers apart: the bearer token
+// identifies the caller when present, the client address otherwise.
+func idempotencyScope(c *gin.Context) string {
+	caller := bearerToken(c)
+	if caller == "" {
+		caller = "ip:" + c.ClientIP()
+	}
+	sum := sha256.Sum256([]byte(caller))
+	return hex.EncodeToString(sum[:])
+}
+
+// Idempotency replays the stored response when a request repeats an
+// Idempotency-Key already processed for the same caller. Server errors are
+// not stored so the client can retry them.
+func Idempotency(store *idempotency.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"message": "idempotency key is too long",
+			})
+			return
+		}
+		key = idempotencyScope(c) + ":" + key
+
+		response, inFlight, reserved := store.Begin(key)
+		if !reserved {
+			if inFlight {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+					"message": "a request with this idempotency key is still in progress",
+				})
+				return
+			}
+			for name, values := range response.Header {
+				c.Writer.Header()[name] = values
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(response.Status, response.ContentType, response.Body)
+			c.Abort()
+			return
+		}
+
+		completed := false
+		defer func() {
+			if !completed {
+				store.Release(key)
+			}
+		}()
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		if writer.Status() >= http.StatusInternalServerError {
+			return
+		}
+		completed = true
+		header := http.Header{}
+		for _, name := range replayedHeaders {
+			if values := writer.Header().Values(name); len(values) > 0 {
+				header[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+		store.Complete(key, &idempotency.Response{
+			Status:      writer.Status(),
+			ContentType: writer.Header().Get("Content-Type"),
+			Header:      header,
+			Body:        writer.body.Bytes(),
+		})
+	}
+}
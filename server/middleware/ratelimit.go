@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit allows at most limit requests per interval across all callers of
+// the wrapped routes, refilling tokens continuously. A limit of zero or less
+// disables the check.
+func RateLimit(limit int, interval time.Duration) gin.HandlerFunc {
+	if limit <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	var mu sync.Mutex
+	tokens := float64(limit)
+	last := time.Now()
+	rate := float64(limit) / interval.Seconds()
+
+	return func(c *gin.Context) {
+		mu.Lock()
+		now := time.Now()
+		tokens = math.Min(float64(limit), tokens+now.Sub(last).Seconds()*rate)
+		last = now
+		if tokens < 1 {
+			wait := math.Ceil((1 - tokens) / rate)
+			mu.Unlock()
+			c.Header("Retry-After", strconv.Itoa(int(wait)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"message": "rate limit exceeded",
+			})
+			return
+		}
+		tokens--
+		mu.Unlock()
+		c.Next()
+	}
+}
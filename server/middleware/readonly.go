@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"messangere/apierror"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadOnly refuses requests that would write while healthy reports false.
+// GET, HEAD and OPTIONS requests pass through.
+func ReadOnly(healthy func() bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if !healthy() {
+			c.Header("Retry-After", "30")
+			apierror.Set(c, apierror.ReadOnly)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"message": "database is unavailable, the server is read-only",
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Recovery answers 500 when a handler panics and logs the panic with the
+// request headers masked by redactor. gin.Recovery dumps the request with
+// only Authorization masked, file passwords and cookies would end up in
+// the log.
+func Recovery(redactor Redactor) gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(nil, func(c *gin.Context, err any) {
+		log.Printf("Panic serving %s %s: %v headers: %s\n%s",
+			c.Request.Method, c.Request.URL.Path, err, redactor.Headers(c.Request.Header), debug.Stack())
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultRedactedHeaders are masked in logs regardless of configuration.
+var DefaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-File-Password",
+	"X-Api-Key",
+}
+
+// Redactor formats request headers for logs with the values of sensitive
+// headers replaced by ***, so their presence is still visible.
+type Redactor map[string]bool
+
+func NewRedactor(headers []string) Redactor {
+	r := Redactor{}
+	for _, header := range append(append([]string(nil), DefaultRedactedHeaders...), headers...) {
+		if header = strings.TrimSpace(header); header != "" {
+			r[http.CanonicalHeaderKey(header)] = true
+		}
+	}
+	return r
+}
+
+// Headers renders h as space separated name=value pairs sorted by name.
+func (r Redactor) Headers(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		value := "***"
+		if !r[http.CanonicalHeaderKey(name)] {
+			value = strings.Join(h[name], ", ")
+		}
+		pairs = append(pairs, name+"="+strconv.Quote(value))
+	}
+	return strings.Join(pairs, " ")
+}
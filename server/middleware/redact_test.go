@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const secret = "s3cr3t-token-value"
+
+// captureLog returns what the standard logger writes during the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(out) })
+	return &buf
+}
+
+func secretRequest(method, target string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader("data"))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	req.Header.Set("X-File-Password", secret)
+	req.Header.Set("Cookie", "session="+secret)
+	req.Header.Set("X-Custom-Secret", secret)
+	req.Header.Set("User-Agent", "tests")
+	return req
+}
+
+func TestRedactorHeaders(t *testing.T) {
+	got := NewRedactor([]string{" x-custom-secret ", ""}).Headers(secretRequest("GET", "/").Header)
+	want := `Authorization="***" Cookie="***" User-Agent="tests" X-Custom-Secret="***" X-File-Password="***"`
+	if got != want {
+		t.Errorf("Headers() = %s, want %s", got, want)
+	}
+}
+
+func TestSecretsStayOutOfLogs(t *testing.T) {
+	redactor := NewRedactor([]string{"X-Custom-Secret"})
+	router := gin.New()
+	router.Use(Recovery(redactor))
+	router.POST("/upload", UploadTelemetry([]float64{1}, []float64{1}, 1, redactor), func(c *gin.Context) {
+		c.Status(http.StatusCreated)
+	})
+	router.GET("/panic", func(c *gin.Context) {
+		panic("handler failed")
+	})
+
+	for _, req := range []*http.Request{secretRequest("POST", "/upload"), secretRequest("GET", "/panic")} {
+		logged := captureLog(t)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		line := logged.String()
+		if !strings.Contains(line, `X-File-Password="***"`) {
+			t.Errorf("%s %s: no masked headers in %q", req.Method, req.URL.Path, line)
+		}
+		if strings.Contains(line, secret) {
+			t.Errorf("%s %s: the secret was logged: %q", req.Method, req.URL.Path, line)
+		}
+	}
+}
+
+func TestRecoveryAnswers500(t *testing.T) {
+	captureLog(t)
+	router := gin.New()
+	router.Use(Recovery(NewRedactor(nil)))
+	router.GET("/panic", func(c *gin.Context) {
+		panic("handler failed")
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"io"
+	"log"
+	"math/rand/v2"
+	"messangere/metrics"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+func uploadOutcome(status int) string {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return "failed"
+	case status >= http.StatusBadRequest:
+		return "rejected"
+	default:
+		return "success"
+	}
+}
+
+// UploadTelemetry records the size, duration and outcome of every upload in
+// histograms and logs the full details of a sampled fraction of requests,
+// with sensitive headers masked by redactor.
+func UploadTelemetry(sizeBuckets, durationBuckets []float64, sampleRate float64, redactor Redactor) gin.HandlerFunc {
+	sizes := metrics.NewHistogram("upload_request_bytes", "Bytes read from upload request bodies.", sizeBuckets)
+	durations := metrics.NewHistogram("upload_request_duration_seconds", "Time spent handling upload requests.", durationBuckets)
+	outcomes := metrics.NewCounterVec("upload_requests_total", "Upload requests by outcome.", "outcome")
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		body := &countingBody{ReadCloser: c.Request.Body}
+		c.Request.Body = body
+
+		c.Next()
+
+		elapsed := time.Since(start)
+		read := body.n.Load()
+		status := c.Writer.Status()
+		sizes.Observe(float64(read))
+		durations.Observe(elapsed.Seconds())
+		outcomes.Inc(uploadOutcome(status))
+
+		if sampleRate > 0 && rand.Float64() < sampleRate {
+			log.Printf("Upload sample: status=%d bytes=%d content_length=%d duration=%s client=%s headers: %s",
+				status, read, c.Request.ContentLength, elapsed, c.ClientIP(), redactor.Headers(c.Request.Header))
+		}
+	}
+}
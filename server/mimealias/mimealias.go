@@ -0,0 +1,76 @@
+package mimealias
+
+import (
+	"mime"
+	"strings"
+)
+
+// Defaults maps mimetypes clients commonly send to the canonical type of
+// the same format.
+var Defaults = map[string]string{
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"image/x-png":                  "image/png",
+	"image/x-icon":                 "image/vnd.microsoft.icon",
+	"image/x-ms-bmp":               "image/bmp",
+	"text/xml":                     "application/xml",
+	"application/x-javascript":     "text/javascript",
+	"application/javascript":       "text/javascript",
+	"text/x-markdown":              "text/markdown",
+	"audio/mp3":                    "audio/mpeg",
+	"audio/x-wav":                  "audio/wav",
+	"audio/wave":                   "audio/wav",
+	"audio/x-flac":                 "audio/flac",
+	"application/x-pdf":            "application/pdf",
+	"application/x-zip-compressed": "application/zip",
+	"application/x-gzip":           "application/gzip",
+	"video/x-matroska":             "video/matroska",
+}
+
+// Table maps aliases to canonical mimetypes, all lower case.
+type Table map[string]string
+
+// New returns the defaults extended, or overridden, by extra.
+func New(extra map[string]string) Table {
+	t := make(Table, len(Defaults)+len(extra))
+	for alias, canonical := range Defaults {
+		t[alias] = canonical
+	}
+	for alias, canonical := range extra {
+		t[strings.ToLower(alias)] = strings.ToLower(canonical)
+	}
+	return t
+}
+
+// Normalize lower-cases the mimetype and replaces a known alias by its
+// canonical type. Parameters such as charset are kept; values that don't
+// parse are returned trimmed but otherwise unchanged.
+func (t Table) Normalize(mimetype string) string {
+	mediatype, params, err := mime.ParseMediaType(mimetype)
+	if err != nil {
+		return strings.TrimSpace(mimetype)
+	}
+	if canonical, ok := t[mediatype]; ok {
+		mediatype = canonical
+	}
+	if len(params) == 0 {
+		return mediatype
+	}
+	return mime.FormatMediaType(mediatype, params)
+}
+
+// Variants returns the normalized mimetype followed by every alias of it,
+// so filters also match rows stored before normalization.
+func (t Table) Variants(mimetype string) []string {
+	canonical := t.Normalize(mimetype)
+	variants := []string{canonical}
+	if mimetype != canonical {
+		variants = append(variants, mimetype)
+	}
+	for alias, target := range t {
+		if target == canonical && alias != mimetype {
+			variants = append(variants, alias)
+		}
+	}
+	return variants
+}
@@ -0,0 +1,78 @@
+package namepolicy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rules a name can break, reported in Violation.Rule.
+const (
+	RulePattern    = "pattern"
+	RulePrefix     = "prefix"
+	RuleSpaces     = "spaces"
+	RuleCharacters = "characters"
+	RuleLength     = "length"
+)
+
+// Policy is a filename convention. The zero value allows every name.
+type Policy struct {
+	// Pattern must match the name, see Compile.
+	Pattern *regexp.Regexp
+	// Prefixes, when set, are the prefixes a name may start with.
+	Prefixes []string
+	NoSpaces bool
+	// Forbidden lists characters names must not contain.
+	Forbidden string
+	// MaxLength is in characters, zero for no limit.
+	MaxLength int
+}
+
+// Violation is a rule a name breaks.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Compile compiles a Pattern anchored at both ends, so it has to match
+// the whole name rather than a part of it.
+func Compile(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(`^(?:` + pattern + `)$`)
+}
+
+// Check returns every rule the name breaks, none when it's acceptable.
+func (p Policy) Check(name string) []Violation {
+	var violations []Violation
+	if p.MaxLength > 0 && utf8.RuneCountInString(name) > p.MaxLength {
+		violations = append(violations, Violation{RuleLength,
+			fmt.Sprintf("the name is longer than %d characters", p.MaxLength)})
+	}
+	if p.NoSpaces && strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+		violations = append(violations, Violation{RuleSpaces, "the name contains spaces"})
+	}
+	if i := strings.IndexAny(name, p.Forbidden); p.Forbidden != "" && i >= 0 {
+		char, _ := utf8.DecodeRuneInString(name[i:])
+		violations = append(violations, Violation{RuleCharacters,
+			fmt.Sprintf("the name contains the forbidden character %q", char)})
+	}
+	if len(p.Prefixes) > 0 && !hasPrefix(name, p.Prefixes) {
+		violations = append(violations, Violation{RulePrefix,
+			"the name must start with one of " + strings.Join(p.Prefixes, ", ")})
+	}
+	if p.Pattern != nil && !p.Pattern.MatchString(name) {
+		violations = append(violations, Violation{RulePattern,
+			"the name doesn't match " + p.Pattern.String()})
+	}
+	return violations
+}
+
+func hasPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package naming
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Template builds download file names from placeholders:
+//
+//	{id}   the file ID
+//	{name} the uploaded name
+//	{base} the uploaded name without its extension
+//	{ext}  the extension including the dot, or nothing
+//	{date} the upload date as 2006-01-02
+//
+// Any other text is copied as is.
+type Template struct {
+	parts []part
+}
+
+type part struct {
+	literal     string
+	placeholder string
+}
+
+var placeholders = map[string]bool{"id": true, "name": true, "base": true, "ext": true, "date": true}
+
+// Parse checks a template; unknown placeholders and unbalanced braces are
+// errors.
+func Parse(template string) (Template, error) {
+	var t Template
+	rest := template
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, part{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return Template{}, errors.New("unexpected }")
+		}
+		if open > 0 {
+			t.parts = append(t.parts, part{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return Template{}, errors.New("unclosed {")
+		}
+		name := rest[open+1 : open+end]
+		if !placeholders[name] {
+			return Template{}, fmt.Errorf("unknown placeholder {%s}", name)
+		}
+		t.parts = append(t.parts, part{placeholder: name})
+		rest = rest[open+end+1:]
+	}
+	if len(t.parts) == 0 {
+		return Template{}, errors.New("template is empty")
+	}
+	return t, nil
+}
+
+// Execute returns the name for a file. The result holds no path
+// separators or control characters; when nothing is left of it the
+// uploaded name is returned.
+func (t Template) Execute(id uint64, name string, created time.Time) string {
+	ext := filepath.Ext(name)
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch p.placeholder {
+		case "":
+			b.WriteString(p.literal)
+		case "id":
+			b.WriteString(strconv.FormatUint(id, 10))
+		case "name":
+			b.WriteString(name)
+		case "base":
+			b.WriteString(strings.TrimSuffix(name, ext))
+		case "ext":
+			b.WriteString(ext)
+		case "date":
+			b.WriteString(created.UTC().Format(time.DateOnly))
+		}
+	}
+	result := strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '/' || r == '\\' {
+			return -1
+		}
+		return r
+	}, b.String()))
+	if result == "" || result == "." || result == ".." {
+		return name
+	}
+	return result
+}
@@ -0,0 +1,26 @@
+package naming
+
+import (
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// Truncate shortens name to at most max bytes and reports whether it had
+// to. The extension is kept unless it takes more than half of max, and
+// the cut never splits a multi-byte UTF-8 sequence. A max of 0 or less
+// keeps every name.
+func Truncate(name string, max int) (string, bool) {
+	if max <= 0 || len(name) <= max {
+		return name, false
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > max/2 {
+		ext = ""
+	}
+	base := name[:len(name)-len(ext)]
+	cut := max - len(ext)
+	for cut > 0 && !utf8.RuneStart(base[cut]) {
+		cut--
+	}
+	return base[:cut] + ext, true
+}
@@ -0,0 +1,42 @@
+package naming
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		max       int
+		want      string
+		truncated bool
+	}{
+		{"short enough", "report.pdf", 255, "report.pdf", false},
+		{"exactly max", "abcdef.txt", 10, "abcdef.txt", false},
+		{"no limit", "a very long name.txt", 0, "a very long name.txt", false},
+		{"ascii over the limit", "abcdefghij.txt", 10, "abcdef.txt", true},
+		{"no extension", "abcdefghijklmnop", 10, "abcdefghij", true},
+		{"cyrillic not split", "приветствие.txt", 11, "при.txt", true},
+		{"cyrillic on a rune boundary", "приветствие.txt", 12, "прив.txt", true},
+		{"emoji not split", "😀😀😀.png", 10, "😀.png", true},
+		{"extension of half of max kept", "abcdefghij.abcd", 10, "abcde.abcd", true},
+		{"extension over half of max dropped", "a.verylongextension", 10, "a.verylong", true},
+		{"multi-byte extension over half dropped", "файл.расширение", 12, "файл.р", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := Truncate(tt.input, tt.max)
+			if got != tt.want || truncated != tt.truncated {
+				t.Errorf("Truncate(%q, %d) = %q, %v, want %q, %v", tt.input, tt.max, got, truncated, tt.want, tt.truncated)
+			}
+			if tt.max > 0 && len(got) > tt.max {
+				t.Errorf("Truncate(%q, %d) is %d bytes", tt.input, tt.max, len(got))
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("Truncate(%q, %d) = %q isn't valid UTF-8", tt.input, tt.max, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// Scan runs the configured scan command with the file path appended as the
+// last argument. It follows the clamscan convention: exit code 0 means the
+// file is clean, exit code 1 means it is infected, anything else is an error.
+func Scan(command []string, path string, timeout time.Duration) (infected bool, err error) {
+	if len(command) == 0 {
+		return false, errors.New("no scan command configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	args := append(append([]string(nil), command[1:]...), path)
+	output, err := exec.CommandContext(ctx, command[0], args...).CombinedOutput()
+	if err == nil {
+		return false, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return true, nil
+	}
+	return false, fmt.Errorf("scan failed: %w: %s", err, output)
+}
@@ -0,0 +1,75 @@
+package scope
+
+import "strings"
+
+// Scope is something an API token is allowed to do.
+type Scope string
+
+const (
+	Read   Scope = "read"
+	Write  Scope = "write"
+	Delete Scope = "delete"
+	Admin  Scope = "admin"
+)
+
+// Set is the scopes of one token.
+type Set []Scope
+
+// Default is what a token listed without scopes may do, everything tokens
+// could do before they had scopes. Admin has to be granted explicitly.
+var Default = Set{Read, Write, Delete}
+
+// All is the scopes of ADMIN_TOKEN.
+var All = Set{Read, Write, Delete, Admin}
+
+// Anonymous is what requests without a token may do. Without API tokens
+// everyone is anonymous and may do everything tokens could. Once tokens
+// are configured anonymous callers only read, otherwise anyone holding a
+// read-only token could drop it and write anyway.
+func Anonymous(tokensConfigured bool) Set {
+	if tokensConfigured {
+		return Set{Read}
+	}
+	return Default
+}
+
+// Token is an API token: the user it authenticates and its scopes.
+type Token struct {
+	User   string
+	Scopes Set
+}
+
+// Parse reads scopes separated by +, e.g. read+write. It reports false
+// for an empty list or an unknown scope.
+func Parse(value string) (Set, bool) {
+	var set Set
+	for _, name := range strings.Split(value, "+") {
+		s := Scope(strings.ToLower(strings.TrimSpace(name)))
+		switch s {
+		case Read, Write, Delete, Admin:
+		default:
+			return nil, false
+		}
+		if !set.Has(s) {
+			set = append(set, s)
+		}
+	}
+	return set, true
+}
+
+func (set Set) Has(s Scope) bool {
+	for _, granted := range set {
+		if granted == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (set Set) String() string {
+	names := make([]string, len(set))
+	for i, s := range set {
+		names[i] = string(s)
+	}
+	return strings.Join(names, "+")
+}
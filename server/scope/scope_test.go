@@ -0,0 +1,38 @@
+package scope
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Set
+		ok    bool
+	}{
+		{"read", Set{Read}, true},
+		{"read+write", Set{Read, Write}, true},
+		{" Delete + read + delete", Set{Delete, Read}, true},
+		{"admin", Set{Admin}, true},
+		{"", nil, false},
+		{"read+", nil, false},
+		{"read+upload", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := Parse(tt.value)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAnonymous(t *testing.T) {
+	if got := Anonymous(false); !reflect.DeepEqual(got, Default) {
+		t.Errorf("Anonymous(false) = %v, want %v", got, Default)
+	}
+	got := Anonymous(true)
+	if !got.Has(Read) || got.Has(Write) || got.Has(Delete) || got.Has(Admin) {
+		t.Errorf("Anonymous(true) = %v, want read only", got)
+	}
+}
@@ -0,0 +1,102 @@
+package sensitive
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"mime"
+	"path"
+	"strings"
+)
+
+// documentTypes are the office formats ScanDocument reads: zip archives
+// whose text is in XML parts.
+var documentTypes = map[string]bool{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         true,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": true,
+	"application/vnd.oasis.opendocument.text":                                   true,
+	"application/vnd.oasis.opendocument.spreadsheet":                            true,
+	"application/vnd.oasis.opendocument.presentation":                           true,
+}
+
+// textParts match the archive members holding the text of a document.
+var textParts = []string{
+	"word/document.xml", "word/header*.xml", "word/footer*.xml",
+	"xl/sharedStrings.xml", "xl/worksheets/*.xml",
+	"ppt/slides/*.xml",
+	"content.xml",
+}
+
+// blockElements end a paragraph, cell or shared string, their text is kept
+// apart so numbers from neighbouring cells don't run together.
+var blockElements = map[string]bool{"p": true, "h": true, "si": true, "c": true, "tc": true, "table-cell": true}
+
+// Document reports whether ScanDocument can read files of the media type.
+func Document(mimetype string) bool {
+	mediatype, _, err := mime.ParseMediaType(mimetype)
+	return err == nil && documentTypes[mediatype]
+}
+
+// ScanDocument is Scan for the text of an office document, at most limit
+// bytes of it.
+func ScanDocument(src string, limit int64, patterns []Pattern) ([]string, error) {
+	archive, err := zip.OpenReader(src)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	var text bytes.Buffer
+	for _, member := range archive.File {
+		if int64(text.Len()) >= limit {
+			break
+		}
+		if !textPart(member.Name) {
+			continue
+		}
+		part, err := member.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = extractText(&text, io.LimitReader(part, limit), limit)
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return Scan(&text, limit, patterns)
+}
+
+func textPart(name string) bool {
+	for _, pattern := range textParts {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// extractText appends the character data of an XML part to text, a line
+// per block element, until text holds limit bytes.
+func extractText(text *bytes.Buffer, part io.Reader, limit int64) error {
+	decoder := xml.NewDecoder(part)
+	for int64(text.Len()) < limit {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.CharData:
+			text.Write(token)
+		case xml.EndElement:
+			if blockElements[strings.ToLower(token.Name.Local)] {
+				text.WriteByte('\n')
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package sensitive
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Pattern is a named regular expression for one kind of sensitive data.
+// Valid, when set, has to accept a match for it to count, for data the
+// expression alone can't tell from other numbers.
+type Pattern struct {
+	Name   string
+	Regexp *regexp.Regexp
+	Valid  func(match []byte) bool
+}
+
+// Defaults is used when no pattern file is configured.
+var Defaults = []Pattern{
+	{"credit_card", regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), Luhn},
+	{"ssn", regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), nil},
+	{"aws_access_key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), nil},
+	{"private_key", regexp.MustCompile(`-----BEGIN (?:[A-Z]+ )?PRIVATE KEY-----`), nil},
+	{"api_key", regexp.MustCompile(`(?i)\b(?:api[_-]?key|secret|token)\s*[:=]\s*['"]?[0-9a-z_\-]{20,}`), nil},
+}
+
+// validators are attached by Load to patterns of the same name.
+var validators = map[string]func([]byte) bool{
+	"credit_card": Luhn,
+}
+
+// Luhn reports whether the digits of match pass the Luhn check all card
+// numbers carry. Other characters, the spaces and dashes between groups,
+// are skipped.
+func Luhn(match []byte) bool {
+	sum, digits := 0, 0
+	for i := len(match) - 1; i >= 0; i-- {
+		c := match[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits > 0 && sum%10 == 0
+}
+
+// Load reads patterns from a file with one "name: regexp" per line. Blank
+// lines and lines starting with # are skipped. An empty path returns the
+// defaults.
+func Load(path string) ([]Pattern, error) {
+	if path == "" {
+		return Defaults, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []Pattern
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, expr, ok := strings.Cut(line, ":")
+		name, expr = strings.TrimSpace(name), strings.TrimSpace(expr)
+		if !ok || name == "" || expr == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"name: regexp\"", path, n)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		patterns = append(patterns, Pattern{name, re, validators[name]})
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("%s: no patterns", path)
+	}
+	return patterns, nil
+}
+
+// Scan reads at most limit bytes of content and returns the names of the
+// patterns found in it. The matched values themselves are never returned.
+func Scan(content io.Reader, limit int64, patterns []Pattern) ([]string, error) {
+	data, err := io.ReadAll(io.LimitReader(content, limit))
+	if err != nil {
+		return nil, err
+	}
+	var matched []string
+	for _, p := range patterns {
+		if p.found(data) {
+			matched = append(matched, p.Name)
+		}
+	}
+	return matched, nil
+}
+
+func (p Pattern) found(data []byte) bool {
+	if p.Valid == nil {
+		return p.Regexp.Match(data)
+	}
+	for _, match := range p.Regexp.FindAll(data, -1) {
+		if p.Valid(match) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package signature
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HeaderSize is how much of a file Detect needs to see.
+const HeaderSize = 64
+
+// Unknown is the name Detect reports for files matching no signature.
+const Unknown = "unknown"
+
+// Signature identifies a file type by the bytes at Offset. Mimetypes are
+// the declared types a file with this signature can legitimately have.
+type Signature struct {
+	Name      string
+	Offset    int
+	Magic     []byte
+	Mimetypes []string
+}
+
+// Defaults is the built-in table. More specific entries come first, the
+// first match wins.
+var Defaults = []Signature{
+	{"png", 0, []byte("\x89PNG\r\n\x1a\n"), []string{"image/png", "image/apng"}},
+	{"jpeg", 0, []byte("\xff\xd8\xff"), []string{"image/jpeg", "image/pjpeg"}},
+	{"gif", 0, []byte("GIF8"), []string{"image/gif"}},
+	{"webp", 8, []byte("WEBP"), []string{"image/webp"}},
+	{"wav", 8, []byte("WAVE"), []string{"audio/wav", "audio/x-wav", "audio/wave"}},
+	{"avi", 8, []byte("AVI "), []string{"video/x-msvideo", "video/avi"}},
+	{"bmp", 0, []byte("BM"), []string{"image/bmp", "image/x-ms-bmp"}},
+	{"tiff", 0, []byte("II*\x00"), []string{"image/tiff"}},
+	{"tiff", 0, []byte("MM\x00*"), []string{"image/tiff"}},
+	{"iso_media", 4, []byte("ftyp"), []string{"video/mp4", "video/quicktime", "audio/mp4", "audio/x-m4a",
+		"video/3gpp", "image/heic", "image/heif", "image/avif"}},
+	{"webm", 0, []byte("\x1a\x45\xdf\xa3"), []string{"video/webm", "audio/webm", "video/x-matroska"}},
+	{"ogg", 0, []byte("OggS"), []string{"audio/ogg", "video/ogg", "application/ogg", "audio/opus"}},
+	{"mp3", 0, []byte("ID3"), []string{"audio/mpeg", "audio/mp3"}},
+	// MP3 files without an ID3 tag start with the frame sync of an MPEG-1
+	// or MPEG-2 layer III frame.
+	{"mp3", 0, []byte("\xff\xfb"), []string{"audio/mpeg", "audio/mp3"}},
+	{"mp3", 0, []byte("\xff\xf3"), []string{"audio/mpeg", "audio/mp3"}},
+	{"flac", 0, []byte("fLaC"), []string{"audio/flac", "audio/x-flac"}},
+	{"pdf", 0, []byte("%PDF-"), []string{"application/pdf"}},
+	{"zip", 0, []byte("PK\x03\x04"), []string{"application/zip", "application/x-zip-compressed",
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		"application/vnd.oasis.opendocument.text", "application/vnd.oasis.opendocument.spreadsheet",
+		"application/epub+zip", "application/java-archive", "application/vnd.android.package-archive"}},
+	{"gzip", 0, []byte("\x1f\x8b"), []string{"application/gzip", "application/x-gzip"}},
+	{"7z", 0, []byte("7z\xbc\xaf\x27\x1c"), []string{"application/x-7z-compressed"}},
+	{"rar", 0, []byte("Rar!\x1a\x07"), []string{"application/vnd.rar", "application/x-rar-compressed"}},
+	{"exe", 0, []byte("MZ"), []string{"application/vnd.microsoft.portable-executable", "application/x-msdownload",
+		"application/x-dosexec"}},
+	{"elf", 0, []byte("\x7fELF"), []string{"application/x-executable", "application/x-elf", "application/x-sharedlib"}},
+	{"macho", 0, []byte("\xcf\xfa\xed\xfe"), []string{"application/x-mach-binary"}},
+	{"macho", 0, []byte("\xca\xfe\xba\xbe"), []string{"application/x-mach-binary", "application/java-vm"}},
+}
+
+// Executables are the signatures of programs. They only match the types
+// their signature lists, never a declared type no signature knows.
+var Executables = map[string]bool{"exe": true, "elf": true, "macho": true}
+
+// Load returns the built-in table extended by the signatures in path, one
+// "name: offset hex-magic [mimetype...]" per line. Blank lines and lines
+// starting with # are skipped. Entries from the file are checked first, so
+// they can refine built-in ones.
+func Load(path string) ([]Signature, error) {
+	if path == "" {
+		return Defaults, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var signatures []Signature
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, rest, ok := strings.Cut(line, ":")
+		name, fields := strings.TrimSpace(name), strings.Fields(rest)
+		if !ok || name == "" || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"name: offset hex-magic [mimetype...]\"", path, n)
+		}
+		offset, err := strconv.Atoi(fields[0])
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid offset %q", path, n, fields[0])
+		}
+		magic, err := hex.DecodeString(fields[1])
+		if err != nil || len(magic) == 0 {
+			return nil, fmt.Errorf("%s:%d: invalid magic %q", path, n, fields[1])
+		}
+		if offset+len(magic) > HeaderSize {
+			return nil, fmt.Errorf("%s:%d: signature ends after the first %d bytes", path, n, HeaderSize)
+		}
+		signatures = append(signatures, Signature{name, offset, magic, fields[2:]})
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	return append(signatures, Defaults...), nil
+}
+
+// Detect returns the name of the first signature matching header, or
+// Unknown.
+func Detect(header []byte, signatures []Signature) string {
+	for _, s := range signatures {
+		end := s.Offset + len(s.Magic)
+		if end <= len(header) && bytes.Equal(header[s.Offset:end], s.Magic) {
+			return s.Name
+		}
+	}
+	return Unknown
+}
+
+// DetectFile reads the header of the file at path and detects its type.
+func DetectFile(path string, signatures []Signature) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return DetectReader(f, signatures)
+}
+
+// DetectReader reads the header of content and detects its type.
+func DetectReader(content io.Reader, signatures []Signature) (string, error) {
+	header := make([]byte, HeaderSize)
+	n, err := io.ReadFull(content, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return Detect(header[:n], signatures), nil
+}
+
+// Matches reports whether a file detected as name may be declared with the
+// mimetype. Declared types no signature lists can't be checked and match
+// anything but an executable.
+func Matches(name, mimetype string, signatures []Signature) bool {
+	mimetype = strings.ToLower(strings.TrimSpace(strings.Split(mimetype, ";")[0]))
+	known := false
+	for _, s := range signatures {
+		for _, m := range s.Mimetypes {
+			if m != mimetype {
+				continue
+			}
+			if s.Name == name {
+				return true
+			}
+			known = true
+		}
+	}
+	return !known && !Executables[name]
+}
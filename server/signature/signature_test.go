@@ -0,0 +1,88 @@
+package signature
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"\x89PNG\r\n\x1a\n\x00\x00", "png"},
+		{"\xff\xd8\xff\xe0", "jpeg"},
+		{"RIFF\x00\x00\x00\x00WEBPVP8 ", "webp"},
+		{"ID3\x04\x00", "mp3"},
+		{"\xff\xfb\x90\x64", "mp3"},
+		{"\xff\xf3\x48\xc4", "mp3"},
+		{"MZ\x90\x00", "exe"},
+		{"\x7fELF\x02\x01", "elf"},
+		{"hello world", Unknown},
+		{"", Unknown},
+	}
+	for _, tt := range tests {
+		if got := Detect([]byte(tt.header), Defaults); got != tt.want {
+			t.Errorf("Detect(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimetype string
+		want     bool
+	}{
+		{"png", "image/png", true},
+		{"png", "IMAGE/PNG; charset=binary", true},
+		{"png", "image/jpeg", false},
+		{"mp3", "audio/mpeg", true},
+		{"exe", "image/png", false},
+		{"unknown", "image/png", false},
+		// Types no signature lists can't be checked.
+		{"unknown", "text/plain", true},
+		{"png", "text/plain", true},
+		// Except for executables, whatever they are declared as.
+		{"exe", "text/plain", false},
+		{"elf", "application/octet-stream", false},
+		{"macho", "", false},
+		{"exe", "application/x-msdownload", true},
+	}
+	for _, tt := range tests {
+		if got := Matches(tt.name, tt.mimetype, Defaults); got != tt.want {
+			t.Errorf("Matches(%s, %q) = %v, want %v", tt.name, tt.mimetype, got, tt.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signatures")
+	content := "# extra types\n\nsqlite: 0 53514c69746520666f726d6174 application/vnd.sqlite3\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	signatures, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signatures) != len(Defaults)+1 || signatures[0].Name != "sqlite" {
+		t.Fatalf("Load() = %d signatures starting with %s", len(signatures), signatures[0].Name)
+	}
+	if got := Detect([]byte("SQLite format 3\x00"), signatures); got != "sqlite" {
+		t.Errorf("Detect() = %s, want sqlite", got)
+	}
+	if !Matches("sqlite", "application/vnd.sqlite3", signatures) {
+		t.Error("sqlite doesn't match its own type")
+	}
+
+	for _, line := range []string{"broken", "x: -1 00", "x: 0 zz", "x: 63 0000"} {
+		if err := os.WriteFile(path, []byte(line+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("Load(%q) succeeded", line)
+		}
+	}
+}
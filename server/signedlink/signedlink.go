@@ -0,0 +1,31 @@
+package signedlink
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// Sign returns the signature allowing a download of the file until expires
+// without credentials.
+func Sign(key string, fileID uint64, expires time.Time) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strconv.FormatUint(fileID, 10) + ":" + strconv.FormatInt(expires.Unix(), 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature and the expiry it was made for, given as Unix
+// seconds.
+func Verify(key string, fileID uint64, expires, signature string) bool {
+	if key == "" || signature == "" {
+		return false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	want := Sign(key, fileID, time.Unix(unix, 0))
+	return hmac.Equal([]byte(want), []byte(signature))
+}
@@ -0,0 +1,45 @@
+package throttle
+
+import "sync"
+
+// Slots caps how many holders a key may have at once, e.g. concurrent
+// downloads per user. Keys without holders are forgotten, so the map only
+// grows with the number of active keys. A limit of zero or less disables
+// the cap.
+type Slots struct {
+	mu    sync.Mutex
+	limit int
+	held  map[string]int
+}
+
+func NewSlots(limit int) *Slots {
+	return &Slots{limit: limit, held: make(map[string]int)}
+}
+
+// Acquire takes a slot for key and reports whether one was free. Every
+// successful Acquire must be paired with a Release.
+func (s *Slots) Acquire(key string) bool {
+	if s.limit <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held[key] >= s.limit {
+		return false
+	}
+	s.held[key]++
+	return true
+}
+
+func (s *Slots) Release(key string) {
+	if s.limit <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held[key] <= 1 {
+		delete(s.held, key)
+		return
+	}
+	s.held[key]--
+}
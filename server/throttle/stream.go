@@ -0,0 +1,67 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StallWriter drops clients that stop reading. Before every write the
+// connection's write deadline is moved timeout into the future, so a slow
+// but progressing client is served while a write blocked for longer than
+// timeout fails and lets the handler return. Call Clear when done so the
+// deadline doesn't carry over to the next request on the connection.
+type StallWriter struct {
+	gin.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func NewStallWriter(w gin.ResponseWriter, timeout time.Duration) *StallWriter {
+	return &StallWriter{ResponseWriter: w, rc: http.NewResponseController(w), timeout: timeout}
+}
+
+func (w *StallWriter) Write(p []byte) (int, error) {
+	w.rc.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *StallWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *StallWriter) Clear() {
+	w.rc.SetWriteDeadline(time.Time{})
+}
+
+// ContextReader stops reading once ctx is done, so a copy to a client that
+// went away ends at the next chunk instead of running to the end of the
+// file.
+type ContextReader struct {
+	Ctx context.Context
+	io.Reader
+}
+
+func (r ContextReader) Read(p []byte) (int, error) {
+	if err := r.Ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// ContextReadSeeker is ContextReader for content served with
+// http.ServeContent.
+type ContextReadSeeker struct {
+	Ctx context.Context
+	io.ReadSeeker
+}
+
+func (r ContextReadSeeker) Read(p []byte) (int, error) {
+	if err := r.Ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadSeeker.Read(p)
+}
@@ -0,0 +1,75 @@
+package throttle
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Writer limits the bytes written through it with a token bucket refilled
+// continuously at rate bytes per second. Writes are split into small chunks
+// so the output is paced smoothly instead of in bursts.
+type Writer struct {
+	gin.ResponseWriter
+	ctx    context.Context
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewWriter(ctx context.Context, w gin.ResponseWriter, bytesPerSecond int64) *Writer {
+	rate := float64(bytesPerSecond)
+	// A tenth of a second worth of data, but never less than 1 KiB.
+	burst := max(rate/10, 1024)
+	return &Writer{
+		ResponseWriter: w,
+		ctx:            ctx,
+		rate:           rate,
+		burst:          burst,
+		tokens:         burst,
+		last:           time.Now(),
+	}
+}
+
+func (t *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := min(len(p), int(t.burst))
+		if err := t.wait(chunk); err != nil {
+			return written, err
+		}
+		n, err := t.ResponseWriter.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+func (t *Writer) WriteString(s string) (int, error) {
+	return t.Write([]byte(s))
+}
+
+func (t *Writer) wait(n int) error {
+	now := time.Now()
+	t.tokens = min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	need := float64(n) - t.tokens
+	if need > 0 {
+		timer := time.NewTimer(time.Duration(need / t.rate * float64(time.Second)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		}
+		t.tokens = float64(n)
+		t.last = time.Now()
+	}
+	t.tokens -= float64(n)
+	return nil
+}
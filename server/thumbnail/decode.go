@@ -0,0 +1,41 @@
+package thumbnail
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+// ErrTooLarge is returned for images with more pixels than allowed.
+var ErrTooLarge = errors.New("image is too large")
+
+// decode reads the image at src. The dimensions are taken from the header
+// first, so an image declaring more than maxPixels pixels is refused before
+// its pixel buffer is allocated. A maxPixels of zero or less disables the
+// check.
+func decode(src string, maxPixels int64) (image.Image, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	if maxPixels > 0 {
+		config, _, err := image.DecodeConfig(in)
+		if err != nil {
+			return nil, fmt.Errorf("decode image header: %w", err)
+		}
+		if pixels := int64(config.Width) * int64(config.Height); pixels > maxPixels {
+			return nil, fmt.Errorf("%w: %dx%d is more than %d pixels", ErrTooLarge, config.Width, config.Height, maxPixels)
+		}
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	img, _, err := image.Decode(in)
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	return img, nil
+}
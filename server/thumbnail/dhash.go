@@ -0,0 +1,33 @@
+package thumbnail
+
+import (
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+)
+
+// DHash computes the 64-bit difference hash of an image: it is shrunk to
+// 9x8 grayscale pixels and each bit tells whether a pixel is brighter than
+// its right neighbour. Resaves and small edits change only a few bits, so
+// the Hamming distance between hashes measures how similar images look.
+// Images of more than maxPixels pixels fail with ErrTooLarge.
+func DHash(src string, maxPixels int64) (uint64, error) {
+	img, err := decode(src, maxPixels)
+	if err != nil {
+		return 0, err
+	}
+
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.At(x, y).(color.Gray).Y > small.At(x+1, y).(color.Gray).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
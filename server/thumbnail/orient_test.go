@@ -0,0 +1,147 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withOrientation returns a JPEG of img with an EXIF segment holding the
+// orientation, in the byte order given.
+func withOrientation(t *testing.T, img image.Image, orientation uint16, order binary.ByteOrder) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8))
+	// One IFD0 entry: tag, SHORT type, count 1, the value padded to four
+	// bytes; then no next IFD.
+	binary.Write(&tiff, order, uint16(1))
+	binary.Write(&tiff, order, []uint16{0x0112, 3})
+	binary.Write(&tiff, order, uint32(1))
+	binary.Write(&tiff, order, []uint16{orientation, 0})
+	binary.Write(&tiff, order, uint32(0))
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2])
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(segment)+2))
+	out.Write(segment)
+	out.Write(encoded.Bytes()[2:])
+	return out.Bytes()
+}
+
+func TestOrientation(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			data := withOrientation(t, img, orientation, order)
+			if got := Orientation(bytes.NewReader(data)); got != int(orientation) {
+				t.Errorf("orientation %d in %v: Orientation() = %d", orientation, order, got)
+			}
+		}
+	}
+
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, img, nil)
+	exif := withOrientation(t, img, 6, binary.BigEndian)
+	for name, data := range map[string][]byte{
+		"no EXIF":           plain.Bytes(),
+		"not a JPEG":        []byte("\x89PNG\r\n\x1a\n"),
+		"empty":             nil,
+		"invalid value":     withOrientation(t, img, 9, binary.BigEndian),
+		"truncated segment": exif[:30],
+	} {
+		if got := Orientation(bytes.NewReader(data)); got != 1 {
+			t.Errorf("%s: Orientation() = %d, want 1", name, got)
+		}
+	}
+}
+
+func TestOrientPixels(t *testing.T) {
+	// A 3x2 image with its top-left pixel red and top-right pixel blue.
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	src.Set(0, 0, red)
+	src.Set(2, 0, blue)
+	// Where the two corners end up once the image is displayed upright.
+	type point struct{ x, y int }
+	tests := []struct {
+		orientation int
+		width       int
+		red, blue   point
+	}{
+		{1, 3, point{0, 0}, point{2, 0}},
+		{2, 3, point{2, 0}, point{0, 0}},
+		{3, 3, point{2, 1}, point{0, 1}},
+		{4, 3, point{0, 1}, point{2, 1}},
+		{5, 2, point{0, 0}, point{0, 2}},
+		{6, 2, point{1, 0}, point{1, 2}},
+		{7, 2, point{1, 2}, point{1, 0}},
+		{8, 2, point{0, 2}, point{0, 0}},
+	}
+	for _, tt := range tests {
+		dst := orient(src, tt.orientation)
+		if got := dst.Bounds().Dx(); got != tt.width {
+			t.Errorf("orientation %d: width %d, want %d", tt.orientation, got, tt.width)
+		}
+		if got := dst.At(tt.red.x, tt.red.y); got != color.Color(red) {
+			t.Errorf("orientation %d: %v at %v, want red", tt.orientation, got, tt.red)
+		}
+		if got := dst.At(tt.blue.x, tt.blue.y); got != color.Color(blue) {
+			t.Errorf("orientation %d: %v at %v, want blue", tt.orientation, got, tt.blue)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	dir := t.TempDir()
+	img := image.NewGray(image.Rect(0, 0, 40, 20))
+	src, dst := filepath.Join(dir, "photo.jpg"), filepath.Join(dir, "upright.jpg")
+
+	for _, orientation := range []uint16{1, 6} {
+		if err := os.WriteFile(src, withOrientation(t, img, orientation, binary.BigEndian), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		rotated, err := Orient(src, dst, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rotated != (orientation != 1) {
+			t.Errorf("orientation %d: Orient() = %v", orientation, rotated)
+		}
+	}
+	f, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	config, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 20 || config.Height != 40 {
+		t.Errorf("upright copy is %dx%d, want 20x40", config.Width, config.Height)
+	}
+	if orientation, _ := FileOrientation(dst); orientation != 1 {
+		t.Errorf("upright copy has orientation %d", orientation)
+	}
+
+	if _, err := Orient(src, dst, 100); err == nil {
+		t.Error("Orient() accepted an image over the pixel limit")
+	}
+}
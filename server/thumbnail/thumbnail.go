@@ -0,0 +1,55 @@
+package thumbnail
+
+import (
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+)
+
+var supported = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+func Supported(mimetype string) bool {
+	return supported[mimetype]
+}
+
+// Generate writes a JPEG thumbnail of src to dst that fits into a
+// maxSize x maxSize box. Images already smaller than the box are only
+// re-encoded. With autoOrient the thumbnail is turned upright by the EXIF
+// orientation of src, which it doesn't keep. Images of more than maxPixels
+// pixels fail with ErrTooLarge.
+func Generate(src, dst string, maxSize int, maxPixels int64, autoOrient bool) error {
+	img, err := decode(src, maxPixels)
+	if err != nil {
+		return err
+	}
+	if autoOrient {
+		orientation, err := FileOrientation(src)
+		if err != nil {
+			return err
+		}
+		img = orient(img, orientation)
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > maxSize || height > maxSize {
+		if width >= height {
+			height = max(1, height*maxSize/width)
+			width = maxSize
+		} else {
+			width = max(1, width*maxSize/height)
+			height = maxSize
+		}
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Over, nil)
+
+	return writeJPEG(dst, thumb, 85)
+}
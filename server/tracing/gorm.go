@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const spanKey = "tracing:span"
+
+// InstrumentDB adds a span for every statement run on db with a context
+// carrying a trace, db.WithContext(ctx). Statements outside a request don't
+// start traces of their own.
+func InstrumentDB(db *gorm.DB) error {
+	callbacks := db.Callback()
+	for _, err := range []error{
+		callbacks.Create().Before("*").Register("tracing:before_create", startStatement("create")),
+		callbacks.Create().After("*").Register("tracing:after_create", endStatement),
+		callbacks.Query().Before("*").Register("tracing:before_query", startStatement("query")),
+		callbacks.Query().After("*").Register("tracing:after_query", endStatement),
+		callbacks.Update().Before("*").Register("tracing:before_update", startStatement("update")),
+		callbacks.Update().After("*").Register("tracing:after_update", endStatement),
+		callbacks.Delete().Before("*").Register("tracing:before_delete", startStatement("delete")),
+		callbacks.Delete().After("*").Register("tracing:after_delete", endStatement),
+		callbacks.Row().Before("*").Register("tracing:before_row", startStatement("row")),
+		callbacks.Row().After("*").Register("tracing:after_row", endStatement),
+		callbacks.Raw().Before("*").Register("tracing:before_raw", startStatement("raw")),
+		callbacks.Raw().After("*").Register("tracing:after_raw", endStatement),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startStatement(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx := db.Statement.Context
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			return
+		}
+		_, span := Start(ctx, "db."+operation,
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.operation", operation),
+			attribute.String("db.sql.table", db.Statement.Table))
+		db.InstanceSet(spanKey, span)
+	}
+}
+
+// endStatement records the SQL, with placeholders and not the values,
+// and the rows the statement affected. A lookup finding nothing isn't an
+// error.
+func endStatement(db *gorm.DB) {
+	value, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	span.SetAttributes(
+		attribute.String("db.statement", db.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", db.RowsAffected))
+	err := db.Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+	}
+	End(span, err)
+}